@@ -0,0 +1,113 @@
+package acd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+	"golang.org/x/oauth2"
+)
+
+const accountURL = "https://drive.amazonaws.com/drive/v1/account"
+
+// AccountInfo is the status of the Cloud Drive account.
+type AccountInfo struct {
+	TermsOfUse string `json:"termsOfUse"`
+	Status     string `json:"status"` // e.g. ACTIVE
+}
+
+// Quota is the storage of the Cloud Drive account in bytes.
+type Quota struct {
+	Quota          int64     `json:"quota"`
+	LastCalculated time.Time `json:"lastCalculated"`
+	Available      int64     `json:"available"`
+}
+
+// Token returns the access token, refreshing it first if it expired.
+func (c *Client) Token() (*oauth2.Token, error) {
+	return c.ts.Token()
+}
+
+// GetAccountInfo returns the status of the account.
+func (c *Client) GetAccountInfo() (*AccountInfo, error) {
+	c.Log(DebugTrace, "[TRC] GetAccountInfo")
+
+	var info AccountInfo
+	err := c.getAccount("info", &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// GetQuota returns the storage quota of the account.
+func (c *Client) GetQuota() (*Quota, error) {
+	c.Log(DebugTrace, "[TRC] GetQuota")
+
+	var quota Quota
+	err := c.getAccount("quota", &quota)
+	if err != nil {
+		return nil, err
+	}
+
+	return &quota, nil
+}
+
+// getAccount decodes account endpoint what into v.
+func (c *Client) getAccount(what string, v interface{}) error {
+	t, err := c.ts.Token()
+	if err != nil {
+		return err
+	}
+
+	url := accountURL + "/" + what
+	c.Log(DebugURL, "[URL] %v", url)
+
+	// create http request
+	req, err := c.newRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
+
+	// execute request
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	c.Log(DebugHTTP, "[HTP] %v", res.Status)
+
+	// obtain body
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	c.Log(DebugBody, "[BDY] %v", string(body))
+
+	if res.StatusCode != http.StatusOK {
+		return NewCombinedError(res.StatusCode, res.Status, body)
+	}
+
+	// convert to JSON
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return err
+	}
+	c.Log(DebugJSON, "[JSN] %v", spew.Sdump(v))
+
+	return nil
+}
+
+// Quota returns the bytes used and the total storage of the account.
+func (c *Client) Quota() (used, total int64, err error) {
+	q, err := c.GetQuota()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return q.Quota - q.Available, q.Quota, nil
+}
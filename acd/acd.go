@@ -1,14 +1,18 @@
 package acd
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httputil"
 	"net/textproto"
+	"strings"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -20,6 +24,7 @@ import (
 const (
 	metadataURL = "https://drive.amazonaws.com/drive/v1/nodes"
 	contentURL  = "https://content-na.drive.amazonaws.com/cdproxy/nodes"
+	trashURL    = "https://drive.amazonaws.com/drive/v1/trash"
 )
 
 // exported contants
@@ -31,6 +36,16 @@ const (
 	StatusTrash     = "TRASH"
 	StatusPurged    = "PURGED"
 
+	// FilterAnd combines filters, e.g. "kind:FILE" + FilterAnd +
+	// FilterAvailable.
+	FilterAnd       = "%20AND%20"
+	FilterOr        = "%20OR%20"
+	FilterAvailable = "status:" + StatusAvailable
+
+	// ResolveBatch is the number of names ResolveNames looks up per
+	// request.  It keeps the query well below URL length limits.
+	ResolveBatch = 50
+
 	DebugTrace = 1 << 0 // function calls
 	DebugHTTP  = 1 << 1 // HTTP return errors
 	DebugURL   = 1 << 2 // URL
@@ -91,24 +106,52 @@ type Asset struct {
 	IsShared   bool `json:"isShared"`
 }
 
+// NodeJSON is the metadata of a node that is created.
 type NodeJSON struct {
-	Name   string   `json:"name"`
-	Kind   string   `json:"kind"`
-	Labels []string `json:"labels,omitempty"`
+	Name        string   `json:"name"`
+	Kind        string   `json:"kind"`
+	Labels      []string `json:"labels,omitempty"`
+	Description string   `json:"description,omitempty"`
 	//Properties
 	Parents []string `json:"parents,omitempty"`
 }
 
+// MoveJSON is the body of a move request.
+type MoveJSON struct {
+	FromParent string `json:"fromParent"`
+	ChildID    string `json:"childId"`
+}
+
 // Client context
 type Client struct {
-	ts   *token.Source
-	root string // cache root id
+	stats        *counters       // traffic, shared with WithContext copies
+	client       *http.Client    // shared by all requests
+	ctx          context.Context // of all requests, nil is none
+	ts           *token.Source
+	root         string // cache root id
+	includeTrash bool   // do not filter out trashed nodes
+	chunked      bool   // use chunked transfer encoding for uploads
 
 	debug.Debugger
 }
 
+// NewClient returns a Client that uses the token stored in path and the
+// proxy, if any, configured in the environment.
 func NewClient(path string, d debug.Debugger) (*Client, error) {
+	return NewClientWithOptions(path, d, nil)
+}
+
+// NewClientWithOptions returns a Client that uses the token stored in path
+// and is tuned by o, which may be nil.
+func NewClientWithOptions(path string, d debug.Debugger, o *Options) (*Client,
+	error) {
+
+	if o == nil {
+		o = &Options{}
+	}
+
 	c := Client{
+		stats:    new(counters),
 		Debugger: d,
 	}
 
@@ -120,10 +163,15 @@ func NewClient(path string, d debug.Debugger) (*Client, error) {
 	c.Log(DebugTrace, "[TRC] NewClient %v", path)
 
 	var err error
+	c.client, err = NewHTTPClient(o)
+	if err != nil {
+		return nil, err
+	}
 	c.ts, err = token.New(path, DebugToken, c.Debugger)
 	if err != nil {
 		return nil, err
 	}
+	c.ts.SetClient(c.client)
 
 	// cache root id
 	a, err := c.GetMetadataJSON("")
@@ -147,6 +195,37 @@ func (c *Client) GetRoot() string {
 	return c.root
 }
 
+// WithContext returns a copy of c whose requests are aborted once ctx is
+// done.  The copy shares the connections and the Stats of c.
+func (c *Client) WithContext(ctx context.Context) Backend {
+	cc := *c
+	cc.ctx = ctx
+	return &cc
+}
+
+// newRequest returns a request that is aborted along with the context of c.
+func (c *Client) newRequest(method, url string,
+	body io.Reader) (*http.Request, error) {
+
+	if c.ctx == nil {
+		return http.NewRequest(method, url, body)
+	}
+	return http.NewRequestWithContext(c.ctx, method, url, body)
+}
+
+// Chunked sets whether uploads use chunked transfer encoding instead of an
+// explicit Content-Length.  Some proxies reject chunked uploads so it is off
+// by default.
+func (c *Client) Chunked(chunked bool) {
+	c.chunked = chunked
+}
+
+// IncludeTrash sets whether path lookups consider trashed nodes.  By default
+// only available nodes are considered.
+func (c *Client) IncludeTrash(include bool) {
+	c.includeTrash = include
+}
+
 func (c *Client) GetMetadataJSON(id string) (*Asset, error) {
 	c.Log(DebugTrace, "[TRC] GetMetadataJSON %v", id)
 
@@ -166,15 +245,14 @@ func (c *Client) GetMetadataJSON(id string) (*Asset, error) {
 	c.Log(DebugURL, "[URL] %v", url)
 
 	// create http request
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := c.newRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
 
 	// execute request
-	clt := &http.Client{}
-	res, err := clt.Do(req)
+	res, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -230,15 +308,14 @@ func (c *Client) GetChildrenJSON(id, filter string) (*Assets, error) {
 	c.Log(DebugURL, "[URL] %v", url)
 
 	// create http request
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := c.newRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
 
 	// execute request
-	clt := &http.Client{}
-	res, err := clt.Do(req)
+	res, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -292,15 +369,14 @@ func (c *Client) MkdirJSON(parent, name string) (*Asset, error) {
 	c.Log(DebugURL, "[URL] %v", metadataURL)
 
 	// create http request
-	req, err := http.NewRequest("POST", metadataURL, body)
+	req, err := c.newRequest("POST", metadataURL, body)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
 
 	// execute request
-	clt := &http.Client{}
-	res, err := clt.Do(req)
+	res, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -342,15 +418,14 @@ func (c *Client) DownloadJSON(id string) ([]byte, error) {
 	c.Log(DebugURL, "[URL] %v", url)
 
 	// create http request
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := c.newRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
 
 	// execute request
-	clt := &http.Client{}
-	res, err := clt.Do(req)
+	res, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -374,74 +449,287 @@ func (c *Client) DownloadJSON(id string) ([]byte, error) {
 	return body, nil
 }
 
+// UploadJSON uploads payload as filename into parent.
 func (c *Client) UploadJSON(parent, filename string, payload []byte) (*Asset,
 	error) {
 
 	c.Log(DebugTrace, "[TRC] UploadJSON %v %v", filename, len(payload))
 
+	return c.UploadFromReader(parent, filename, bytes.NewReader(payload),
+		int64(len(payload)))
+}
+
+// UploadNode uploads payload as a file described by node into parent.  Only
+// the name, labels and description of node are used.
+func (c *Client) UploadNode(parent string, node *NodeJSON,
+	payload []byte) (*Asset, error) {
+
+	c.Log(DebugTrace, "[TRC] UploadNode %v %v %v", node.Name, node.Labels,
+		len(payload))
+
+	return c.upload(parent, *node, bytes.NewReader(payload),
+		int64(len(payload)))
+}
+
+// UploadFromReader uploads size bytes read from r as filename into parent.
+// The multipart body is streamed instead of buffered.  It is sent with
+// chunked transfer encoding when enabled with Chunked and with a
+// Content-Length otherwise, in which case r must yield exactly size bytes.
+func (c *Client) UploadFromReader(parent, filename string, r io.Reader,
+	size int64) (*Asset, error) {
+
+	c.Log(DebugTrace, "[TRC] UploadFromReader %v %v", filename, size)
+
+	return c.upload(parent, NodeJSON{Name: filename}, r, size)
+}
+
+// OverwriteContent replaces the content of file id with payload.  The node
+// keeps its id, name, labels and description.
+func (c *Client) OverwriteContent(id string, payload []byte) (*Asset, error) {
+	c.Log(DebugTrace, "[TRC] OverwriteContent %v %v", id, len(payload))
+
+	return c.sendContent("PUT", contentURL+"/"+id+"/content", id, nil,
+		bytes.NewReader(payload), int64(len(payload)), http.StatusOK)
+}
+
+// upload streams size bytes read from r as the file described by j into
+// parent.
+func (c *Client) upload(parent string, j NodeJSON, r io.Reader,
+	size int64) (*Asset, error) {
+
+	j.Kind = AssetFile
+	j.Parents = []string{parent}
+	jj, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.sendContent("POST", contentURL, j.Name, jj, r, size,
+		http.StatusCreated)
+}
+
+// sendContent streams size bytes read from r as the content of a multipart
+// request to url and expects status in return.  Metadata, if not nil, is sent
+// as the NodeJSON of the node.
+func (c *Client) sendContent(method, url, filename string, metadata []byte,
+	r io.Reader, size int64, status int) (*Asset, error) {
+
 	t, err := c.ts.Token()
 	if err != nil {
 		return nil, err
 	}
 
-	url := contentURL
 	c.Log(DebugURL, "[URL] %v", url)
 
-	// create body
-	j := NodeJSON{
-		Name:    filename,
-		Kind:    AssetFile,
-		Parents: []string{parent},
+	// sniff content type without consuming r
+	br := bufio.NewReader(r)
+	sniff, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
 	}
-	jj, err := json.Marshal(j)
+	contentType := http.DetectContentType(sniff)
+
+	// everything but the content is small so render it up front; the
+	// multipart writer writes straight through so head and tail can be
+	// split off the same buffer
+	mb := new(bytes.Buffer)
+	writer := multipart.NewWriter(mb)
+	err = writeUploadHead(writer, filename, contentType, metadata)
+	if err != nil {
+		return nil, err
+	}
+	head := append([]byte(nil), mb.Bytes()...)
+	mb.Reset()
+	err = writer.Close()
 	if err != nil {
 		return nil, err
 	}
+	tail := mb.Bytes()
 
-	// metadata
-	body := new(bytes.Buffer)
-	writer := multipart.NewWriter(body)
-	mh := textproto.MIMEHeader{}
-	mh.Add("Content-Disposition", `form-data; name="metadata"`)
-	mh.Add("Content-Type", "application/json")
-	part, err := writer.CreatePart(mh)
+	// create http request
+	var body io.Reader
+	if c.chunked {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := pw.Write(head)
+			if err == nil {
+				_, err = io.Copy(pw, br)
+			}
+			if err == nil {
+				_, err = pw.Write(tail)
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		body = pr
+	} else {
+		body = io.MultiReader(bytes.NewReader(head), br,
+			bytes.NewReader(tail))
+	}
+	req, err := c.newRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.chunked {
+		req.ContentLength = -1
+	} else {
+		req.ContentLength = int64(len(head)) + size + int64(len(tail))
+	}
+	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
+	req.Header.Add("Content-Type", "multipart/form-data; boundary="+
+		writer.Boundary())
+
+	// dump headers, the body is streamed
+	if c.GetMask()&DebugBody == DebugBody {
+		x, _ := httputil.DumpRequestOut(req, false)
+		c.Log(DebugBody, "BDY: %s", x)
+	}
+
+	// execute request
+	res, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
-	part.Write(jj)
+	defer res.Body.Close()
+	c.Log(DebugHTTP, "[HTP] %v", res.Status)
+
+	// obtain body
+	rbody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Log(DebugBody, "[BDY] %v", string(rbody))
+
+	if res.StatusCode != status {
+		return nil, NewCombinedError(res.StatusCode, res.Status, rbody)
+	}
+
+	var asset Asset
+	err = json.Unmarshal(rbody, &asset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &asset, nil
+}
+
+// quoteEscaper escapes quoted-string values in multipart headers.
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// writeUploadHead writes the metadata part and the header of the content part
+// of an upload to w.  Cloud drive rejects uploads with a 400 unless the
+// metadata part, named metadata and holding a NodeJSON, precedes the content
+// part, named content, so the order of the parts must not change.  The
+// metadata part is left out if metadata is nil, as for overwrites.
+func writeUploadHead(w *multipart.Writer, filename, contentType string,
+	metadata []byte) error {
+
+	// metadata
+	if metadata != nil {
+		mh := textproto.MIMEHeader{}
+		mh.Add("Content-Disposition", `form-data; name="metadata"`)
+		mh.Add("Content-Type", "application/json")
+		part, err := w.CreatePart(mh)
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(metadata)
+		if err != nil {
+			return err
+		}
+	}
 
 	// content
-	mh = textproto.MIMEHeader{}
+	mh := textproto.MIMEHeader{}
 	mh.Add("Content-Disposition", `form-data; name="content"; filename="`+
-		filename+`"`)
-	mh.Add("Content-Type", http.DetectContentType(payload))
-	part, err = writer.CreatePart(mh)
+		quoteEscaper.Replace(filename)+`"`)
+	mh.Add("Content-Type", contentType)
+	_, err := w.CreatePart(mh)
+
+	return err
+}
+
+// MoveJSON moves node id from parent from to parent to.
+func (c *Client) MoveJSON(id, from, to string) (*Asset, error) {
+	c.Log(DebugTrace, "[TRC] MoveJSON %v %v %v", id, from, to)
+
+	t, err := c.ts.Token()
 	if err != nil {
 		return nil, err
 	}
-	part.Write(payload)
 
-	// flush
-	writer.Close()
+	j := MoveJSON{
+		FromParent: from,
+		ChildID:    id,
+	}
+	jj, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+	body := bytes.NewReader(jj)
+
+	url := metadataURL + "/" + to + "/children"
+	c.Log(DebugURL, "[URL] %v", url)
 
 	// create http request
-	req, err := http.NewRequest("POST", url, body)
+	req, err := c.newRequest("POST", url, body)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
-	req.Header.Add("Content-Type", "multipart/form-data; boundary="+
-		writer.Boundary())
 
-	// dump body
-	if c.GetMask()&DebugBody == DebugBody {
-		x, _ := httputil.DumpRequestOut(req, true)
-		c.Log(DebugBody, "BDY: %s", x)
+	// execute request
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer res.Body.Close()
+	c.Log(DebugHTTP, "[HTP] %v", res.Status)
+
+	// obtain body
+	rbody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Log(DebugBody, "[BDY] %v", string(rbody))
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		// success
+	default:
+		return nil, NewCombinedError(res.StatusCode, res.Status, rbody)
+	}
+
+	var asset Asset
+	err = json.Unmarshal(rbody, &asset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &asset, nil
+}
+
+// TrashJSON moves node id to the trash.
+func (c *Client) TrashJSON(id string) (*Asset, error) {
+	c.Log(DebugTrace, "[TRC] TrashJSON %v", id)
+
+	t, err := c.ts.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	url := trashURL + "/" + id
+	c.Log(DebugURL, "[URL] %v", url)
+
+	// create http request
+	req, err := c.newRequest("PUT", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
 
 	// execute request
-	clt := &http.Client{}
-	res, err := clt.Do(req)
+	res, err := c.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -456,7 +744,57 @@ func (c *Client) UploadJSON(parent, filename string, payload []byte) (*Asset,
 	c.Log(DebugBody, "[BDY] %v", string(rbody))
 
 	switch res.StatusCode {
-	case http.StatusCreated:
+	case http.StatusOK:
+		// success
+	default:
+		return nil, NewCombinedError(res.StatusCode, res.Status, rbody)
+	}
+
+	var asset Asset
+	err = json.Unmarshal(rbody, &asset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &asset, nil
+}
+
+// RestoreJSON restores node id from the trash.
+func (c *Client) RestoreJSON(id string) (*Asset, error) {
+	c.Log(DebugTrace, "[TRC] RestoreJSON %v", id)
+
+	t, err := c.ts.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	url := trashURL + "/" + id + "/restore"
+	c.Log(DebugURL, "[URL] %v", url)
+
+	// create http request
+	req, err := c.newRequest("POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
+
+	// execute request
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	c.Log(DebugHTTP, "[HTP] %v", res.Status)
+
+	// obtain body
+	rbody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Log(DebugBody, "[BDY] %v", string(rbody))
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusCreated:
 		// success
 	default:
 		return nil, NewCombinedError(res.StatusCode, res.Status, rbody)
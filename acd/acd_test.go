@@ -0,0 +1,507 @@
+package acd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marcopeereboom/acdb/acd/token"
+	"github.com/marcopeereboom/acdb/debug"
+)
+
+// rewriteTransport sends all requests to the test server at host.
+type rewriteTransport struct {
+	host string
+	rt   http.RoundTripper
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+
+	r := req.Clone(req.Context())
+	r.URL.Scheme = "http"
+	r.URL.Host = t.host
+	r.Host = t.host
+	return t.rt.RoundTrip(r)
+}
+
+// testClient returns a Client that sends all requests to h.
+func testClient(t *testing.T, h http.Handler) *Client {
+	t.Helper()
+
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "token")
+	err = ioutil.WriteFile(path, []byte(`{"access_token":"access",`+
+		`"token_type":"Bearer","refresh_token":"refresh",`+
+		`"expiry":"2100-01-01T00:00:00Z"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := debug.NewDebugNil()
+	ts, err := token.New(path, DebugToken, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Client{
+		stats: new(counters),
+		client: &http.Client{Transport: rewriteTransport{host: u.Host,
+			rt: http.DefaultTransport}},
+		ts:       ts,
+		root:     "root",
+		Debugger: d,
+	}
+}
+
+// uploadPart is a part of a multipart upload.
+type uploadPart struct {
+	name        string
+	filename    string
+	contentType string
+	body        []byte
+}
+
+// readUpload returns the parts of multipart body r sent with content type
+// ct.
+func readUpload(t *testing.T, ct string, r io.Reader) []uploadPart {
+	t.Helper()
+
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != "multipart/form-data" {
+		t.Fatalf("content type %v", mt)
+	}
+	var parts []uploadPart
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, uploadPart{
+			name:        p.FormName(),
+			filename:    p.FileName(),
+			contentType: p.Header.Get("Content-Type"),
+			body:        b,
+		})
+	}
+	return parts
+}
+
+func TestWriteUploadHead(t *testing.T) {
+	const filename = `a "quoted" \ name`
+	node, err := json.Marshal(NodeJSON{
+		Name:    filename,
+		Kind:    AssetFile,
+		Labels:  []string{"label"},
+		Parents: []string{"parent"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		metadata []byte
+		want     []string // part names
+	}{
+		{name: "upload", metadata: node, want: []string{"metadata",
+			"content"}},
+		{name: "overwrite", want: []string{"content"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			w := multipart.NewWriter(&b)
+			err := writeUploadHead(w, filename, "text/plain",
+				tt.metadata)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = io.WriteString(&b, "payload")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parts := readUpload(t, w.FormDataContentType(), &b)
+			if len(parts) != len(tt.want) {
+				t.Fatalf("got %v parts, want %v", len(parts),
+					len(tt.want))
+			}
+			for k, v := range tt.want {
+				if parts[k].name != v {
+					t.Fatalf("part %v is %v, want %v", k,
+						parts[k].name, v)
+				}
+			}
+
+			if tt.metadata != nil {
+				p := parts[0]
+				if p.contentType != "application/json" {
+					t.Fatalf("metadata content type %v",
+						p.contentType)
+				}
+				var j NodeJSON
+				err = json.Unmarshal(p.body, &j)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if j.Name != filename || j.Kind != AssetFile ||
+					len(j.Parents) != 1 ||
+					j.Parents[0] != "parent" ||
+					len(j.Labels) != 1 || j.Labels[0] != "label" {
+					t.Fatalf("metadata %+v", j)
+				}
+			}
+
+			p := parts[len(parts)-1]
+			if p.filename != filename {
+				t.Fatalf("filename %q, want %q", p.filename, filename)
+			}
+			if p.contentType != "text/plain" {
+				t.Fatalf("content type %v", p.contentType)
+			}
+			if string(p.body) != "payload" {
+				t.Fatalf("content %q", p.body)
+			}
+		})
+	}
+}
+
+func TestUploadParts(t *testing.T) {
+	var (
+		method string
+		path   string
+		ct     string
+		body   []byte
+	)
+	c := testClient(t, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		method = r.Method
+		path = r.URL.Path
+		ct = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+		status := http.StatusCreated
+		if r.Method == "PUT" {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, `{"id":"id"}`)
+	}))
+
+	_, err := c.UploadNode("parent", &NodeJSON{Name: "node",
+		Labels: []string{"label"}}, []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := readUpload(t, ct, bytes.NewReader(body))
+	if method != "POST" || !strings.HasSuffix(path, "/nodes") ||
+		len(parts) != 2 || parts[0].name != "metadata" ||
+		parts[1].name != "content" || string(parts[1].body) != "new" {
+		t.Fatalf("upload %v %v %+v", method, path, parts)
+	}
+	var j NodeJSON
+	err = json.Unmarshal(parts[0].body, &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Name != "node" || j.Kind != AssetFile || len(j.Parents) != 1 ||
+		j.Parents[0] != "parent" {
+		t.Fatalf("metadata %+v", j)
+	}
+
+	// overwrites only carry the content
+	_, err = c.OverwriteContent("id", []byte("overwritten"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts = readUpload(t, ct, bytes.NewReader(body))
+	if method != "PUT" || !strings.HasSuffix(path, "/nodes/id/content") ||
+		len(parts) != 1 || parts[0].name != "content" ||
+		string(parts[0].body) != "overwritten" {
+		t.Fatalf("overwrite %v %v %+v", method, path, parts)
+	}
+}
+
+func TestUploadFromReader(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	type request struct {
+		transferEncoding []string
+		contentLength    int64
+		length           int64 // of the body as sent
+		body             []byte
+	}
+	var requests []request
+	c := testClient(t, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		body, _ := ioutil.ReadAll(r.Body)
+		length := int64(len(body))
+
+		// the boundary is random, strip it for comparison
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		body = bytes.ReplaceAll(body, []byte(params["boundary"]),
+			[]byte("boundary"))
+		requests = append(requests, request{
+			transferEncoding: r.TransferEncoding,
+			contentLength:    r.ContentLength,
+			length:           length,
+			body:             body,
+		})
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":"id"}`)
+	}))
+
+	for _, chunked := range []bool{false, true} {
+		c.Chunked(chunked)
+		_, err := c.UploadFromReader("parent", "file",
+			bytes.NewReader(payload), int64(len(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(requests) != 2 {
+		t.Fatalf("got %v requests", len(requests))
+	}
+
+	r := requests[0]
+	if len(r.transferEncoding) != 0 ||
+		r.contentLength != r.length {
+		t.Fatalf("transfer encoding %v, content length %v, body %v",
+			r.transferEncoding, r.contentLength, r.length)
+	}
+	r = requests[1]
+	if len(r.transferEncoding) != 1 || r.transferEncoding[0] != "chunked" ||
+		r.contentLength != -1 {
+		t.Fatalf("transfer encoding %v, content length %v",
+			r.transferEncoding, r.contentLength)
+	}
+	if !bytes.Equal(requests[0].body, requests[1].body) {
+		t.Fatal("bodies differ")
+	}
+	if !bytes.Contains(requests[0].body, payload) {
+		t.Fatal("payload not sent")
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	started := make(chan struct{})
+	c := testClient(t, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		if !strings.HasSuffix(r.URL.Path, "/block/content") {
+			io.WriteString(w, "content")
+			return
+		}
+		close(started)
+		<-r.Context().Done()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := c.WithContext(ctx).(*Client)
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := cc.DownloadJSON("block")
+	if err == nil || ctx.Err() == nil {
+		t.Fatalf("got %v", err)
+	}
+
+	// the original is not affected and the stats are shared
+	_, err = c.DownloadJSON("id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().Requests != 2 || cc.Stats().Requests != 2 {
+		t.Fatalf("requests %v %v", c.Stats().Requests,
+			cc.Stats().Requests)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		want uint16
+		err  error
+	}{
+		{"1.0", 0, ErrTLSVersion},
+		{"1.1", 0, ErrTLSVersion},
+		{"1.2", tls.VersionTLS12, nil},
+		{"1.3", tls.VersionTLS13, nil},
+		{"", 0, ErrTLSVersion},
+		{"1.4", 0, ErrTLSVersion},
+	}
+	for _, tt := range tests {
+		got, err := ParseTLSVersion(tt.name)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%q: got %v %v, want %v %v", tt.name, got, err,
+				tt.want, tt.err)
+		}
+	}
+}
+
+func TestResolveNames(t *testing.T) {
+	m := NewMemoryBackend()
+	dir, err := m.MkdirJSON(m.GetRoot(), "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(name string) *Asset {
+		a, err := m.UploadJSON(dir.ID, name, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	trash := func(a *Asset) {
+		_, err := m.TrashJSON(a.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a trashed a shadowed by an available one, two available b, a
+	// trashed c and no d
+	trash(upload("a"))
+	a := upload("a")
+	b := upload("b")
+	trash(b)
+	upload("b")
+	_, err = m.RestoreJSON(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := upload("c")
+	trash(c)
+
+	// the client sees the same nodes, the names are left to the client
+	cl := testClient(t, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		filter := ""
+		if strings.Contains(r.URL.Query().Get("filters"),
+			FilterAvailable) {
+			filter = "?filters=" + FilterAvailable
+		}
+		assets, err := m.GetChildrenJSON(dir.ID, filter)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(assets)
+	}))
+
+	names := []string{"a", "b", "c", "d"}
+	tests := []struct {
+		includeTrash bool
+		want         map[string]string
+	}{
+		{false, map[string]string{"a": a.ID}},
+		{true, map[string]string{"a": a.ID, "c": c.ID}},
+	}
+	for _, tt := range tests {
+		m.IncludeTrash(tt.includeTrash)
+		cl.IncludeTrash(tt.includeTrash)
+		for _, b := range []Backend{m, cl} {
+			got, err := b.ResolveNames(dir.ID, names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("%T include trash %v: got %v, want %v",
+					b, tt.includeTrash, got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Fatalf("%T include trash %v: got %v, "+
+						"want %v", b, tt.includeTrash, got,
+						tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestFilterValue(t *testing.T) {
+	names := []string{
+		"plain",
+		"2016-01-02 15:04:05",
+		"a (1)",
+		`*?:\"'&+-|!{}[]^~`,
+		"100% snapshot",
+	}
+
+	var got []string
+	c := testClient(t, http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		got = append(got, r.URL.Query().Get("filters"))
+		io.WriteString(w, `{"count":0,"data":[]}`)
+	}))
+	m := NewMemoryBackend()
+	for _, name := range names {
+		_, _, err := c.NodeExists("parent", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a, err := m.MkdirJSON(m.GetRoot(), name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assets, err := m.GetChildrenJSON(m.GetRoot(), "?filters=name:"+
+			FilterValue(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assets.Count != 1 || assets.Data[0].ID != a.ID {
+			t.Fatalf("%q: found %+v", name, assets.Data)
+		}
+	}
+
+	// the server sees every special character escaped once
+	want := []string{
+		`name:plain`,
+		`name:2016\-01\-02\ 15\:04\:05`,
+		`name:a\ \(1\)`,
+		`name:\*\?\:\\\"\'\&\+\-\|\!\{\}\[\]\^\~`,
+		`name:100%\ snapshot`,
+	}
+	for k, v := range want {
+		if k >= len(got) || !strings.HasPrefix(got[k], v+" AND ") {
+			t.Fatalf("filter %v: got %q, want %q", k, got, v)
+		}
+	}
+}
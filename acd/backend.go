@@ -0,0 +1,54 @@
+package acd
+
+import (
+	"context"
+	"io"
+)
+
+// Backend is the set of cloud drive operations required to store and
+// retrieve backups.  Client implements Backend by talking to Amazon Cloud
+// Drive; MemoryBackend implements it in memory for testing and DirBackend
+// in a local directory.
+type Backend interface {
+	GetRoot() string
+	IncludeTrash(include bool)
+	GetMetadataFS(filepath string) (*Asset, error)
+	GetChildrenJSON(id, filter string) (*Assets, error)
+	NodeExists(parent, name string) (bool, string, error)
+	ResolveNames(parent string, names []string) (map[string]string, error)
+	MkdirJSON(parent, name string) (*Asset, error)
+	DownloadJSON(id string) ([]byte, error)
+	UploadJSON(parent, filename string, payload []byte) (*Asset, error)
+	UploadNode(parent string, node *NodeJSON, payload []byte) (*Asset,
+		error)
+	UploadFromReader(parent, filename string, r io.Reader,
+		size int64) (*Asset, error)
+	OverwriteContent(id string, payload []byte) (*Asset, error)
+	MoveJSON(id, from, to string) (*Asset, error)
+	TrashJSON(id string) (*Asset, error)
+	RestoreJSON(id string) (*Asset, error)
+	Stats() Stats
+}
+
+// ContextBackend is a Backend whose requests can be aborted.  Client is one,
+// the local backends finish their operations quickly enough to not need it.
+type ContextBackend interface {
+	Backend
+	WithContext(ctx context.Context) Backend
+}
+
+// WithContext returns b with its requests aborted once ctx is done, or b
+// itself if it is not a ContextBackend.
+func WithContext(b Backend, ctx context.Context) Backend {
+	if cb, ok := b.(ContextBackend); ok {
+		return cb.WithContext(ctx)
+	}
+	return b
+}
+
+var (
+	_ ContextBackend = (*Client)(nil)        // ensure interface is satisfied
+	_ Backend        = (*Client)(nil)        // ensure interface is satisfied
+	_ Backend        = (*MemoryBackend)(nil) // ensure interface is satisfied
+	_ Backend        = (*DirBackend)(nil)    // ensure interface is satisfied
+)
@@ -0,0 +1,408 @@
+package acd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DirBackend is a Backend that stores nodes as files and folders below a
+// local directory, e.g. to keep a self-contained backup next to its local
+// metadata.  Node ids are the slash separated paths of the nodes relative to
+// that directory.  Nodes can not be trashed and labels and descriptions are
+// not kept.
+type DirBackend struct {
+	sync.Mutex
+
+	dir   string
+	stats Stats
+}
+
+// errDirTrash is returned by the trash operations of a DirBackend.
+var errDirTrash = errors.New("local directories have no trash")
+
+// NewDirBackend returns a DirBackend that stores its nodes in dir, which is
+// created if it does not exist.
+func NewDirBackend(dir string) (*DirBackend, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &DirBackend{dir: dir}, nil
+}
+
+// filename returns the local name of node id.
+func (d *DirBackend) filename(id string) (string, error) {
+	if id == "" || path.Clean(id) != id || path.IsAbs(id) ||
+		id == ".." || strings.HasPrefix(id, "../") {
+		return "", notFound()
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(id)), nil
+}
+
+// child returns the id and local name of name in parent.
+func (d *DirBackend) child(parent, name string) (string, string, error) {
+	if name == "" || name == "." || name == ".." ||
+		strings.ContainsAny(name, "/\\") {
+		return "", "", errors.New("invalid name: " + name)
+	}
+	id := path.Join(parent, name)
+	filename, err := d.filename(id)
+	return id, filename, err
+}
+
+// folder returns the local name of folder id or an error if it does not
+// exist.
+func (d *DirBackend) folder(id string) (string, error) {
+	filename, err := d.filename(id)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil || !fi.IsDir() {
+		return "", notFound()
+	}
+	return filename, nil
+}
+
+// asset returns the asset of node id with local file information fi.
+func (d *DirBackend) asset(id string, fi os.FileInfo) *Asset {
+	a := Asset{
+		ID:           id,
+		Name:         path.Base(id),
+		Kind:         AssetFile,
+		Version:      1,
+		ModifiedDate: fi.ModTime(),
+		CreatedDate:  fi.ModTime(),
+		Status:       StatusAvailable,
+	}
+	if id == "." {
+		a.Name = ""
+		a.IsRoot = true
+	} else {
+		a.Parents = []string{path.Dir(id)}
+	}
+	if fi.IsDir() {
+		a.Kind = AssetFolder
+	} else {
+		a.ContentProperties.Size = int(fi.Size())
+	}
+	return &a
+}
+
+func (d *DirBackend) request() {
+	d.Lock()
+	d.stats.Requests++
+	d.Unlock()
+}
+
+func (d *DirBackend) GetRoot() string {
+	return "."
+}
+
+func (d *DirBackend) IncludeTrash(include bool) {
+}
+
+func (d *DirBackend) GetMetadataFS(filepath string) (*Asset, error) {
+	d.request()
+
+	id := strings.TrimPrefix(path.Clean("/"+filepath), "/")
+	if id == "" {
+		return nil, ErrNotFound
+	}
+	filename, err := d.filename(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	return d.asset(id, fi), nil
+}
+
+func (d *DirBackend) NodeExists(parent, name string) (bool, string,
+	error) {
+
+	d.request()
+
+	_, err := d.folder(parent)
+	if err != nil {
+		return false, "", err
+	}
+	id, filename, err := d.child(parent, name)
+	if err != nil {
+		return false, "", err
+	}
+	_, err = os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return false, "", nil
+	} else if err != nil {
+		return false, "", err
+	}
+
+	return true, id, nil
+}
+
+func (d *DirBackend) ResolveNames(parent string,
+	names []string) (map[string]string, error) {
+
+	ids := make(map[string]string, len(names))
+	for _, v := range names {
+		exists, id, err := d.NodeExists(parent, v)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			ids[v] = id
+		}
+	}
+
+	return ids, nil
+}
+
+// GetChildrenJSON returns the children of id.  Only kind:, name: and status:
+// filters, optionally combined with FilterAnd, are understood.
+func (d *DirBackend) GetChildrenJSON(id, filter string) (*Assets, error) {
+	d.request()
+
+	if id == "" {
+		id = d.GetRoot()
+	}
+	filename, err := d.folder(id)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := parseFilters(filter)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	assets := Assets{}
+	for _, fi := range fis {
+		a := d.asset(path.Join(id, fi.Name()), fi)
+		if !filters.match(a) {
+			continue
+		}
+		assets.Data = append(assets.Data, *a)
+	}
+	assets.Count = len(assets.Data)
+
+	return &assets, nil
+}
+
+func (d *DirBackend) MkdirJSON(parent, name string) (*Asset, error) {
+	d.request()
+
+	_, err := d.folder(parent)
+	if err != nil {
+		return nil, err
+	}
+	id, filename, err := d.child(parent, name)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Mkdir(filename, 0700)
+	if os.IsExist(err) {
+		return nil, conflict()
+	} else if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.asset(id, fi), nil
+}
+
+func (d *DirBackend) DownloadJSON(id string) ([]byte, error) {
+	d.request()
+
+	filename, err := d.filename(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, notFound()
+	} else if err != nil {
+		return nil, err
+	}
+
+	d.Lock()
+	d.stats.Downloaded += int64(len(content))
+	d.Unlock()
+
+	return content, nil
+}
+
+func (d *DirBackend) UploadJSON(parent, filename string,
+	payload []byte) (*Asset, error) {
+
+	return d.UploadFromReader(parent, filename, bytes.NewReader(payload),
+		int64(len(payload)))
+}
+
+func (d *DirBackend) UploadNode(parent string, node *NodeJSON,
+	payload []byte) (*Asset, error) {
+
+	return d.UploadJSON(parent, node.Name, payload)
+}
+
+// UploadFromReader stores size bytes read from r as filename in parent.  A
+// failed upload leaves no file behind.
+func (d *DirBackend) UploadFromReader(parent, filename string,
+	r io.Reader, size int64) (*Asset, error) {
+
+	d.request()
+
+	_, err := d.folder(parent)
+	if err != nil {
+		return nil, err
+	}
+	id, name, err := d.child(parent, filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, conflict()
+	} else if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(name)
+		return nil, err
+	}
+
+	d.Lock()
+	d.stats.Uploaded += n
+	d.Unlock()
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.asset(id, fi), nil
+}
+
+// OverwriteContent replaces the content of file id with payload.  The file
+// is replaced atomically.
+func (d *DirBackend) OverwriteContent(id string, payload []byte) (*Asset,
+	error) {
+
+	d.request()
+
+	filename, err := d.filename(id)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil || fi.IsDir() {
+		return nil, notFound()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".overwrite")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(payload)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+
+	d.Lock()
+	d.stats.Uploaded += int64(len(payload))
+	d.Unlock()
+
+	fi, err = os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.asset(id, fi), nil
+}
+
+func (d *DirBackend) MoveJSON(id, from, to string) (*Asset, error) {
+	d.request()
+
+	if path.Dir(id) != path.Clean(from) {
+		return nil, notFound()
+	}
+	filename, err := d.filename(id)
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.folder(to)
+	if err != nil {
+		return nil, err
+	}
+	newID, newFilename, err := d.child(to, path.Base(id))
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Lstat(newFilename)
+	if err == nil {
+		return nil, conflict()
+	}
+	err = os.Rename(filename, newFilename)
+	if os.IsNotExist(err) {
+		return nil, notFound()
+	} else if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(newFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.asset(newID, fi), nil
+}
+
+func (d *DirBackend) TrashJSON(id string) (*Asset, error) {
+	return nil, errDirTrash
+}
+
+func (d *DirBackend) RestoreJSON(id string) (*Asset, error) {
+	return nil, errDirTrash
+}
+
+// Stats returns the local traffic.  Latency is not measured.
+func (d *DirBackend) Stats() Stats {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.stats
+}
@@ -2,15 +2,53 @@ package acd
 
 import (
 	"errors"
-	"fmt"
+	"net/url"
 	"path"
 	"strings"
 )
 
 var (
-	ErrNotFound = errors.New("object not found")
+	ErrNotFound  = errors.New("object not found")
+	ErrAmbiguous = errors.New("object name is ambiguous")
 )
 
+// filterSpecial are the characters that must be escaped with a backslash in
+// filter values.
+const filterSpecial = `+-&|!(){}[]^'"~*?:\ `
+
+// FilterValue returns s escaped for use as a filter value, e.g. in
+// "?filters=name:" + FilterValue(name).  Names may contain characters
+// that are special to the filter syntax or to URLs.
+func FilterValue(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(filterSpecial, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return strings.ReplaceAll(url.QueryEscape(b.String()), "+", "%20")
+}
+
+// filterUnescape returns the value FilterValue escaped as s.
+func filterUnescape(s string) (string, error) {
+	s, err := url.PathUnescape(s)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
 func (c *Client) GetMetadataFS(filepath string) (*Asset, error) {
 	c.Log(DebugTrace, "[TRC] GetMetadataFS %v", filepath)
 
@@ -23,38 +61,157 @@ func (c *Client) GetMetadataFS(filepath string) (*Asset, error) {
 			continue
 		}
 		c.Log(DebugTrace, "[TRC] looking for: %v", v)
-		assets, err := c.GetChildrenJSON(parent, "?filters=name:"+v)
+		filter := "?filters=name:" + FilterValue(v)
+		if !c.includeTrash {
+			filter += FilterAnd + FilterAvailable
+		}
+		assets, err := c.GetChildrenJSON(parent, filter)
 		if err != nil {
 			return nil, err
 		}
 
-		// sanity
+		// there may be several nodes with the same name
 		if assets.Count != 1 {
-			c.Log(DebugTrace, "[TRC] unexpected count: %v",
-				assets.Count)
-			return nil, ErrNotFound
+			c.Log(DebugTrace, "[TRC] %v: %v nodes", v, assets.Count)
 		}
+		candidates := make([]*Asset, 0, len(assets.Data))
+		for k := range assets.Data {
+			candidates = append(candidates, &assets.Data[k])
+		}
+		match, err := pick(candidates, parent, v)
+		if err != nil {
+			return nil, err
+		}
+		parent = match.ID
 
-		if assets.Data[0].Name != v {
-			return nil, fmt.Errorf("returned invalid name")
+		if v == file {
+			return match, nil
 		}
+	}
 
-		found := false
-		for _, vv := range assets.Data[0].Parents {
-			if vv == parent {
-				parent = assets.Data[0].ID
-				found = true
-				break
-			}
+	return nil, ErrNotFound
+}
+
+// pick returns the asset called name that lives in parent the way paths are
+// resolved: an available node shadows trashed ones and several candidates
+// with the same status are ambiguous.
+func pick(assets []*Asset, parent, name string) (*Asset, error) {
+	var (
+		match   *Asset
+		matches int
+	)
+	for _, a := range assets {
+		if a.Name != name || !hasParent(a, parent) {
+			continue
 		}
-		if !found {
-			return nil, fmt.Errorf("parent not found %v", parent)
+		if match == nil || (a.Status == StatusAvailable &&
+			match.Status != StatusAvailable) {
+			match = a
+			matches = 1
+		} else if a.Status == match.Status {
+			matches++
 		}
+	}
+	if match == nil {
+		return nil, ErrNotFound
+	}
+	if matches != 1 {
+		return nil, ErrAmbiguous
+	}
 
-		if v == file {
-			return &assets.Data[0], nil
+	return match, nil
+}
+
+// hasParent returns true if parent is one of the parents of a.
+func hasParent(a *Asset, parent string) bool {
+	for _, v := range a.Parents {
+		if v == parent {
+			return true
 		}
 	}
+	return false
+}
 
-	return nil, ErrNotFound
+// NodeExists returns true and the id of the node called name if it lives in
+// parent.  Only the children of parent that match name are retrieved which
+// makes this considerably cheaper than uploading a duplicate.
+func (c *Client) NodeExists(parent, name string) (bool, string, error) {
+	c.Log(DebugTrace, "[TRC] NodeExists %v %v", parent, name)
+
+	filter := "?filters=name:" + FilterValue(name)
+	if !c.includeTrash {
+		filter += FilterAnd + FilterAvailable
+	}
+	assets, err := c.GetChildrenJSON(parent, filter)
+	if err != nil {
+		return false, "", err
+	}
+	for k := range assets.Data {
+		a := &assets.Data[k]
+		if a.Name == name && hasParent(a, parent) {
+			return true, a.ID, nil
+		}
+	}
+
+	return false, "", nil
+}
+
+// ResolveNames returns the ids of the nodes in parent called names, keyed by
+// name, picked like GetMetadataFS does.  Names are looked up ResolveBatch at
+// a time with a single children query each.  Names that are missing or
+// ambiguous are left out so that callers can fall back to GetMetadataFS for
+// a proper error.
+func (c *Client) ResolveNames(parent string, names []string) (map[string]string,
+	error) {
+
+	c.Log(DebugTrace, "[TRC] ResolveNames %v %v", parent, len(names))
+
+	ids := make(map[string]string, len(names))
+	for len(names) != 0 {
+		n := len(names)
+		if n > ResolveBatch {
+			n = ResolveBatch
+		}
+		batch := names[:n]
+		names = names[n:]
+
+		values := make([]string, 0, len(batch))
+		for _, v := range batch {
+			values = append(values, FilterValue(v))
+		}
+		filter := "?filters=name:(" + strings.Join(values, FilterOr) + ")"
+		if !c.includeTrash {
+			filter += FilterAnd + FilterAvailable
+		}
+		assets, err := c.GetChildrenJSON(parent, filter)
+		if err != nil {
+			return nil, err
+		}
+		resolved(ids, assets.Data, parent, batch)
+	}
+
+	return ids, nil
+}
+
+// resolved adds the ids of the assets in parent that are called one of names
+// to ids.  Names that can not be picked are left out.
+func resolved(ids map[string]string, assets []Asset, parent string,
+	names []string) {
+
+	candidates := make(map[string][]*Asset, len(names))
+	for _, v := range names {
+		candidates[v] = nil
+	}
+	for k := range assets {
+		a := &assets[k]
+		if c, ok := candidates[a.Name]; ok {
+			candidates[a.Name] = append(c, a)
+		}
+	}
+	for k, v := range candidates {
+		a, err := pick(v, parent, k)
+		if err == nil {
+			ids[k] = a.ID
+		}
+	}
 }
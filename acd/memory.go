@@ -0,0 +1,433 @@
+package acd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBackend is a Backend that keeps all nodes in memory.  It mimics the
+// cloud drive semantics acdb relies on, such as returning StatusConflict
+// when a duplicate name is created under the same parent, so that the
+// backup and restore flow can be exercised without network access.
+type MemoryBackend struct {
+	sync.Mutex
+
+	root         string
+	next         int
+	includeTrash bool
+	stats        Stats               // simulated traffic
+	assets       map[string]*Asset   // id -> asset
+	children     map[string][]string // parent id -> child ids
+	content      map[string][]byte   // id -> file content
+}
+
+// NewMemoryBackend returns an empty MemoryBackend that only contains the
+// root folder.
+func NewMemoryBackend() *MemoryBackend {
+	m := MemoryBackend{
+		assets:   make(map[string]*Asset),
+		children: make(map[string][]string),
+		content:  make(map[string][]byte),
+	}
+	root := m.newAsset("", AssetFolder, "")
+	root.IsRoot = true
+	m.root = root.ID
+
+	return &m
+}
+
+// newAsset creates an asset and links it to parent.  Must be called with the
+// lock held.
+func (m *MemoryBackend) newAsset(parent, kind, name string) *Asset {
+	m.next++
+	now := time.Now()
+	a := Asset{
+		ID:           fmt.Sprintf("memory%08d", m.next),
+		Name:         name,
+		Kind:         kind,
+		Version:      1,
+		ModifiedDate: now,
+		CreatedDate:  now,
+		Status:       StatusAvailable,
+	}
+	if parent != "" {
+		a.Parents = []string{parent}
+		m.children[parent] = append(m.children[parent], a.ID)
+	}
+	m.assets[a.ID] = &a
+
+	return &a
+}
+
+// visible returns true if a is returned by lookups, i.e. it is available or
+// trashed nodes are included.  Must be called with the lock held.
+func (m *MemoryBackend) visible(a *Asset) bool {
+	return a.Status == StatusAvailable || m.includeTrash
+}
+
+// lookup returns the visible child of parent called name, picked the way
+// Client resolves paths.  Must be called with the lock held.
+func (m *MemoryBackend) lookup(parent, name string) (*Asset, error) {
+	var candidates []*Asset
+	for _, v := range m.children[parent] {
+		a := m.assets[v]
+		if a.Name == name && m.visible(a) {
+			candidates = append(candidates, a)
+		}
+	}
+
+	return pick(candidates, parent, name)
+}
+
+// taken returns true if parent has an available child called name.  Like
+// the cloud drive, trashed nodes do not conflict with new ones.  Must be
+// called with the lock held.
+func (m *MemoryBackend) taken(parent, name string) bool {
+	for _, v := range m.children[parent] {
+		a := m.assets[v]
+		if a.Name == name && a.Status == StatusAvailable {
+			return true
+		}
+	}
+	return false
+}
+
+// conflict returns the error the cloud drive returns on duplicate names.
+func conflict() error {
+	return NewCombinedError(http.StatusConflict,
+		fmt.Sprintf("%v %v", http.StatusConflict,
+			http.StatusText(http.StatusConflict)), nil)
+}
+
+// notFound returns the error the cloud drive returns on unknown ids.
+func notFound() error {
+	return NewCombinedError(http.StatusNotFound,
+		fmt.Sprintf("%v %v", http.StatusNotFound,
+			http.StatusText(http.StatusNotFound)), nil)
+}
+
+// filters are the kind:, name: and status: filters of a children request.
+type filters map[string]string
+
+// parseFilters parses filter, optionally combined with FilterAnd.
+func parseFilters(filter string) (filters, error) {
+	f := make(filters)
+	if filter == "" {
+		return f, nil
+	}
+	for _, v := range strings.Split(strings.TrimPrefix(filter,
+		"?filters="), FilterAnd) {
+
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("unsupported filter: %v", filter)
+		}
+		switch kv[0] {
+		case "kind", "name", "status":
+		default:
+			return nil, fmt.Errorf("unsupported filter: %v", filter)
+		}
+		value, err := filterUnescape(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("unsupported filter: %v", filter)
+		}
+		f[kv[0]] = value
+	}
+
+	return f, nil
+}
+
+// match returns true if a passes all filters.
+func (f filters) match(a *Asset) bool {
+	return (f["kind"] == "" || a.Kind == f["kind"]) &&
+		(f["name"] == "" || a.Name == f["name"]) &&
+		(f["status"] == "" || a.Status == f["status"])
+}
+
+func (m *MemoryBackend) GetRoot() string {
+	return m.root
+}
+
+func (m *MemoryBackend) IncludeTrash(include bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.includeTrash = include
+}
+
+func (m *MemoryBackend) GetMetadataFS(filepath string) (*Asset, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	parent := m.root
+	var a *Asset
+	for _, v := range strings.Split(path.Clean("/"+filepath), "/") {
+		if v == "" {
+			continue
+		}
+		var err error
+		a, err = m.lookup(parent, v)
+		if err != nil {
+			return nil, err
+		}
+		parent = a.ID
+	}
+	if a == nil {
+		return nil, ErrNotFound
+	}
+
+	c := *a
+	return &c, nil
+}
+
+func (m *MemoryBackend) NodeExists(parent, name string) (bool, string,
+	error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	if _, ok := m.assets[parent]; !ok {
+		return false, "", notFound()
+	}
+	// like Client the first visible match wins
+	for _, v := range m.children[parent] {
+		a := m.assets[v]
+		if a.Name == name && m.visible(a) {
+			return true, a.ID, nil
+		}
+	}
+
+	return false, "", nil
+}
+
+func (m *MemoryBackend) ResolveNames(parent string,
+	names []string) (map[string]string, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.assets[parent]; !ok {
+		return nil, notFound()
+	}
+	ids := make(map[string]string, len(names))
+	for k, v := range names {
+		if k%ResolveBatch == 0 {
+			m.stats.Requests++
+		}
+		a, err := m.lookup(parent, v)
+		if err != nil {
+			continue
+		}
+		ids[v] = a.ID
+	}
+
+	return ids, nil
+}
+
+// GetChildrenJSON returns the children of id.  Only kind:, name: and status:
+// filters, optionally combined with FilterAnd, are understood.
+func (m *MemoryBackend) GetChildrenJSON(id, filter string) (*Assets, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	if id == "" {
+		id = m.root
+	}
+	if _, ok := m.assets[id]; !ok {
+		return nil, notFound()
+	}
+
+	filters, err := parseFilters(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	assets := Assets{}
+	for _, v := range m.children[id] {
+		a := m.assets[v]
+		if !filters.match(a) {
+			continue
+		}
+		assets.Data = append(assets.Data, *a)
+	}
+	assets.Count = len(assets.Data)
+
+	return &assets, nil
+}
+
+func (m *MemoryBackend) MkdirJSON(parent, name string) (*Asset, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	if _, ok := m.assets[parent]; !ok {
+		return nil, notFound()
+	}
+	if m.taken(parent, name) {
+		return nil, conflict()
+	}
+
+	c := *m.newAsset(parent, AssetFolder, name)
+	return &c, nil
+}
+
+func (m *MemoryBackend) DownloadJSON(id string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	content, ok := m.content[id]
+	if !ok {
+		return nil, notFound()
+	}
+	m.stats.Downloaded += int64(len(content))
+
+	return append([]byte(nil), content...), nil
+}
+
+func (m *MemoryBackend) UploadJSON(parent, filename string,
+	payload []byte) (*Asset, error) {
+
+	return m.UploadNode(parent, &NodeJSON{Name: filename}, payload)
+}
+
+func (m *MemoryBackend) UploadNode(parent string, node *NodeJSON,
+	payload []byte) (*Asset, error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	m.stats.Uploaded += int64(len(payload))
+	if _, ok := m.assets[parent]; !ok {
+		return nil, notFound()
+	}
+	if m.taken(parent, node.Name) {
+		return nil, conflict()
+	}
+
+	a := m.newAsset(parent, AssetFile, node.Name)
+	a.Labels = append([]string(nil), node.Labels...)
+	a.Description = node.Description
+	a.ContentProperties.Size = len(payload)
+	m.content[a.ID] = append([]byte(nil), payload...)
+
+	c := *a
+	return &c, nil
+}
+
+func (m *MemoryBackend) UploadFromReader(parent, filename string,
+	r io.Reader, size int64) (*Asset, error) {
+
+	payload, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, err
+	}
+
+	return m.UploadJSON(parent, filename, payload)
+}
+
+func (m *MemoryBackend) OverwriteContent(id string, payload []byte) (*Asset,
+	error) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	m.stats.Uploaded += int64(len(payload))
+	a, ok := m.assets[id]
+	if !ok || a.Kind != AssetFile {
+		return nil, notFound()
+	}
+
+	a.Version++
+	a.ModifiedDate = time.Now()
+	a.ContentProperties.Size = len(payload)
+	m.content[id] = append([]byte(nil), payload...)
+
+	c := *a
+	return &c, nil
+}
+
+func (m *MemoryBackend) MoveJSON(id, from, to string) (*Asset, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	a, ok := m.assets[id]
+	if !ok {
+		return nil, notFound()
+	}
+	if _, ok := m.assets[to]; !ok {
+		return nil, notFound()
+	}
+	if m.taken(to, a.Name) {
+		return nil, conflict()
+	}
+
+	// unlink from old parent
+	children := m.children[from]
+	for k, v := range children {
+		if v == id {
+			m.children[from] = append(children[:k:k],
+				children[k+1:]...)
+			break
+		}
+	}
+	for k, v := range a.Parents {
+		if v == from {
+			a.Parents[k] = to
+		}
+	}
+	m.children[to] = append(m.children[to], id)
+
+	c := *a
+	return &c, nil
+}
+
+func (m *MemoryBackend) TrashJSON(id string) (*Asset, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	a, ok := m.assets[id]
+	if !ok {
+		return nil, notFound()
+	}
+	a.Status = StatusTrash
+
+	c := *a
+	return &c, nil
+}
+
+func (m *MemoryBackend) RestoreJSON(id string) (*Asset, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Requests++
+	a, ok := m.assets[id]
+	if !ok {
+		return nil, notFound()
+	}
+	a.Status = StatusAvailable
+
+	c := *a
+	return &c, nil
+}
+
+// Stats returns the simulated traffic.  Latency is not simulated.
+func (m *MemoryBackend) Stats() Stats {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.stats
+}
@@ -0,0 +1,132 @@
+package acd
+
+import (
+	"testing"
+)
+
+func TestMemoryTrashedConflict(t *testing.T) {
+	m := NewMemoryBackend()
+	a, err := m.UploadJSON(m.GetRoot(), "file", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.UploadJSON(m.GetRoot(), "file", []byte("new"))
+	if ce, ok := IsCombinedError(err); !ok || ce.StatusCode != 409 {
+		t.Fatalf("duplicate upload: %v", err)
+	}
+
+	// a trashed node does not take its name
+	_, err = m.TrashJSON(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.UploadJSON(m.GetRoot(), "file", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.MkdirJSON(m.GetRoot(), "file")
+	if ce, ok := IsCombinedError(err); !ok || ce.StatusCode != 409 {
+		t.Fatalf("duplicate mkdir: %v", err)
+	}
+
+	// restoring the trashed node leaves two available nodes
+	_, err = m.RestoreJSON(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.GetMetadataFS("/file")
+	if err != ErrAmbiguous {
+		t.Fatalf("got %v, want %v", err, ErrAmbiguous)
+	}
+	_, err = m.TrashJSON(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := m.GetMetadataFS("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != a.ID {
+		t.Fatalf("got %v, want %v", f.ID, a.ID)
+	}
+}
+
+func TestMemoryTrashedShadow(t *testing.T) {
+	m := NewMemoryBackend()
+
+	// the trashed duplicates come first so that they would win if
+	// status was ignored
+	trashed, err := m.MkdirJSON(m.GetRoot(), "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.UploadJSON(trashed.ID, "file", []byte("trashed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.TrashJSON(trashed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := m.MkdirJSON(m.GetRoot(), "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := m.UploadJSON(dir.ID, "file", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.TrashJSON(old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := m.UploadJSON(dir.ID, "file", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, include := range []bool{false, true} {
+		m.IncludeTrash(include)
+		a, err := m.GetMetadataFS("/dir/file")
+		if err != nil {
+			t.Fatalf("include trash %v: %v", include, err)
+		}
+		if a.ID != file.ID {
+			t.Fatalf("include trash %v: got %v, want %v", include,
+				a.ID, file.ID)
+		}
+		ids, err := m.ResolveNames(dir.ID, []string{"file"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids["file"] != file.ID {
+			t.Fatalf("include trash %v: resolved %v", include, ids)
+		}
+	}
+	m.IncludeTrash(false)
+
+	ok, id, err := m.NodeExists(m.GetRoot(), "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || id != dir.ID {
+		t.Fatalf("exists %v %v, want %v", ok, id, dir.ID)
+	}
+
+	// listings only hide trashed nodes when asked to
+	assets, err := m.GetChildrenJSON(dir.ID, "?filters=name:file"+
+		FilterAnd+FilterAvailable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assets.Count != 1 || assets.Data[0].ID != file.ID {
+		t.Fatalf("available %+v", assets.Data)
+	}
+	assets, err = m.GetChildrenJSON(dir.ID, "?filters=name:file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assets.Count != 2 {
+		t.Fatalf("all %+v", assets.Data)
+	}
+}
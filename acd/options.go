@@ -0,0 +1,69 @@
+package acd
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+var (
+	ErrProxyScheme = errors.New("unsupported proxy scheme")
+	ErrTLSVersion  = errors.New("unsupported TLS version")
+)
+
+// Options tunes a Client.
+type Options struct {
+	// Proxy is the URL of the proxy all requests go through, e.g.
+	// http://proxy:3128 or socks5://proxy:1080.  When empty
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored.
+	Proxy string
+
+	// TLS configures the connections to cloud drive, e.g. to trust a
+	// TLS inspecting middlebox through RootCAs.  Versions before TLS 1.2
+	// are only used when MinVersion asks for them explicitly.
+	TLS *tls.Config
+}
+
+// NewHTTPClient returns the HTTP client that is shared by all requests of a
+// Client, e.g. to obtain a token through the same proxy.  SOCKS5 proxies are
+// handled by the transport itself.
+func NewHTTPClient(o *Options) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+
+	t.TLSClientConfig = &tls.Config{}
+	if o.TLS != nil {
+		t.TLSClientConfig = o.TLS.Clone()
+	}
+	if t.TLSClientConfig.MinVersion == 0 {
+		t.TLSClientConfig.MinVersion = tls.VersionTLS12
+	}
+
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, ErrProxyScheme
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	return &http.Client{Transport: t}, nil
+}
+
+// ParseTLSVersion returns the TLS version called name, "1.2" or "1.3".
+// Older versions are insecure and not supported.
+func ParseTLSVersion(name string) (uint16, error) {
+	switch name {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, ErrTLSVersion
+}
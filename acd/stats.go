@@ -0,0 +1,69 @@
+package acd
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the traffic a Backend handled.
+type Stats struct {
+	Requests   int64         `json:"requests"`   // requests sent
+	Uploaded   int64         `json:"uploaded"`   // request body bytes
+	Downloaded int64         `json:"downloaded"` // response body bytes
+	Latency    time.Duration `json:"latency"`    // cumulative request time
+}
+
+// counters are the atomically updated Stats of a Client.  They are allocated
+// separately, which keeps them 64 bit aligned.
+type counters struct {
+	requests   int64
+	uploaded   int64
+	downloaded int64
+	latency    int64 // nanoseconds
+}
+
+// countingReader adds the number of bytes read to n.
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// do executes req and accounts for it in the client stats.  Latency is the
+// time until the response headers arrive; bytes are counted as the request
+// and response bodies are read.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&c.stats.requests, 1)
+	if req.Body != nil && req.Body != http.NoBody {
+		// counted as sent since chunked uploads have no length
+		req.Body = countingReader{ReadCloser: req.Body,
+			n: &c.stats.uploaded}
+	}
+
+	start := time.Now()
+	res, err := c.client.Do(req)
+	atomic.AddInt64(&c.stats.latency, int64(time.Since(start)))
+	if err != nil {
+		return nil, err
+	}
+	res.Body = countingReader{ReadCloser: res.Body, n: &c.stats.downloaded}
+
+	return res, nil
+}
+
+// Stats returns a snapshot of the traffic handled by c so far.
+func (c *Client) Stats() Stats {
+	return Stats{
+		Requests:   atomic.LoadInt64(&c.stats.requests),
+		Uploaded:   atomic.LoadInt64(&c.stats.uploaded),
+		Downloaded: atomic.LoadInt64(&c.stats.downloaded),
+		Latency:    time.Duration(atomic.LoadInt64(&c.stats.latency)),
+	}
+}
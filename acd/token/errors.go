@@ -118,4 +118,29 @@ var (
 	ErrPathIsFolder = errors.New("path is a folder")
 	// ErrWrongPermissions is returned if the file has the wrong permissions.
 	ErrWrongPermissions = errors.New("file has wrong permissions")
+
+	// Token errors
+
+	// ErrTokenMalformed is returned if the token file can not be decoded or
+	// carries no refresh token.
+	ErrTokenMalformed = errors.New("the token file is malformed")
+	// ErrRefreshRejected is returned if the refresh server did not return a
+	// new token, e.g. because the refresh token was revoked.
+	ErrRefreshRejected = errors.New("the token refresh was rejected")
+	// ErrRefreshUnavailable is returned if the refresh server failed to
+	// answer a refresh, e.g. because it is overloaded.
+	ErrRefreshUnavailable = errors.New("the token refresh service is " +
+		"unavailable")
 )
+
+// IsTransient returns true if err is a token refresh failure that may go
+// away when the refresh is retried later, as opposed to a token that was
+// rejected.
+func IsTransient(err error) bool {
+	switch err {
+	case ErrDoingHTTPRequest, ErrRefreshUnavailable,
+		ErrJSONDecodingResponseBody:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package token
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRefreshError(t *testing.T) {
+	tests := []struct {
+		code      int
+		want      error
+		transient bool
+	}{
+		{http.StatusBadRequest, ErrRefreshRejected, false},
+		{http.StatusUnauthorized, ErrRefreshRejected, false},
+		{http.StatusForbidden, ErrRefreshRejected, false},
+		{http.StatusNotFound, ErrRefreshRejected, false},
+		{http.StatusTooManyRequests, ErrRefreshUnavailable, true},
+		{http.StatusInternalServerError, ErrRefreshUnavailable, true},
+		{http.StatusBadGateway, ErrRefreshUnavailable, true},
+		{http.StatusServiceUnavailable, ErrRefreshUnavailable, true},
+		{http.StatusGatewayTimeout, ErrRefreshUnavailable, true},
+	}
+	for _, tt := range tests {
+		err := refreshError(tt.code)
+		if err != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.code, err, tt.want)
+		}
+		if IsTransient(err) != tt.transient {
+			t.Errorf("%v: transient %v, want %v", tt.code,
+				IsTransient(err), tt.transient)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{ErrDoingHTTPRequest, true},
+		{ErrJSONDecodingResponseBody, true},
+		{ErrRefreshUnavailable, true},
+		{ErrRefreshRejected, false},
+		{ErrTokenMalformed, false},
+		{ErrOpenFile, false},
+		{errors.New("other"), false},
+	}
+	for _, tt := range tests {
+		if got := IsTransient(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package token
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/marcopeereboom/acdb/internal/random"
+
+	"golang.org/x/oauth2"
+)
+
+// Scopes are the Cloud Drive permissions Login asks for.
+var Scopes = []string{"clouddrive:read_all", "clouddrive:write"}
+
+// LoginOptions select the Login with Amazon client and how the user is sent
+// to authorize it.
+type LoginOptions struct {
+	// ClientID and ClientSecret identify the security profile, created
+	// at https://developer.amazon.com, that is allowed to access Cloud
+	// Drive.  Its allowed return URLs must include the callback.
+	ClientID     string
+	ClientSecret string
+
+	// Listen is the local address of the callback server, e.g.
+	// localhost:54321.  The callback is http://Listen/.
+	Listen string
+
+	// Open sends the user to url, e.g. by starting a browser.
+	Open func(url string) error
+
+	// Client is used to exchange the code, nil is http.DefaultClient.
+	Client *http.Client
+}
+
+// Login runs the Login with Amazon authorization code flow and saves the
+// token in path.  The user authorizes the client in the browser, Amazon
+// redirects back to a local server with the code and the code is exchanged
+// for a token that is refreshed with the same client.  Login returns once
+// the token is saved or when ctx is done.
+func Login(ctx context.Context, path string, o *LoginOptions) error {
+	if o.ClientID == "" || o.ClientSecret == "" {
+		return errors.New("a client id and secret are required")
+	}
+
+	l, err := net.Listen("tcp", o.Listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	conf := config(o.ClientID, o.ClientSecret, "http://"+o.Listen+"/")
+
+	// state ties the callback to this login
+	var nonce [16]byte
+	_, err = io.ReadFull(random.Reader, nonce[:])
+	if err != nil {
+		return err
+	}
+	state := hex.EncodeToString(nonce[:])
+
+	type result struct {
+		code string
+		err  error
+	}
+	done := make(chan result, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+
+			q := r.URL.Query()
+			var res result
+			switch {
+			case q.Get("state") != state:
+				http.Error(w, "invalid state", http.StatusBadRequest)
+				return
+			case q.Get("error") != "":
+				res.err = fmt.Errorf("login failed: %v",
+					strings.TrimSpace(q.Get("error")+" "+
+						q.Get("error_description")))
+			case q.Get("code") == "":
+				res.err = errors.New("login failed: no code")
+			default:
+				res.code = q.Get("code")
+			}
+			if res.err != nil {
+				http.Error(w, res.err.Error(), http.StatusForbidden)
+			} else {
+				fmt.Fprintf(w, "acdb is logged in, you can close "+
+					"this window.\n")
+			}
+			select {
+			case done <- res:
+			default:
+			}
+		}),
+	}
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	err = o.Open(conf.AuthCodeURL(state))
+	if err != nil {
+		return err
+	}
+
+	var res result
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case res = <-done:
+	}
+	if res.err != nil {
+		return res.err
+	}
+
+	if o.Client != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, o.Client)
+	}
+	t, err := conf.Exchange(ctx, res.code)
+	if err != nil {
+		return fmt.Errorf("login failed: %v", err)
+	}
+
+	return writeToken(path, &tokenFile{
+		Token:        *t,
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+	})
+}
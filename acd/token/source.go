@@ -1,24 +1,43 @@
 // Package token represents an oauth2.TokenSource which has the ability to
-// refresh the access token through the oauth server.
+// refresh the access token through the oauth server, or directly with Amazon
+// for tokens obtained by Login.
 package token
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/marcopeereboom/acdb/debug"
 
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/amazon"
 )
 
-const refreshURL = "https://go-acd.appspot.com/refresh"
+// ServerURL is the token server that hands out and refreshes tokens.
+const ServerURL = "https://go-acd.appspot.com"
+
+const refreshURL = ServerURL + "/refresh"
+
+// endpoint is where Login and clients refresh tokens.
+var endpoint = amazon.Endpoint
 
 // Source provides a Source with support for refreshing from the acd server.
 type Source struct {
-	path  string
-	token *oauth2.Token
+	sync.Mutex
+
+	path   string
+	token  *oauth2.Token
+	client *http.Client // used to refresh the token
+
+	// client that obtained the token, if not the token server
+	clientID     string
+	clientSecret string
 
 	// debug
 	mask int
@@ -26,7 +45,9 @@ type Source struct {
 }
 
 // New returns a new Source implementing oauth2.TokenSource. The path must
-// exist on the filesystem and must be of permissions 0600.
+// exist on the filesystem and must be of permissions 0600.  It returns
+// ErrFileNotFound if it does not exist and ErrTokenMalformed if it does not
+// hold a token that can be refreshed.
 func New(path string, mask int, d debug.Debugger) (*Source, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil, ErrFileNotFound
@@ -35,18 +56,33 @@ func New(path string, mask int, d debug.Debugger) (*Source, error) {
 	ts := &Source{
 		path:     path,
 		token:    new(oauth2.Token),
+		client:   &http.Client{},
 		mask:     mask,
 		Debugger: d,
 	}
-	ts.readToken()
+	if err := ts.readToken(); err != nil {
+		return nil, err
+	}
 
 	return ts, nil
 }
 
+// SetClient sets the HTTP client used to refresh the token, e.g. to go
+// through a proxy.
+func (ts *Source) SetClient(c *http.Client) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	ts.client = c
+}
+
 // Token returns an oauth2.Token. If the cached token (in (*Source).path) has
 // expired, it will fetch the token from the server and cache it before
 // returning it.
 func (ts *Source) Token() (*oauth2.Token, error) {
+	ts.Lock()
+	defer ts.Unlock()
+
 	if !ts.token.Valid() {
 		ts.Log(ts.mask, "[TKN] token is not valid, it has probably expired")
 		if err := ts.refreshToken(); err != nil {
@@ -61,6 +97,63 @@ func (ts *Source) Token() (*oauth2.Token, error) {
 	return ts.token, nil
 }
 
+// tokenFile is the token as it is stored.  Tokens obtained by Login carry
+// the client that obtained them since only that client can refresh them.
+type tokenFile struct {
+	oauth2.Token
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// config returns the OAuth configuration of client id and secret.
+func config(clientID, clientSecret, redirect string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     endpoint,
+		RedirectURL:  redirect,
+		Scopes:       Scopes,
+	}
+}
+
+// writeToken replaces path, which is only accessible to the user, with tf.
+// The token is written to a temporary file that is renamed over path so
+// that a crash never leaves a truncated token behind.
+func writeToken(path string, tf *tokenFile) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return ErrCreateFile
+	}
+	err = f.Chmod(0600)
+	if err != nil {
+		err = ErrCreateFile
+	} else if json.NewEncoder(f).Encode(tf) != nil {
+		err = ErrJSONEncoding
+	} else if f.Sync() != nil {
+		err = ErrCreateFile
+	}
+	if e := f.Close(); err == nil && e != nil {
+		err = ErrCreateFile
+	}
+	if err == nil && os.Rename(f.Name(), path) != nil {
+		err = ErrCreateFile
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// refreshError returns the error for a refresh that failed with HTTP status
+// code.
+func refreshError(code int) error {
+	if code >= http.StatusInternalServerError ||
+		code == http.StatusTooManyRequests {
+		return ErrRefreshUnavailable
+	}
+	return ErrRefreshRejected
+}
+
 func (ts *Source) readToken() error {
 	ts.Log(ts.mask, "[TKN] reading the token from %s", ts.path)
 	f, err := os.Open(ts.path)
@@ -68,9 +161,18 @@ func (ts *Source) readToken() error {
 		ts.Log(ts.mask, "[TKN] %s: %s", ErrOpenFile, ts.path)
 		return ErrOpenFile
 	}
-	if err := json.NewDecoder(f).Decode(ts.token); err != nil {
+	defer f.Close()
+	var tf tokenFile
+	if err := json.NewDecoder(f).Decode(&tf); err != nil {
 		ts.Log(ts.mask, "[TKN] %s: %s", ErrJSONDecoding, err)
-		return ErrJSONDecoding
+		return ErrTokenMalformed
+	}
+	ts.token = &tf.Token
+	ts.clientID = tf.ClientID
+	ts.clientSecret = tf.ClientSecret
+	if ts.token.RefreshToken == "" {
+		ts.Log(ts.mask, "[TKN] no refresh token in %s", ts.path)
+		return ErrTokenMalformed
 	}
 
 	ts.Log(ts.mask, "[TKN] token loaded successfully")
@@ -79,14 +181,14 @@ func (ts *Source) readToken() error {
 
 func (ts *Source) saveToken() error {
 	ts.Log(ts.mask, "[TKN] saving the token to %s", ts.path)
-	f, err := os.Create(ts.path)
+	err := writeToken(ts.path, &tokenFile{
+		Token:        *ts.token,
+		ClientID:     ts.clientID,
+		ClientSecret: ts.clientSecret,
+	})
 	if err != nil {
-		ts.Log(ts.mask, "[TKN] %s: %s", ErrCreateFile, ts.path)
-		return ErrCreateFile
-	}
-	if err := json.NewEncoder(f).Encode(ts.token); err != nil {
-		ts.Log(ts.mask, "[TKN] %s: %s", ErrJSONEncoding, err)
-		return ErrJSONEncoding
+		ts.Log(ts.mask, "[TKN] %s: %s", err, ts.path)
+		return err
 	}
 
 	ts.Log(ts.mask, "[TKN] token saved successfully")
@@ -94,6 +196,10 @@ func (ts *Source) saveToken() error {
 }
 
 func (ts *Source) refreshToken() error {
+	if ts.clientID != "" {
+		return ts.refreshClient()
+	}
+
 	ts.Log(ts.mask, "[TKN] refreshing the token from %q", refreshURL)
 
 	data, err := json.Marshal(ts.token)
@@ -107,16 +213,57 @@ func (ts *Source) refreshToken() error {
 		return ErrCreatingHTTPRequest
 	}
 	req.Header.Set("Content-Type", "application/json")
-	res, err := (&http.Client{}).Do(req)
+	res, err := ts.client.Do(req)
 	if err != nil {
 		ts.Log(ts.mask, "[TKN] %s: %s", ErrDoingHTTPRequest, err)
 		return ErrDoingHTTPRequest
 	}
 	defer res.Body.Close()
-	if err := json.NewDecoder(res.Body).Decode(ts.token); err != nil {
+	if res.StatusCode != http.StatusOK {
+		err := refreshError(res.StatusCode)
+		ts.Log(ts.mask, "[TKN] %s: %s", err, res.Status)
+		return err
+	}
+
+	// decode into a copy since callers may still hold the old token
+	token := *ts.token
+	token.AccessToken = ""
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
 		ts.Log(ts.mask, "[TKN] %s: %s", ErrJSONDecodingResponseBody, err)
 		return ErrJSONDecodingResponseBody
 	}
+	if token.AccessToken == "" {
+		ts.Log(ts.mask, "[TKN] %s: no new access token",
+			ErrRefreshRejected)
+		return ErrRefreshRejected
+	}
+	ts.token = &token
+	ts.Log(ts.mask, "[TKN] token was refreshed successfully")
+
+	return nil
+}
+
+// refreshClient refreshes the token with Amazon using the client that
+// obtained it.
+func (ts *Source) refreshClient() error {
+	ts.Log(ts.mask, "[TKN] refreshing the token for client %v",
+		ts.clientID)
+
+	// expire the copy so that it is refreshed
+	token := *ts.token
+	token.AccessToken = ""
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient,
+		ts.client)
+	t, err := config(ts.clientID, ts.clientSecret, "").TokenSource(ctx,
+		&token).Token()
+	if err != nil {
+		ts.Log(ts.mask, "[TKN] refresh: %s", err)
+		if e, ok := err.(*oauth2.RetrieveError); ok {
+			return refreshError(e.Response.StatusCode)
+		}
+		return ErrDoingHTTPRequest
+	}
+	ts.token = t
 	ts.Log(ts.mask, "[TKN] token was refreshed successfully")
 
 	return nil
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"container/list"
-	"crypto/sha256"
-	"encoding/hex"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,419 +14,251 @@ import (
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/nacl/secretbox"
-
 	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/acd/token"
+	"github.com/marcopeereboom/acdb/backup"
 	"github.com/marcopeereboom/acdb/debug"
-	"github.com/marcopeereboom/acdb/metadata"
 	"github.com/marcopeereboom/acdb/shared"
 	"github.com/marcopeereboom/goutil"
 )
 
 const (
-	dataName     = "data"
-	metadataName = "metadata"
-	secretsName  = "secrets"
-
 	debugApp = 1 << 32
+)
 
-	modeCreate = iota
-	modeExtract
-	modeList
+// exit codes
+const (
+	exitOK       = 0 // success
+	exitFatal    = 1 // run aborted
+	exitSkipped  = 2 // run completed but skipped files on error
+	exitDeadline = 3 // run stopped at -deadline, snapshot is partial
 )
 
 // acdb amazon cloud drive backup context.
 type acdb struct {
 	debug.Debugger
 
-	me *metadata.MetadataEncoder
-	md *metadata.MetadataDecoder
-
-	c    *acd.Client
+	c    acd.Backend
 	keys shared.Keys
 
-	dataID     string
-	metadataID string
+	// keys are not encrypted at rest, or not stored at all yet
+	keysPlaintext bool
+	keysFilename  string
 
-	// flags
-	verbose  bool
-	compress bool
-	perms    bool
-	target   string
-	mode     int
-	root     string
-
-	// permission for directories
-	permList *list.List
-}
+	// password that unlocked the keys, if any
+	password []byte
 
-func (a *acdb) makeDirectories() error {
-	a.Log(acd.DebugTrace, "[TRC] makeDirectories")
+	// additional secrets, only downloaded when the password does not
+	// open the secrets
+	extraSecrets [][]byte
 
-	asset, err := a.c.MkdirJSON(a.c.GetRoot(), dataName)
-	if err != nil {
-		if e, ok := acd.IsCombinedError(err); ok {
-			if e.StatusCode != http.StatusConflict {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		a.dataID = asset.ID
-	}
+	dataID     string
+	metadataID string
 
-	asset, err = a.c.MkdirJSON(a.c.GetRoot(), metadataName)
-	if err != nil {
-		if e, ok := acd.IsCombinedError(err); ok {
-			if e.StatusCode != http.StatusConflict {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		a.metadataID = asset.ID
-	}
+	// backing up, the only operation that records the dedup key
+	// fingerprint, see checkDedupKey
+	create bool
 
-	return nil
+	// flags
+	target           string
+	refresh          bool
+	json             bool
+	noSavePassword   bool
+	passwordFd       int
+	encryptLocalKeys bool
+	deriveKeys       bool
+	trashSecrets     bool
+	includeTrash     bool
+	includeOwn       bool
+	chunked          bool
+	proxy            string
+	caFile           string
+	tlsMin           string
+	tags             []string
+	verbose          bool
+	veryVerbose      bool
+	local            bool
+	quotaCheck       string
+	metrics          string
+	notifyURL        string
+	notifyTimeout    time.Duration
+	notifyRetries    int
+
+	// options for the backup engine, remote folders are filled in once
+	// online
+	opts backup.Options
 }
 
-func (a *acdb) walk(path string, info os.FileInfo, errIn error) error {
-	a.Log(acd.DebugLoud, "[TRC] walk")
-
-	if errIn != nil {
-		fmt.Printf("skipping %v error: %v\n", path, errIn)
-		return nil
-	}
-
-	var (
-		payload []byte
-		digest  *[sha256.Size]byte
-		err     error
-	)
-
-	switch {
-	case info.Mode()&os.ModeDir == os.ModeDir:
-		// dir
-		err = a.me.Dir(path, info)
-		if err != nil {
-			break
-		}
-
-	case info.Mode()&os.ModeSymlink == os.ModeSymlink:
-		// symlink
-		err = a.me.Symlink(path, info)
-		if err != nil {
-			break
-		}
-
-	case info.Mode().IsRegular() && info.Size() == 0:
-		// zero sized file
-		err = a.me.File(path, info, "", nil)
-		if err != nil {
-			break
-		}
-
-	case info.Mode().IsRegular():
-		// regular file
-
-		// external pointer AND digest
-		digest, err = goutil.FileHMACSHA256(path, a.keys.Dedup[:])
-		if err != nil {
-			break
-		}
-
-		payload, err = shared.FileNaClEncrypt(path, a.compress,
-			&a.keys.Data)
-		if err != nil {
-			break
-		}
-
-		mime, _, err := goutil.FileCompressible(path)
+// readNames returns the names listed in filename, one per line.  Blank lines
+// and lines starting with '#' are ignored.  A filename of - reads stdin.
+func readNames(filename string) ([]string, error) {
+	var r io.Reader
+	if filename == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(filename)
 		if err != nil {
-			break
+			return nil, err
 		}
+		defer func() { _ = f.Close() }()
+		r = f
+	}
 
-		err = a.me.File(path, info, mime, digest)
-		if err != nil {
-			break
+	var names []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" ||
+			strings.HasPrefix(line, "#") {
+			continue
 		}
-
-	default:
-		fmt.Printf("skipping %v: unsuported file type\n", path)
-
-		return nil
+		names = append(names, line)
 	}
-
-	if err != nil {
-		fmt.Printf("skipping %v: %v\n", path, err)
-		return nil
+	if err := s.Err(); err != nil {
+		return nil, err
 	}
 
-	var d, ds string
-	if digest != nil {
-		d = hex.EncodeToString(digest[:])
-	}
+	return names, nil
+}
 
-	if digest != nil {
-		asset, err := a.c.UploadJSON(a.dataID, d, payload)
-		if err != nil {
-			if e, ok := acd.IsCombinedError(err); ok {
-				if e.StatusCode != http.StatusConflict {
-					fmt.Printf("skipping %v: %v\n",
-						path, err)
-					return nil
-				}
-				ds += " deduped "
-			} else {
-				fmt.Printf("should not happen %T: %v\n",
-					err, err)
-				return nil
-			}
-		} else {
-			ds += " new "
-		}
+// findFolders looks up, or creates, the data and metadata folders and
+// caches their ids.
+func (a *acdb) findFolders() error {
+	a.Log(acd.DebugTrace, "[TRC] findFolders")
 
-		_ = asset
+	var err error
+	a.dataID, a.metadataID, err = backup.FindFolders(a.c, a.includeTrash)
+	if err != nil {
+		return err
 	}
 
-	if a.verbose {
-		if digest != nil {
-			ds += "=> " + d
-		}
-		fmt.Printf("%v %15v %v%v\n",
-			info.Mode(),
-			info.Size(),
-			path,
-			ds)
+	err = a.cacheFolders()
+	if err != nil {
+		a.Log(debugApp, "[APP] could not cache folders: %v", err)
 	}
 
 	return nil
 }
 
-func (a *acdb) archive(args []string) error {
-	a.Log(acd.DebugTrace, "[TRC] archive")
+// connect creates the cloud drive client and loads the keys.
+func (a *acdb) connect() error {
+	a.Log(acd.DebugTrace, "[TRC] connect")
 
-	var (
-		f   *os.File
-		err error
-	)
-	if a.target == "-" {
-		f, err = ioutil.TempFile("", "acdb")
-	} else {
-		f, err = os.Create(a.target)
-	}
-	if err != nil {
-		return err
+	// already connected
+	if a.c != nil {
+		return nil
 	}
-	defer f.Close()
 
-	// setup metadata encoder
-	a.me, err = metadata.NewEncoder(f, a.compress)
+	keysFilename, err := shared.DefaultKeysFilename()
 	if err != nil {
 		return err
 	}
-	defer a.me.Flush()
-
-	// go online
-	err = a.online()
+	c, err := a.newClient()
 	if err != nil {
 		return err
 	}
+	a.c = c
 
-	for _, v := range args {
-		err := filepath.Walk(v, a.walk)
-		if err != nil {
-			return err
-		}
-	}
-
-	// determine what to do with metadata
-	if a.target == "-" {
-		a.me.Flush()
-
-		// upload to cloud drive
-		_, err = f.Seek(0, os.SEEK_SET)
-		if err != nil {
-			return err
-		}
-		fi, err := f.Stat()
-		if err != nil {
-			return err
-		}
-
-		// read metadata
-		md := make([]byte, fi.Size())
-		_, err = f.Read(md)
-		if err != nil {
-			return err
-		}
-
-		// encrypt metadata
-		nonce, err := shared.NaClNonce()
-		if err != nil {
-			return err
-		}
-		mde := secretbox.Seal(nonce[:], md, nonce, &a.keys.MD)
-
-		// upload metadata
-		name := time.Now().Format("20060102.150405")
-		_, err = a.c.UploadJSON(a.metadataID, name, mde)
-		if err != nil {
-			return err
-		}
-
-		fmt.Printf("backup complete: %v\n", name)
+	if a.deriveKeys {
+		// derived from the remote secrets once online
+		return nil
 	}
 
-	return nil
+	return a.loadKeys(keysFilename)
 }
 
-func (a *acdb) downloadPayload(fullpath string, id [sha256.Size]byte) error {
-
-	ids := hex.EncodeToString(id[:])
-
-	a.Log(acd.DebugTrace, "[TRC] downloadPayload %v", ids)
-
-	asset, err := a.c.GetMetadataFS("/data/" + ids)
+// newClient creates the cloud drive client, which validates the token.
+func (a *acdb) newClient() (*acd.Client, error) {
+	filename, err := tokenFilename()
 	if err != nil {
-		return fmt.Errorf("remote object not found")
+		return nil, err
 	}
-	a.Log(acd.DebugTrace, "[TRC] found asset: %v -> %v\n",
-		asset.ID,
-		asset.Name)
-	body, err := a.c.DownloadJSON(asset.ID)
+	tc, err := a.tlsConfig()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// decrypt
-	_, payload, err := shared.NaClDecrypt(body, &a.keys.Data)
+	c, err := acd.NewClientWithOptions(filename, a.Debugger,
+		&acd.Options{Proxy: a.proxy, TLS: tc})
 	if err != nil {
-		return err
+		return nil, tokenError(filename, err)
 	}
+	c.Chunked(a.chunked)
+	c.IncludeTrash(a.includeTrash)
+
+	return c, nil
+}
 
-	// save file
-	out, err := ioutil.TempFile(a.root, "acdb")
-	defer func() { _ = out.Close() }()
-	_, err = out.Write(payload)
+// localKeys loads the local keys without going online.
+func (a *acdb) localKeys() error {
+	keysFilename, err := shared.DefaultKeysFilename()
 	if err != nil {
 		return err
 	}
+	return a.loadKeys(keysFilename)
+}
+
+// offline stores, or reads, the file data in the directory next to the local
+// archive instead of on Cloud Drive, which makes the archive self-contained.
+func (a *acdb) offline() error {
+	a.Log(acd.DebugTrace, "[TRC] offline")
 
-	// rename file
-	err = os.Rename(out.Name(), path.Join(a.root, fullpath))
+	if a.deriveKeys {
+		return fmt.Errorf("-derive-keys requires Cloud Drive")
+	}
+	c, err := acd.NewDirBackend(backup.LocalDataDir(a.target))
 	if err != nil {
 		return err
 	}
+	a.c = c
 
-	return nil
+	return a.localKeys()
 }
 
-func (a *acdb) extract(e *metadata.File) (bool, error) {
-	a.Log(acd.DebugTrace, "[TRC] extract")
-
-	// ensure we have a valid path
-	err := os.MkdirAll(path.Join(a.root, path.Dir(e.Name)), 0755)
+// tlsConfig returns the TLS configuration selected by -ca-file and -tls-min.
+func (a *acdb) tlsConfig() (*tls.Config, error) {
+	version, err := acd.ParseTLSVersion(a.tlsMin)
 	if err != nil {
-		return true, err
+		return nil, fmt.Errorf("invalid TLS version: %v", a.tlsMin)
 	}
-
-	evalpath := path.Join(a.root, e.Name)
-	switch {
-	case a.mode == modeExtract && e.Size == 0:
-		f, err := os.Create(evalpath)
-		if err != nil {
-			return true, err
-		}
-		f.Close()
-
-	default:
-		err = a.downloadPayload(e.Name, e.Digest)
-		if err != nil {
-			return false, err
-		}
+	tc := tls.Config{MinVersion: version}
+	if a.caFile == "" {
+		return &tc, nil
 	}
 
-	if a.perms {
-		// set UID/GID/perms
-		err = os.Chmod(evalpath, e.Mode)
-		if err != nil {
-			return true, err
-		}
-
-		err = os.Chtimes(evalpath, e.Modified,
-			e.Modified)
-		if err != nil {
-			return true, err
-		}
-
-		err = os.Chown(evalpath, e.Owner, e.Group)
-		if err != nil {
-			return true, err
-		}
+	pem, err := ioutil.ReadFile(a.caFile)
+	if err != nil {
+		return nil, err
+	}
+	tc.RootCAs = x509.NewCertPool()
+	if !tc.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%v: no certificates found", a.caFile)
 	}
 
-	return false, nil
+	return &tc, nil
 }
 
 func (a *acdb) online() error {
 	a.Log(acd.DebugTrace, "[TRC] online")
 
-	keysFilename, err := shared.DefaultKeysFilename()
-	if err != nil {
-		return err
-	}
-	rootDir := path.Dir(keysFilename)
-	err = os.MkdirAll(rootDir, 0700)
-	if err != nil {
-		return err
-	}
-
-	filename := path.Join(rootDir, shared.TokenFilename)
-	a.c, err = acd.NewClient(filename, a.Debugger)
-	if err != nil {
-		return fmt.Errorf("%v: %v", filename, err)
-	}
-
-	err = shared.LoadKeys(keysFilename, &a.keys)
-	if err != nil {
-		return err
+	// already online
+	if a.dataID != "" && a.metadataID != "" {
+		return nil
 	}
 
-	// get root folders
-	children, err := a.c.GetChildrenJSON("",
-		"?filters=kind:"+acd.AssetFolder)
+	err := a.connect()
 	if err != nil {
 		return err
 	}
 
-	// save off data and metadata ids
-	count := 0
-	for _, v := range children.Data {
-		switch v.Name {
-		case dataName:
-			a.dataID = v.ID
-		case metadataName:
-			a.metadataID = v.ID
-		default:
-			continue
-		}
-		count++
-		if count == 2 {
-			break
-		}
-	}
-	if count != 2 {
-		err = a.makeDirectories()
+	// use cached folder ids unless asked not to
+	if a.refresh || !a.cachedFolders() {
+		err = a.findFolders()
 		if err != nil {
-			return fmt.Errorf("could not create required "+
-				"directories: %v", err)
+			return err
 		}
 	}
 	a.Log(debugApp, "[APP] root: %v data: %v metadata: %v",
@@ -437,276 +271,289 @@ func (a *acdb) online() error {
 		return err
 	}
 
-	return nil
-}
-
-func (a *acdb) list() error {
-	a.Log(acd.DebugTrace, "[TRC] list %v", a.mode)
-
-	if a.mode == modeExtract {
-		err := a.online()
-		if err != nil {
-			return err
-		}
-	}
-
-	// determine where md resides
-	f, err := os.Open(a.target)
+	err = a.checkDedupKey()
 	if err != nil {
-		// not localy so try cloud drive
-		err := a.online()
-		if err != nil {
-			return err
-		}
+		return err
+	}
 
-		// get metadata
-		md, err := a.downloadMD(a.target)
+	if a.keysPlaintext && a.encryptLocalKeys {
+		err = a.encryptKeys()
 		if err != nil {
 			return err
 		}
+	}
 
-		// decrypt
-		var nonce [shared.NonceSize]byte
-		copy(nonce[:], md[:shared.NonceSize])
-		mdd, ok := secretbox.Open(nil, md[shared.NonceSize:], &nonce,
-			&a.keys.MD)
-		if !ok {
-			return fmt.Errorf("could not decrypt metadata")
-		}
-
-		// create local md file
-		f, err = ioutil.TempFile("", "acdb")
-		if err != nil {
-			return err
-		}
-		_, err = f.Write(mdd)
-		if err != nil {
-			return err
-		}
-		_, err = f.Seek(0, os.SEEK_SET)
+	// hand the folders to the engine and keep the cache current when
+	// it has to look them up again
+	a.opts.DataID = a.dataID
+	a.opts.MetadataID = a.metadataID
+	a.opts.OnFolders = func(dataID, metadataID string) {
+		a.dataID, a.metadataID = dataID, metadataID
+		err := a.cacheFolders()
 		if err != nil {
-			return err
+			a.Log(debugApp, "[APP] could not cache folders: %v",
+				err)
 		}
 	}
 
-	a.md, err = metadata.NewDecoder(f)
+	return nil
+}
+
+// listRemote display all files in the metadata directory.
+func (a *acdb) listRemote() error {
+	err := a.online()
 	if err != nil {
 		return err
 	}
 
-	var (
-		fullpath string
-		mode     os.FileMode
-		size     int64
-	)
-	for {
-		t, err := a.md.Next()
+	children, err := a.children(a.metadataID, "")
+	if backup.IsNotFound(err) && !a.refresh {
+		// cached folder is gone
+		err = a.findFolders()
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
 			return err
 		}
-
-		switch e := t.(type) {
-		case metadata.Dir:
-			fullpath = e.Name
-			mode = e.Mode
-			size = 0
-
-			if a.mode == modeExtract {
-				err := os.MkdirAll(path.Join(a.root, fullpath),
-					0755)
-				if err != nil {
-					return err
-				}
-
-				if a.perms {
-					// set perms after extracting
-					a.permList.PushFront(e)
-				}
-			}
-
-		case metadata.Symlink:
-			fullpath = e.Name
-			mode = os.ModeSymlink | 0755
-			size = 0
-
-			if a.mode == modeExtract {
-				err := os.Symlink(path.Join(a.root, e.Link),
-					path.Join(a.root, fullpath))
-				if err != nil {
-					return err
-				}
-			}
-
-		case metadata.File:
-			fullpath = e.Name
-			mode = e.Mode
-			size = e.Size
-
-			if a.mode == modeExtract {
-				fatal, err := a.extract(&e)
-				if fatal && err != nil {
-					return err
-				}
-				if err != nil {
-					fmt.Printf("could not extract %v: %v\n",
-						fullpath, err)
-					continue
-				}
-			}
-
-		default:
-			return fmt.Errorf("unsuported type: %T", t)
-		}
-
-		fmt.Printf("%v %15v %v\n",
-			mode,
-			size,
-			fullpath)
+		children, err = a.children(a.metadataID, "")
+	}
+	if err != nil {
+		return err
 	}
 
-	// set directory permissions
-	for e := a.permList.Front(); e != nil; e = e.Next() {
-		ee, ok := e.Value.(metadata.Dir)
-		if !ok {
+	for _, v := range children {
+		if v.Kind != acd.AssetFile || !hasLabels(v.Labels, a.tags) {
 			continue
 		}
-
-		evalpath := path.Join(a.root, ee.Name)
-		// set UID/GID/perms
-		err = os.Chmod(evalpath, ee.Mode)
-		if err != nil {
-			return err
-		}
-
-		err = os.Chtimes(evalpath, ee.Modified,
-			ee.Modified)
-		if err != nil {
-			return err
+		var labels string
+		if len(v.Labels) != 0 {
+			labels = "  [" + strings.Join(v.Labels, ",") + "]"
 		}
-
-		err = os.Chown(evalpath, ee.Owner, ee.Group)
-		if err != nil {
-			return err
-		}
-
+		fmt.Printf("%13v  %v  %v%v%v\n",
+			v.ContentProperties.Size,
+			v.ModifiedDate.Format("Mon 02 Jan 2006 15:04:05"),
+			v.Name,
+			labels,
+			a.describe(v.Description))
 	}
 
 	return nil
 }
 
-// listRemote display all files in the metadata directory.
-func (a *acdb) listRemote() error {
-	err := a.online()
+// describe returns the snapshot description desc for -T, if any.
+func (a *acdb) describe(desc string) string {
+	if desc == "" {
+		return ""
+	}
+	d, err := backup.DecodeDescription(desc, &a.keys.MD)
 	if err != nil {
-		return err
+		a.Log(acd.DebugTrace, "[TRC] describe: %v", err)
+		return ""
 	}
 
-	mdID := a.metadataID
-	for {
-		children, err := a.c.GetChildrenJSON(mdID, "")
-		if err != nil {
-			return err
-		}
+	s := fmt.Sprintf("  %v, %v files", d.Host, d.Files)
+	if len(d.Paths) != 0 {
+		s += ": " + strings.Join(d.Paths, " ")
+	}
+	if d.MorePaths != 0 {
+		s += fmt.Sprintf(" and %v more", d.MorePaths)
+	}
 
-		for _, v := range children.Data {
-			if v.Kind != acd.AssetFile {
-				continue
+	return s
+}
+
+// hasLabels returns true if labels contains all of want.
+func hasLabels(labels, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, v := range labels {
+			if v == w {
+				found = true
+				break
 			}
-			fmt.Printf("%13v  %v  %v\n",
-				v.ContentProperties.Size,
-				v.ModifiedDate.Format("Mon 02 Jan 2006 15:04:05"),
-				v.Name)
 		}
-
-		if children.NextToken == "" {
-			break
+		if !found {
+			return false
 		}
-		mdID = children.NextToken
 	}
-
-	return nil
+	return true
 }
 
 // uploadSecrets encrypts and uploads the secrets to acd for safe keeping.
 func (a *acdb) uploadSecrets() error {
 	a.Log(acd.DebugTrace, "[TRC] uploadSecrets")
 
-	fmt.Printf("Cloud Drive does not have a copy of the secrets.  Please enter " +
-		"the password to encrypt the secrets.  Loss of this password is " +
-		"unrecoverable!\n")
+	exists, id, err := a.c.NodeExists(a.metadataID, backup.SecretsName)
+	if err != nil {
+		return err
+	}
 
-	p, err := shared.PromptPassword(true)
+	p, err := a.suppliedPassword()
 	if err != nil {
 		return err
 	}
+	if p == nil {
+		if exists {
+			fmt.Printf("Please enter the password to encrypt the " +
+				"new secrets.  Loss of this password is " +
+				"unrecoverable!\n")
+		} else {
+			fmt.Printf("Cloud Drive does not have a copy of the " +
+				"secrets.  Please enter the password to " +
+				"encrypt the secrets.  Loss of this password " +
+				"is unrecoverable!\n")
+		}
+		p, err = shared.PromptPassword(!a.noSavePassword)
+		if err != nil {
+			return err
+		}
+	}
 	defer func() {
 		goutil.Zero(p)
 	}()
 
-	blob, err := a.keys.Encrypt(p, 32768, 16, 2)
+	var blob []byte
+	if a.deriveKeys {
+		blob, err = a.deriveNewKeys(p)
+	} else {
+		blob, err = a.keys.Encrypt(p, shared.KeysN, shared.KeysR,
+			shared.KeysP)
+	}
 	if err != nil {
 		return err
 	}
+	a.rememberPassword(p)
 
-	asset, err := a.c.UploadJSON(a.metadataID, secretsName, blob)
-	if err != nil {
-		if e, ok := acd.IsCombinedError(err); ok {
-			if e.StatusCode != http.StatusConflict {
-				return fmt.Errorf("secrets appeared unexpectedly")
+	return a.storeSecrets(exists, id, blob)
+}
+
+// storeSecrets stores blob as the secrets.  Secrets that are already on acd,
+// node id, are overwritten in place or, with -trash-before-reupload, moved to
+// the trash and uploaded anew.
+func (a *acdb) storeSecrets(exists bool, id string, blob []byte) error {
+	var (
+		asset *acd.Asset
+		err   error
+	)
+	if exists && !a.trashSecrets {
+		asset, err = a.c.OverwriteContent(id, blob)
+		if err != nil {
+			return fmt.Errorf("could not overwrite secrets: %v", err)
+		}
+	} else {
+		if exists {
+			_, err = a.c.TrashJSON(id)
+			if err != nil {
+				return fmt.Errorf("could not trash secrets: %v",
+					err)
 			}
 		}
+		asset, err = a.c.UploadJSON(a.metadataID, backup.SecretsName,
+			blob)
+		if e, ok := acd.IsCombinedError(err); ok &&
+			e.StatusCode == http.StatusConflict {
+			return fmt.Errorf("secrets appeared unexpectedly")
+		} else if err != nil {
+			return fmt.Errorf("could not upload secrets: %v", err)
+		}
 	}
 
-	a.Log(acd.DebugTrace, "[TRC] uploadSecrets object: %v", asset.ID)
+	a.Log(acd.DebugTrace, "[TRC] storeSecrets object: %v", asset.ID)
 
 	return nil
 }
 
+// suppliedPassword returns the password provided for unattended operation
+// through a file descriptor or the environment, or the one that already
+// unlocked the keys.  It returns nil if no password was supplied.  The
+// caller owns, and should zero, the returned copy.
+func (a *acdb) suppliedPassword() ([]byte, error) {
+	if a.password == nil {
+		// both sources can only be read once
+		var (
+			p   []byte
+			err error
+		)
+		if a.passwordFd >= 0 {
+			p, err = shared.ReadPasswordFd(a.passwordFd)
+		} else {
+			p = shared.EnvPassword()
+		}
+		if err != nil || p == nil {
+			return nil, err
+		}
+		a.rememberPassword(p)
+		goutil.Zero(p)
+	}
+
+	return append([]byte(nil), a.password...), nil
+}
+
+// errKeysDiffer is returned when the remote secrets open but hold other keys
+// than the local ones.
+var errKeysDiffer = errors.New("remote secrets not identical to local " +
+	"secrets")
+
+// verifySecrets verifies password p against the remote secrets blob or,
+// failing that, against the additional secrets added with -add-password.
+// Local keys that differ from the remote secrets are replaced after
+// confirmation, see pullKeys.
 func (a *acdb) verifySecrets(p, blob []byte) error {
 	a.Log(acd.DebugTrace, "[TRC] verifySecrets")
 
+	if a.deriveKeys {
+		return a.deriveSecrets(p, blob)
+	}
+
+	err := a.matchSecrets(p, blob)
+	switch err {
+	case nil:
+		return nil
+	case errKeysDiffer:
+		return a.pullKeys(p, blob)
+	}
+	if a.extraSecrets == nil {
+		extra, e := a.downloadExtraSecrets()
+		if e != nil {
+			return e
+		}
+		a.extraSecrets = extra
+	}
+	for _, v := range a.extraSecrets {
+		if a.matchSecrets(p, v) == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// matchSecrets returns nil if password p opens the secrets blob and they hold
+// the local keys.
+func (a *acdb) matchSecrets(p, blob []byte) error {
 	// decrypt remote secrets
-	kk, err := shared.KeysDecrypt(p, 32768, 16, 2, blob)
+	kk, err := shared.KeysDecrypt(p, shared.KeysN, shared.KeysR,
+		shared.KeysP, blob)
 	if err != nil {
 		return err
 	}
+	defer kk.Zero()
 
 	// compare to disk one
 	if bytes.Equal(a.keys.MD[:], kk.MD[:]) &&
 		bytes.Equal(a.keys.Data[:], kk.Data[:]) &&
 		bytes.Equal(a.keys.Dedup[:], kk.Dedup[:]) {
 
+		a.rememberPassword(p)
 		return nil
 	}
 
-	return fmt.Errorf("remote secrets not identical to local secrets")
-}
-
-func (a *acdb) downloadMD(name string) ([]byte, error) {
-	a.Log(acd.DebugTrace, "[TRC] downloadMD %v", name)
-
-	asset, err := a.c.GetMetadataFS(metadataName + "/" + name)
-	if err != nil {
-		return nil, fmt.Errorf("remote metadata %v: not found", name)
-	}
-	a.Log(acd.DebugTrace, "[TRC] found asset: %v -> %v\n",
-		asset.ID,
-		asset.Name)
-	blob, err := a.c.DownloadJSON(asset.ID)
-	if err != nil {
-		return nil, err
-	}
-
-	return blob, nil
+	return errKeysDiffer
 }
 
 func (a *acdb) downloadSecrets() error {
 	a.Log(acd.DebugTrace, "[TRC] downloadSecrets")
 
-	asset, err := a.c.GetMetadataFS(metadataName + "/" + secretsName)
+	asset, err := a.c.GetMetadataFS(backup.MetadataName + "/" +
+		backup.SecretsName)
 	if err != nil {
 		if err == acd.ErrNotFound {
 			return a.uploadSecrets()
@@ -720,35 +567,60 @@ func (a *acdb) downloadSecrets() error {
 	if err != nil {
 		return err
 	}
+	switch {
+	case a.deriveKeys && !shared.IsDerived(blob):
+		return fmt.Errorf("remote secrets hold keys, they can not be " +
+			"derived with -derive-keys")
+	case !a.deriveKeys && shared.IsDerived(blob):
+		return fmt.Errorf("remote secrets hold a salt, use -derive-keys")
+	}
 
-	var p []byte
+	p, err := a.suppliedPassword()
 	defer func() {
 		goutil.Zero(p)
 	}()
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		// can't ask again so fail on a bad password
+		return a.verifySecrets(p, blob)
+	}
 
 	for {
-		p, err = shared.ReadPassword()
-		if err == nil {
-			break
-		}
+		if a.noSavePassword {
+			fmt.Printf("Please enter password to verify the " +
+				"integrity of the remote secrets.\n")
+		} else {
+			p, err = shared.ReadPassword()
+			if err == nil {
+				break
+			}
 
-		if !os.IsNotExist(err) {
-			return err
-		}
+			if !os.IsNotExist(err) {
+				return err
+			}
 
-		fmt.Printf("There is no local password file.  Please enter " +
-			"password to verify the integrity of the remote " +
-			"secrets.\n")
+			fmt.Printf("There is no local password file.  Please " +
+				"enter password to verify the integrity of " +
+				"the remote secrets.\n")
+		}
 		p, err = shared.PromptPassword(false)
 		if err != nil {
 			return err
 		}
 		err = a.verifySecrets(p, blob)
-		if err != nil {
+		if err == errKeysDiffer {
+			return err
+		} else if err != nil {
+			goutil.Zero(p)
 			fmt.Printf("invalid password: %v\n",
 				err)
 			continue
 		}
+		if a.noSavePassword {
+			return nil
+		}
 		return shared.WritePassword(p)
 	}
 
@@ -761,33 +633,259 @@ func _main() error {
 	extract := flag.Bool("x", false, "extract archive")
 	lst := flag.Bool("t", false, "list archive contents")
 	lstRemote := flag.Bool("T", false, "list remote metadata content")
+	repair := flag.Bool("repair", false, "check and repair the remote "+
+		"folder structure")
+	untrash := flag.Bool("untrash", false, "restore remote metadata -f "+
+		"from trash")
+	usage := flag.Bool("usage", false, "display cloud drive storage used")
+	exportShares := flag.Int("export-shares", 0, "split the keys into "+
+		"shares and print them")
+	threshold := flag.Int("threshold", 2, "number of shares required to "+
+		"restore the keys")
+	importShares := flag.String("import-shares", "", "restore the keys "+
+		"from the shares in file, - is stdin")
+	addPassword := flag.String("add-password", "", "seal the keys with "+
+		"an additional password called name")
+	removePassword := flag.String("remove-password", "", "remove the "+
+		"additional password called name")
+	passwd := flag.Bool("passwd", false, "change the password of the "+
+		"remote secrets")
+	index := flag.Bool("index", false, "update the local index of the "+
+		"files in all snapshots")
+	find := flag.String("find", "", "list the versions of the files "+
+		"matching pattern in the local index")
+	login := flag.Bool("login", false, "log in with Amazon and save the "+
+		"Cloud Drive token, requires -client-id and -client-secret")
+	clientID := flag.String("client-id", "", "Login with Amazon client "+
+		"id of the security profile used by -login")
+	clientSecret := flag.String("client-secret", "", "Login with Amazon "+
+		"client secret of the security profile used by -login")
+	whoami := flag.Bool("whoami", false, "check the Cloud Drive token "+
+		"and show the account status and quota")
+	loginAddr := flag.String("login-addr", "localhost:54321", "address "+
+		"of the -login callback, http://address/ must be an allowed "+
+		"return URL of the security profile")
 	verbose := flag.Bool("v", false, "verbose")
+	veryVerbose := flag.Bool("vv", false, "verbose and also show the "+
+		"payload size and compression of every file")
 	compress := flag.Bool("z", false, "enable compression (default false)")
+	level := flag.Int("level", gzip.DefaultCompression, "compression "+
+		"level, 1 is fastest and 9 is best")
+	blockSz := flag.Int("block-size", 0, "parallel compression block "+
+		"size in bytes (default 1MB)")
+	blocks := flag.Int("blocks", 0, "number of blocks compressed in "+
+		"parallel (default number of CPUs)")
+	types := make(backup.CompressTypes)
+	flag.Var(types, "compress-types", "override compression by file "+
+		"extension, e.g. .log.1=compress,.bin=skip")
 	perms := flag.Bool("p", false, "restore ACL")
+	strictPerms := flag.Bool("strict-perms", false, "abort when "+
+		"permissions, ownership or times can not be restored")
+	digest := flag.String("digest", "sha256", "dedup digest algorithm, "+
+		"sha256 or blake2b")
+	acls := flag.Bool("acls", false, "archive and restore POSIX ACLs "+
+		"and file capabilities, or windows file attributes")
+	absolute := flag.Bool("P", false, "do not strip leading '/' from "+
+		"file names")
+	excludeIfPresent := flag.String("exclude-if-present", "", "skip "+
+		"directories that contain a file with one of these comma "+
+		"separated names")
+	excludeCaches := flag.Bool("exclude-caches", false, "skip "+
+		"directories that contain a CACHEDIR.TAG")
+	includeOwn := flag.Bool("include-own-files", false, "archive the "+
+		"keys, token and other files of acdbackup and the local "+
+		"archive being written")
+	throttle := flag.String("throttle", "", "read files at most this "+
+		"many bytes per second, with a K, M, G or T suffix, and lower "+
+		"the scheduling priority")
+	preserveAtime := flag.Bool("preserve-atime", false, "do not change "+
+		"the access times of the files that are read")
+	oneFS := flag.Bool("one-file-system", false, "do not cross file "+
+		"system boundaries")
+	noSync := flag.Bool("no-sync", false, "do not flush extracted files "+
+		"to stable storage")
+	warnChanged := flag.Bool("warn-changed", false, "reread files and "+
+		"warn if they changed during backup")
+	follow := flag.Bool("L", false, "follow symbolic links and archive "+
+		"their targets")
+	fromTar := flag.Bool("from-tar", false, "archive the tar stream read "+
+		"from stdin")
+	base := flag.String("base", "", "record names relative to "+
+		"directory base, which must contain all names")
+	filesFrom := flag.String("files-from", "", "read names to archive "+
+		"from file, - is stdin")
+	maxSize := flag.Int64("max-size", 0, "skip files larger than size "+
+		"bytes, 0 is no limit")
+	deadline := flag.Duration("deadline", 0, "stop the backup after "+
+		"duration and store a partial snapshot, 0 is no limit")
+	watch := flag.Bool("watch", false, "archive and keep watching the "+
+		"paths, uploading changes and storing snapshots until "+
+		"interrupted")
+	watchInterval := flag.Duration("watch-interval",
+		backup.DefaultInterval, "time between -watch snapshots")
+	watchSettle := flag.Duration("watch-settle", backup.DefaultSettle,
+		"quiet time before -watch uploads a changed file")
+	nameFormat := flag.String("name-format", backup.DefaultNameFormat,
+		"time layout of snapshot names, see Go's time.Format")
+	tag := flag.String("tag", "", "comma separated labels to attach to "+
+		"the snapshot, or to filter -T by")
+	compressionStats := flag.Bool("compression-stats", false, "add "+
+		"the original, compressed and encrypted sizes of the uploaded "+
+		"files by type to the backup summary")
+	jsonSummary := flag.Bool("json", false, "print the backup summary "+
+		"as JSON")
 	target := flag.String("f", "-", "archive target is Cloud Drive)")
+	appendTo := flag.Bool("a", false, "append to the local archive -f "+
+		"instead of creating it")
+	split := flag.String("split", "", "split the local archive -f into "+
+		"parts of at most size bytes, e.g. 1G")
+	plainMetadata := flag.Bool("plain-metadata", false, "do not "+
+		"encrypt the local archive -f, for debugging")
+	quotaCheck := flag.String("quota-check", "off", "before a backup, "+
+		"compare the size of the files with the available Cloud "+
+		"Drive storage: off, warn or abort")
+	local := flag.Bool("local", false, "store the file data next to the "+
+		"local archive -f instead of on Cloud Drive")
+	metrics := flag.String("metrics", "", "write metrics of the backup "+
+		"run to file in the Prometheus text format")
+	notifyURL := flag.String("notify-url", "", "post a JSON summary of "+
+		"the backup run to url")
+	notifyTimeout := flag.Duration("notify-timeout", 10*time.Second,
+		"timeout of every -notify-url attempt")
+	notifyRetries := flag.Int("notify-retries", 2, "number of times a "+
+		"failed -notify-url post is retried")
+	retries := flag.Int("retries", 5, "number of times an upload is "+
+		"retried while the Cloud Drive token can not be refreshed, 0 "+
+		"disables retrying")
 	root := flag.String("C", "", "extract path")
+	jobs := flag.Int("j", 4, "number of concurrent downloads on extract")
+	strip := flag.Int("strip", 0, "strip number of leading path elements "+
+		"on extract")
+	resume := flag.Bool("resume", false, "record extract progress and "+
+		"resume an interrupted extract")
 
 	// not tar like
 	debugLevel := flag.Int("d", 0, "debug level: 0 off, 1 trace, 2 loud")
 	debugTarget := flag.String("l", "-", "debug target file name, - is stdout")
+	noSavePassword := flag.Bool("no-save-password", false, "always "+
+		"prompt for the password and never store it on disk")
+	passwordFd := flag.Int("password-fd", -1, "read the password from "+
+		"file descriptor (default $"+shared.PasswordEnv+")")
+	encryptLocalKeys := flag.Bool("encrypt-local-keys", false, "encrypt "+
+		"the local keys with the password")
+	deriveKeys := flag.Bool("derive-keys", false, "derive the keys "+
+		"from the password instead of using local keys")
+	refresh := flag.Bool("refresh", false, "look up remote folders "+
+		"instead of using the cached ones")
+	trashSecrets := flag.Bool("trash-before-reupload", false, "move "+
+		"the remote secrets to the trash instead of overwriting them "+
+		"when uploading new secrets")
+	includeTrash := flag.Bool("include-trash", false, "consider trashed "+
+		"remote nodes, e.g. for recovery")
+	chunked := flag.Bool("chunked", false, "upload with chunked "+
+		"transfer encoding instead of a content length")
+	proxy := flag.String("proxy", "", "proxy URL, e.g. "+
+		"socks5://host:1080 (default $HTTPS_PROXY)")
+	caFile := flag.String("ca-file", "", "PEM file with the CA "+
+		"certificates to trust instead of the system ones")
+	tlsMin := flag.String("tls-min", "1.2", "minimum TLS version, "+
+		"1.2 or 1.3")
+	config := flag.String("config", "", "configuration file (default "+
+		"~/"+shared.RootDirectory+"/"+shared.ConfigFilename+")")
+	home := flag.String("home", "", "directory that holds keys, token "+
+		"and configuration (default $"+shared.HomeEnv+" or ~/"+
+		shared.RootDirectory+")")
 	flag.Parse()
 
 	args := flag.Args()
 
-	var err error
+	shared.SetHome(*home)
+	err := loadConfig(*config)
+	if err != nil {
+		return err
+	}
+	if *deriveKeys && *encryptLocalKeys {
+		return fmt.Errorf("-derive-keys can not be combined with " +
+			"-encrypt-local-keys")
+	}
 	a := acdb{
-		permList: list.New(),
-		target:   *target,
-		verbose:  *verbose,
-		compress: *compress,
-		perms:    *perms,
-		root:     *root,
+		target:           *target,
+		refresh:          *refresh,
+		json:             *jsonSummary,
+		noSavePassword:   *noSavePassword,
+		passwordFd:       *passwordFd,
+		encryptLocalKeys: *encryptLocalKeys,
+		deriveKeys:       *deriveKeys,
+		trashSecrets:     *trashSecrets,
+		includeTrash:     *includeTrash,
+		includeOwn:       *includeOwn,
+		chunked:          *chunked,
+		proxy:            *proxy,
+		caFile:           *caFile,
+		tlsMin:           *tlsMin,
+		verbose:          *verbose || *veryVerbose,
+		veryVerbose:      *veryVerbose,
+		local:            *local,
+		quotaCheck:       *quotaCheck,
+		metrics:          *metrics,
+		notifyURL:        *notifyURL,
+		notifyTimeout:    *notifyTimeout,
+		notifyRetries:    *notifyRetries,
+		opts: backup.Options{
+			Target:           *target,
+			Absolute:         *absolute,
+			ACLs:             *acls,
+			IncludeTrash:     *includeTrash,
+			Retries:          *retries,
+			Compress:         *compress,
+			Level:            *level,
+			BlockSize:        *blockSz,
+			Blocks:           *blocks,
+			CompressTypes:    types,
+			Follow:           *follow,
+			Base:             *base,
+			OneFS:            *oneFS,
+			ExcludeCaches:    *excludeCaches,
+			PreserveAtime:    *preserveAtime,
+			MaxSize:          *maxSize,
+			WarnChanged:      *warnChanged,
+			NameFormat:       *nameFormat,
+			Append:           *appendTo,
+			PlainMetadata:    *plainMetadata,
+			CompressionStats: *compressionStats,
+			Root:             *root,
+			Strip:            *strip,
+			Jobs:             *jobs,
+			Perms:            *perms,
+			StrictPerms:      *strictPerms,
+			NoSync:           *noSync,
+		},
 	}
-	defer func() {
-		goutil.Zero(a.keys.MD[:])
-		goutil.Zero(a.keys.Data[:])
-		goutil.Zero(a.keys.Dedup[:])
-	}()
+	if *excludeIfPresent != "" {
+		a.opts.ExcludeIfPresent = strings.Split(*excludeIfPresent, ",")
+	}
+	if *tag != "" {
+		a.tags = strings.Split(*tag, ",")
+		a.opts.Tags = a.tags
+	}
+	a.opts.Digest, err = shared.ParseAlgorithm(*digest)
+	if err != nil {
+		return fmt.Errorf("invalid digest algorithm: %v", *digest)
+	}
+	if *throttle != "" {
+		a.opts.Throttle, err = backup.ParseSize(*throttle)
+		if err != nil {
+			return err
+		}
+	}
+	if *split != "" {
+		a.opts.Split, err = backup.ParseSize(*split)
+		if err != nil {
+			return err
+		}
+	}
+	defer a.keys.Zero()
+	defer func() { goutil.Zero(a.password) }()
 
 	// debug target
 	if *debugTarget == "-" {
@@ -818,10 +916,105 @@ func _main() error {
 
 	//a.Debugger.Mask(acd.DebugTrace | acd.DebugHTTP | acd.DebugURL |
 	//acd.DebugJSON | debugApp)
+	a.opts.Debugger = a.Debugger
 
 	a.Log(debugApp, "[APP] start of day")
 	defer a.Log(debugApp, "[APP] end of times")
 
+	passwords := *addPassword != "" || *removePassword != "" || *passwd
+	indexing := *index || *find != ""
+	if *login {
+		if *create || *extract || *lst || *lstRemote || *repair ||
+			*untrash || *usage || *exportShares != 0 ||
+			*importShares != "" || passwords || indexing {
+			return fmt.Errorf("-login can not be combined with " +
+				"other operations")
+		}
+		return a.login(*clientID, *clientSecret, *loginAddr)
+	}
+
+	if *whoami {
+		if *create || *extract || *lst || *lstRemote || *repair ||
+			*untrash || *usage || *exportShares != 0 ||
+			*importShares != "" || passwords || indexing {
+			return fmt.Errorf("-whoami can not be combined with " +
+				"other operations")
+		}
+		return a.whoami()
+	}
+
+	if *exportShares != 0 || *importShares != "" {
+		if *create || *extract || *lst || *lstRemote || *repair ||
+			*untrash || *usage || passwords || indexing ||
+			(*exportShares != 0 && *importShares != "") {
+			return fmt.Errorf("-export-shares and -import-shares " +
+				"can not be combined with other operations")
+		}
+		if *importShares != "" {
+			return a.importShares(*importShares)
+		}
+		return a.exportShares(*exportShares, *threshold)
+	}
+
+	if passwords {
+		if *create || *extract || *lst || *lstRemote || *repair ||
+			*untrash || *usage || indexing ||
+			(*addPassword != "" && *removePassword != "") ||
+			(*passwd && (*addPassword != "" ||
+				*removePassword != "")) {
+			return fmt.Errorf("-passwd, -add-password and " +
+				"-remove-password can not be combined with " +
+				"other operations")
+		}
+		if *passwd {
+			return a.changePassword()
+		}
+		if *removePassword != "" {
+			return a.removePassword(*removePassword)
+		}
+		return a.addPassword(*addPassword)
+	}
+
+	if indexing {
+		if *create || *extract || *lst || *lstRemote || *repair ||
+			*untrash || *usage || (*index && *find != "") {
+			return fmt.Errorf("-index and -find can not be " +
+				"combined with other operations")
+		}
+		if *index {
+			return a.index()
+		}
+		return a.find(*find)
+	}
+
+	if *repair {
+		if *create || *extract || *lst || *lstRemote || *untrash ||
+			*usage {
+			return fmt.Errorf("-repair can not be combined with " +
+				"-c, -x, -t, -T, -untrash or -usage")
+		}
+		return a.repair()
+	}
+
+	if *usage {
+		if *create || *extract || *lst || *lstRemote || *untrash {
+			return fmt.Errorf("-usage can not be combined with " +
+				"-c, -x, -t, -T or -untrash")
+		}
+		return a.usage()
+	}
+
+	if *untrash {
+		if *create || *extract || *lst || *lstRemote {
+			return fmt.Errorf("-untrash can not be combined with " +
+				"-c, -x, -t or -T")
+		}
+		if a.target == "-" {
+			return fmt.Errorf("must provide archive metadata name")
+		}
+		return a.untrash(a.target)
+	}
+
 	// default to create
 	if *create == false && *extract == false && *lst == false &&
 		*lstRemote == false {
@@ -831,27 +1024,92 @@ func _main() error {
 	// determine operation
 	switch {
 	case *create && !(*extract || *lst || *lstRemote):
-		a.mode = modeCreate
+		a.create = true
+		switch {
+		case *deadline < 0:
+			return fmt.Errorf("invalid deadline %v", *deadline)
+		case *deadline > 0:
+			a.opts.Deadline = time.Now().Add(*deadline)
+		}
 
-		if len(args) == 0 {
+		if *filesFrom != "" {
+			names, err := readNames(*filesFrom)
+			if err != nil {
+				return err
+			}
+			args = append(args, names...)
+		}
+		a.opts.Paths = args
+
+		if *appendTo && a.target == "-" {
+			return fmt.Errorf("-a requires a local archive -f")
+		}
+		if *split != "" && a.target == "-" {
+			return fmt.Errorf("-split requires a local archive -f")
+		}
+		if *local && a.target == "-" {
+			return fmt.Errorf("-local requires a local archive -f")
+		}
+		switch a.quotaCheck {
+		case "off", "warn", "abort":
+		default:
+			return fmt.Errorf("invalid -quota-check %v", a.quotaCheck)
+		}
+
+		if *fromTar {
+			if *base != "" {
+				return fmt.Errorf("-base can not be used " +
+					"with -from-tar")
+			}
+			a.opts.FromTar = os.Stdin
+		}
+
+		err = a.opts.Validate()
+		if err != nil {
+			return err
+		}
+
+		if len(args) == 0 && a.opts.FromTar == nil {
 			fmt.Printf("acdbackup <-c>|<-x>|<-t>|<-T> [-vzf target] filenames...\n")
 			flag.PrintDefaults()
 			return nil
 		}
 
-		return a.archive(args)
+		if *watch {
+			switch {
+			case *fromTar || a.target != "-" || *deadline != 0:
+				return fmt.Errorf("-watch can not be combined " +
+					"with -from-tar, -f or -deadline")
+			case *watchInterval <= 0 || *watchSettle <= 0:
+				return fmt.Errorf("invalid -watch-interval or " +
+					"-watch-settle")
+			}
+			a.opts.Interval = *watchInterval
+			a.opts.Settle = *watchSettle
+			return a.watch()
+		}
+
+		return a.archive()
 
 	case *extract && !(*create || *lst || *lstRemote):
-		a.mode = modeExtract
-
 		if a.target == "-" {
 			return fmt.Errorf("must provide archive metadata file")
 		}
-		return a.list()
+		err = a.opts.Validate()
+		if err != nil {
+			return err
+		}
+		if *resume {
+			root, err := shared.DefaultRootDirectory()
+			if err != nil {
+				return err
+			}
+			a.opts.ResumeFile = path.Join(root,
+				shared.ResumeFilename)
+		}
+		return a.restore()
 
 	case *lst && !(*create || *extract):
-		a.mode = modeList
-
 		if a.target == "-" {
 			return fmt.Errorf("must provide archive metadata file")
 		}
@@ -867,12 +1125,187 @@ func _main() error {
 	return nil
 }
 
+// archive creates a backup, uploading the metadata unless -f names a local
+// file, and writes the summary to stderr.
+func (a *acdb) archive() (err error) {
+	a.Log(acd.DebugTrace, "[TRC] archive")
+
+	// the run is reported even if it fails before the backup starts
+	var s *backup.Summary
+	if a.metrics != "" || a.notifyURL != "" {
+		start := time.Now()
+		defer func() {
+			a.report(start, s, err)
+		}()
+	}
+
+	if a.local {
+		err = a.offline()
+	} else {
+		err = a.online()
+	}
+	if err != nil {
+		return err
+	}
+	if a.target == "-" {
+		a.opts.Target = ""
+	}
+	err = a.prepareBackup()
+	if err != nil {
+		return err
+	}
+	if a.verbose {
+		a.opts.Progress = a.printArchived
+	}
+	err = a.checkQuota()
+	if err != nil {
+		return err
+	}
+
+	s, err = backup.Backup(a.c, &a.keys, &a.opts)
+	if err == backup.ErrTokenRejected {
+		if filename, e := tokenFilename(); e == nil {
+			err = tokenError(filename, token.ErrRefreshRejected)
+		}
+	}
+	if s == nil {
+		return err
+	}
+	e := s.Write(os.Stderr, a.json)
+	if e != nil {
+		return e
+	}
+
+	return err
+}
+
+// prepareBackup completes the options of -c and -watch once the target is
+// known.
+func (a *acdb) prepareBackup() error {
+	if a.opts.Throttle > 0 {
+		err := lowerPriority()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: could not lower "+
+				"priority: %v\n", err)
+		}
+	}
+	if !a.includeOwn {
+		// never leak the keys, password or token into a snapshot
+		root, err := shared.DefaultRootDirectory()
+		if err != nil {
+			return err
+		}
+		a.opts.Own = []string{root}
+		if a.opts.Target != "" {
+			a.opts.Own = append(a.opts.Own, a.opts.Target,
+				backup.LocalDataDir(a.opts.Target))
+		}
+	}
+
+	return nil
+}
+
+// report writes the metrics of the backup run that started at start and
+// ended with summary s and err to the -metrics file and posts them to
+// -notify-url.  Failing to do so does not fail the run.
+func (a *acdb) report(start time.Time, s *backup.Summary, err error) {
+	duration := time.Since(start)
+	if a.metrics != "" {
+		e := backup.WriteMetricsFile(a.metrics, &backup.Metrics{
+			Start:    start,
+			Duration: duration,
+			Err:      err,
+			Summary:  s,
+		})
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "could not write metrics: %v\n",
+				e)
+		}
+	}
+	if a.notifyURL != "" {
+		host, _ := os.Hostname()
+		n := backup.NewNotification(host, start, duration, s, err)
+		tc, e := a.tlsConfig()
+		if e == nil {
+			e = backup.Notify(a.notifyURL, n, &acd.Options{
+				Proxy: a.proxy,
+				TLS:   tc,
+			}, a.notifyTimeout, a.notifyRetries)
+		}
+		if e != nil {
+			fmt.Fprintf(os.Stderr, "could not notify: %v\n", e)
+		}
+	}
+}
+
+// restore extracts a backup and writes the cloud drive traffic to stderr.
+func (a *acdb) restore() error {
+	a.Log(acd.DebugTrace, "[TRC] restore")
+
+	// self-contained local archives are extracted offline
+	var err error
+	fi, serr := os.Stat(backup.LocalDataDir(a.target))
+	if a.local || (serr == nil && fi.IsDir()) {
+		err = a.offline()
+	} else {
+		err = a.online()
+	}
+	if err != nil {
+		return err
+	}
+
+	a.opts.Progress = printListed
+	err = backup.Restore(a.c, &a.keys, &a.opts)
+	if err != nil && err != backup.ErrSkipped {
+		return err
+	}
+	st := a.c.Stats()
+	e := backup.WriteStats(os.Stderr, &st, a.json)
+	if e != nil {
+		return e
+	}
+
+	return err
+}
+
+// list lists the contents of a backup, which only requires going online
+// when its metadata is not a local file or the keys are derived.
+func (a *acdb) list() error {
+	a.Log(acd.DebugTrace, "[TRC] list")
+
+	_, err := os.Stat(a.target)
+	if os.IsNotExist(err) {
+		// the archive may have been split
+		_, err = os.Stat(a.target + ".000")
+	}
+	if err == nil && !a.deriveKeys {
+		// local archives are encrypted with the metadata key
+		err = a.localKeys()
+	} else {
+		err = a.online()
+	}
+	if err != nil {
+		return err
+	}
+
+	a.opts.Progress = printListed
+	return backup.List(a.c, &a.keys, &a.opts)
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	err := _main()
-	if err != nil {
+	switch {
+	case err == backup.ErrSkipped:
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitSkipped)
+	case err == backup.ErrDeadline:
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(exitDeadline)
+	case err != nil:
 		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+		os.Exit(exitFatal)
 	}
+	os.Exit(exitOK)
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// folderCache is the on disk cache of the data and metadata folder ids.
+// It is keyed by the root folder id which is unique per account.
+type folderCache map[string]cachedFolders
+
+type cachedFolders struct {
+	Data     string `json:"data"`
+	Metadata string `json:"metadata"`
+}
+
+func cacheFilename() (string, error) {
+	root, err := shared.DefaultRootDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(root, shared.CacheFilename), nil
+}
+
+// loadCache returns the folder cache.  A missing or unreadable cache is
+// treated as empty since it can always be rebuilt.
+func loadCache() folderCache {
+	fc := make(folderCache)
+
+	filename, err := cacheFilename()
+	if err != nil {
+		return fc
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return fc
+	}
+	defer func() { _ = f.Close() }()
+
+	err = json.NewDecoder(f).Decode(&fc)
+	if err != nil {
+		return make(folderCache)
+	}
+
+	return fc
+}
+
+func (fc folderCache) save() error {
+	filename, err := cacheFilename()
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(fc)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, j, 0600)
+}
+
+// cachedFolders sets the data and metadata folder ids from the cache.  It
+// returns false if the cache has no entry for this account.
+func (a *acdb) cachedFolders() bool {
+	cf, ok := loadCache()[a.c.GetRoot()]
+	if !ok || cf.Data == "" || cf.Metadata == "" {
+		return false
+	}
+	a.dataID = cf.Data
+	a.metadataID = cf.Metadata
+
+	return true
+}
+
+// cacheFolders records the data and metadata folder ids in the cache.
+func (a *acdb) cacheFolders() error {
+	fc := loadCache()
+	fc[a.c.GetRoot()] = cachedFolders{
+		Data:     a.dataID,
+		Metadata: a.metadataID,
+	}
+
+	return fc.save()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// loadConfig sets the defaults of all flags that were not provided on the
+// command line from configuration file filename.  The configuration file is
+// a JSON object that maps flag names to values, e.g. {"z": true, "v": true}.
+// Array values are passed to the flag as a comma separated list and object
+// values as comma separated key=value pairs.
+// If filename is empty the default configuration file is used if it exists.
+func loadConfig(filename string) error {
+	explicit := filename != ""
+	if !explicit {
+		var err error
+		filename, err = shared.DefaultConfigFilename()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil
+		}
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	// numbers are passed verbatim, as float64 1048576 would become
+	// 1.048576e+06
+	var config map[string]interface{}
+	d := json.NewDecoder(f)
+	d.UseNumber()
+	err = d.Decode(&config)
+	if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	// command line wins
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for k, v := range config {
+		if flag.Lookup(k) == nil || k == "config" || k == "home" {
+			return fmt.Errorf("%v: invalid option %v", filename, k)
+		}
+		if set[k] {
+			continue
+		}
+		err = flag.Set(k, configValue(v))
+		if err != nil {
+			return fmt.Errorf("%v: option %v: %v", filename, k, err)
+		}
+	}
+
+	return nil
+}
+
+// configValue returns configuration value v as a flag value.
+func configValue(v interface{}) string {
+	var s []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			s = append(s, configValue(e))
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			s = append(s, k+"="+configValue(e))
+		}
+		sort.Strings(s)
+	default:
+		return fmt.Sprint(v)
+	}
+	return strings.Join(s, ",")
+}
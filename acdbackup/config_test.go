@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// withFlags makes fs the command line flags for the duration of t.
+func withFlags(t *testing.T, fs *flag.FlagSet) {
+	old := flag.CommandLine
+	flag.CommandLine = fs
+	t.Cleanup(func() { flag.CommandLine = old })
+}
+
+func TestConfigValue(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{`1048576`, "1048576"},
+		{`1000000`, "1000000"},
+		{`0.5`, "0.5"},
+		{`true`, "true"},
+		{`"text"`, "text"},
+		{`[".nobackup", "CACHEDIR.TAG"]`, ".nobackup,CACHEDIR.TAG"},
+		{`{"b": 2, "a": "x"}`, "a=x,b=2"},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "config.json")
+		err := ioutil.WriteFile(filename, []byte(`{"v": `+tt.config+
+			`}`), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		v := fs.String("v", "", "")
+		withFlags(t, fs)
+		err = loadConfig(filename)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.config, err)
+		}
+		if *v != tt.want {
+			t.Fatalf("%v: got %q, want %q", tt.config, *v, tt.want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(filename, []byte(`{
+		"block-size": 1048576,
+		"max-size": 1000000,
+		"exclude-if-present": [".nobackup", "CACHEDIR.TAG"],
+		"z": true,
+		"j": 2
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	blockSize := fs.Int("block-size", 0, "")
+	maxSize := fs.Int64("max-size", 0, "")
+	exclude := fs.String("exclude-if-present", "", "")
+	z := fs.Bool("z", false, "")
+	jobs := fs.Int("j", 4, "")
+	withFlags(t, fs)
+
+	// the command line wins
+	err = fs.Parse([]string{"-j", "8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *blockSize != 1048576 || *maxSize != 1000000 ||
+		*exclude != ".nobackup,CACHEDIR.TAG" || !*z || *jobs != 8 {
+		t.Fatalf("block size %v, max size %v, exclude %q, z %v, j %v",
+			*blockSize, *maxSize, *exclude, *z, *jobs)
+	}
+
+	// unknown options are rejected
+	err = ioutil.WriteFile(filename, []byte(`{"unknown": 1}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadConfig(filename) == nil {
+		t.Fatal("unknown option accepted")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/backup"
+)
+
+// checkDedupKey compares the fingerprint of the local dedup key with the
+// one recorded on cloud drive by earlier backups and warns when they
+// differ.  A different dedup key yields different digests for identical
+// content, which silently stops deduplication against existing data.  A
+// backup records the fingerprint when there is none yet, other operations
+// leave cloud drive alone.
+func (a *acdb) checkDedupKey() error {
+	a.Log(acd.DebugTrace, "[TRC] checkDedupKey")
+
+	fp := a.keys.DedupFingerprint()
+	local := []byte(hex.EncodeToString(fp[:]))
+
+	asset, err := a.c.GetMetadataFS(backup.MetadataName + "/" +
+		backup.DedupName)
+	if err == acd.ErrNotFound {
+		if !a.create {
+			return nil
+		}
+		_, err = a.c.UploadJSON(a.metadataID, backup.DedupName, local)
+		if err != nil {
+			return fmt.Errorf("could not record dedup key "+
+				"fingerprint: %v", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	remote, err := a.c.DownloadJSON(asset.ID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(bytes.TrimSpace(remote), local) {
+		fmt.Fprintf(os.Stderr, "WARNING: the local dedup key differs "+
+			"from the one used by earlier backups.  New backups "+
+			"will not deduplicate against existing data.\n")
+	}
+
+	return nil
+}
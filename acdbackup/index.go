@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/backup"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+func indexFilename() (string, error) {
+	root, err := shared.DefaultRootDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(root, shared.IndexFilename), nil
+}
+
+// index adds the snapshots that are not indexed yet to the local index and
+// drops the ones that are gone, see -index.
+func (a *acdb) index() error {
+	a.Log(acd.DebugTrace, "[TRC] index")
+
+	err := a.online()
+	if err != nil {
+		return err
+	}
+	filename, err := indexFilename()
+	if err != nil {
+		return err
+	}
+	ix, err := backup.LoadIndex(filename, &a.keys.MD)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+	if ix == nil || ix.Metadata != a.metadataID {
+		// another account or a recreated folder
+		ix = backup.NewIndex(a.metadataID)
+	}
+
+	children, err := a.children(a.metadataID, "")
+	if err != nil {
+		return err
+	}
+	var snapshots []acd.Asset
+	for _, v := range children {
+		if v.Kind != acd.AssetFile || v.Status != acd.StatusAvailable ||
+			backup.IsSecretsName(v.Name) ||
+			v.Name == backup.DedupName {
+			continue
+		}
+		snapshots = append(snapshots, v)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].ModifiedDate.Before(snapshots[j].ModifiedDate)
+	})
+
+	names := make([]string, 0, len(snapshots))
+	for _, v := range snapshots {
+		names = append(names, v.Name)
+	}
+	ix.Retain(names)
+
+	added := 0
+	for _, v := range snapshots {
+		if ix.Has(v.Name) {
+			continue
+		}
+		md, err := a.c.DownloadJSON(v.ID)
+		if err != nil {
+			return err
+		}
+		mdd, err := backup.DecryptMetadata(md, &a.keys.MD)
+		if err == nil {
+			err = ix.Add(v.Name, mdd)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not index %v: %v\n",
+				v.Name, err)
+			continue
+		}
+		added++
+		if a.verbose {
+			fmt.Printf("%v\n", v.Name)
+		}
+	}
+
+	err = ix.Save(filename, &a.keys.MD)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("indexed %v new snapshots, %v snapshots with %v files\n",
+		added, len(ix.Snapshots), len(ix.Files))
+
+	return nil
+}
+
+// find prints the versions of the files in the local index whose path or
+// base name matches pattern, see -find.
+func (a *acdb) find(pattern string) error {
+	a.Log(acd.DebugTrace, "[TRC] find")
+
+	var err error
+	if a.deriveKeys {
+		err = a.online()
+	} else {
+		err = a.localKeys()
+	}
+	if err != nil {
+		return err
+	}
+	filename, err := indexFilename()
+	if err != nil {
+		return err
+	}
+	ix, err := backup.LoadIndex(filename, &a.keys.MD)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no index, create it with -index")
+	} else if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	matches, err := ix.Find(pattern)
+	if err != nil {
+		return err
+	}
+	for _, v := range matches {
+		fmt.Printf("%v  %13v  %v  %x  %v\n",
+			v.Snapshot,
+			v.Size,
+			v.Modified.Format("Mon 02 Jan 2006 15:04:05"),
+			v.Digest[:6],
+			v.Name)
+	}
+
+	return nil
+}
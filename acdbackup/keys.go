@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/shared"
+	"github.com/marcopeereboom/goutil"
+)
+
+// loadKeys loads the local keys from filename and decrypts them if they are
+// encrypted.  With -encrypt-local-keys new keys are only created in memory;
+// they are stored, encrypted, by encryptKeys once online.
+func (a *acdb) loadKeys(filename string) error {
+	a.Log(acd.DebugTrace, "[TRC] loadKeys")
+
+	a.keysFilename = filename
+	_, err := os.Stat(filename)
+	if os.IsNotExist(err) && a.encryptLocalKeys {
+		k, err := shared.NewKeys()
+		if err != nil {
+			return err
+		}
+		a.keys = *k
+		k.Zero()
+		a.keysPlaintext = true
+		return nil
+	}
+
+	err = shared.LoadKeys(filename, &a.keys)
+	if err == nil {
+		a.keysPlaintext = true
+		return nil
+	}
+	if err != shared.ErrKeysEncrypted {
+		return err
+	}
+
+	for {
+		p, err := a.suppliedPassword()
+		if err != nil {
+			return err
+		}
+		supplied := p != nil
+		if p == nil && !a.noSavePassword {
+			p, err = shared.ReadPassword()
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			supplied = err == nil
+		}
+		if p == nil {
+			fmt.Printf("The local keys are encrypted.  Please " +
+				"enter the password to decrypt them.\n")
+			p, err = shared.PromptPassword(false)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = shared.LoadEncryptedKeys(filename, p, &a.keys)
+		if err == nil {
+			a.rememberPassword(p)
+		}
+		goutil.Zero(p)
+		if err == nil {
+			return nil
+		}
+		if supplied {
+			// can't ask again
+			return fmt.Errorf("could not decrypt local keys: %v",
+				err)
+		}
+		fmt.Printf("invalid password: %v\n", err)
+	}
+}
+
+// pullKeys replaces the local keys with the keys in the remote secrets blob,
+// which password p opens, after confirmation.  The remote secrets are
+// authoritative: the keys may have been changed on another machine and stale
+// local keys break deduplication and restores.  The old keys file is kept
+// with an .old suffix.
+func (a *acdb) pullKeys(p, blob []byte) error {
+	a.Log(acd.DebugTrace, "[TRC] pullKeys")
+
+	fmt.Printf("The local keys in %v differ from the remote secrets, "+
+		"e.g. because the keys were changed on another machine.\n",
+		a.keysFilename)
+	if !confirm("Replace the local keys with the remote keys?") {
+		return errKeysDiffer
+	}
+
+	kk, err := shared.KeysDecrypt(p, shared.KeysN, shared.KeysR,
+		shared.KeysP, blob)
+	if err != nil {
+		return err
+	}
+	defer kk.Zero()
+
+	// new keys that are encrypted once online are not stored yet
+	_, err = os.Stat(a.keysFilename)
+	if err == nil {
+		old := a.keysFilename + ".old"
+		err = os.Rename(a.keysFilename, old)
+		if err != nil {
+			return err
+		}
+		if a.keysPlaintext {
+			err = shared.SaveKeys(a.keysFilename, kk)
+		} else {
+			err = shared.SaveEncryptedKeys(a.keysFilename, p, kk)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("local keys replaced, the old keys are in %v\n",
+			old)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	a.keys = *kk
+	a.rememberPassword(p)
+
+	return nil
+}
+
+// encryptKeys stores the local keys encrypted with the password that was
+// verified against the remote secrets.  This way a mistyped password can
+// never lock the local keys.
+func (a *acdb) encryptKeys() error {
+	a.Log(acd.DebugTrace, "[TRC] encryptKeys")
+
+	if a.password == nil {
+		return fmt.Errorf("no verified password to encrypt the " +
+			"local keys with")
+	}
+	err := shared.SaveEncryptedKeys(a.keysFilename, a.password, &a.keys)
+	if err != nil {
+		return fmt.Errorf("could not encrypt local keys: %v", err)
+	}
+	a.keysPlaintext = false
+	fmt.Printf("local keys are encrypted\n")
+
+	return nil
+}
+
+// deriveNewKeys derives new keys from password p and a new salt and returns
+// the secrets blob that holds the salt.
+func (a *acdb) deriveNewKeys(p []byte) ([]byte, error) {
+	a.Log(acd.DebugTrace, "[TRC] deriveNewKeys")
+
+	salt, err := shared.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	k, err := shared.DeriveKeys(p, salt)
+	if err != nil {
+		return nil, err
+	}
+	a.keys = *k
+	k.Zero()
+
+	return shared.EncodeDerived(salt, &a.keys), nil
+}
+
+// deriveSecrets derives the keys from password p and the salt in secrets
+// blob.
+func (a *acdb) deriveSecrets(p, blob []byte) error {
+	a.Log(acd.DebugTrace, "[TRC] deriveSecrets")
+
+	k, err := shared.DecodeDerived(p, blob)
+	if err != nil {
+		return err
+	}
+	a.keys = *k
+	k.Zero()
+	a.rememberPassword(p)
+
+	return nil
+}
+
+// rememberPassword records p as the password that unlocked the keys.
+func (a *acdb) rememberPassword(p []byte) {
+	goutil.Zero(a.password)
+	a.password = append([]byte(nil), p...)
+}
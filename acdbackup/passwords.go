@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/backup"
+	"github.com/marcopeereboom/acdb/shared"
+	"github.com/marcopeereboom/goutil"
+)
+
+// validPasswordName returns an error if name can not name additional
+// secrets.
+func validPasswordName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid password name %q", name)
+	}
+	return nil
+}
+
+// downloadExtraSecrets returns the additional secrets that seal the keys
+// with other passwords.  An empty, non-nil, slice is returned if there are
+// none.
+func (a *acdb) downloadExtraSecrets() ([][]byte, error) {
+	a.Log(acd.DebugTrace, "[TRC] downloadExtraSecrets")
+
+	assets, err := a.children(a.metadataID, "?filters=kind:"+
+		acd.AssetFile)
+	if err != nil {
+		return nil, err
+	}
+	blobs := [][]byte{}
+	for _, v := range assets {
+		if v.Name == backup.SecretsName ||
+			!backup.IsSecretsName(v.Name) ||
+			v.Status != acd.StatusAvailable {
+			continue
+		}
+		blob, err := a.c.DownloadJSON(v.ID)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
+
+// addPassword seals the keys with a new password as the additional secrets
+// called name so that the new password unlocks the same backups.  The keys
+// are verified against the remote secrets first.
+func (a *acdb) addPassword(name string) error {
+	a.Log(acd.DebugTrace, "[TRC] addPassword")
+
+	err := validPasswordName(name)
+	if err != nil {
+		return err
+	}
+	if a.deriveKeys {
+		return fmt.Errorf("derived keys can only be opened with the " +
+			"password they are derived from")
+	}
+	err = a.online()
+	if err != nil {
+		return err
+	}
+
+	filename := backup.ExtraSecretsName(name)
+	exists, _, err := a.c.NodeExists(a.metadataID, filename)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("password %v exists already", name)
+	}
+
+	fmt.Printf("Please enter the new password %v.\n", name)
+	p, err := shared.PromptPassword(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		goutil.Zero(p)
+	}()
+	blob, err := a.keys.Encrypt(p, shared.KeysN, shared.KeysR,
+		shared.KeysP)
+	if err != nil {
+		return err
+	}
+	_, err = a.c.UploadJSON(a.metadataID, filename, blob)
+	if err != nil {
+		return fmt.Errorf("could not upload %v: %v", filename, err)
+	}
+	fmt.Printf("password %v added\n", name)
+
+	return nil
+}
+
+// removePassword moves the additional secrets called name to the trash so
+// that their password no longer unlocks the keys.  The password the secrets
+// were first uploaded with can not be removed.
+func (a *acdb) removePassword(name string) error {
+	a.Log(acd.DebugTrace, "[TRC] removePassword")
+
+	err := validPasswordName(name)
+	if err != nil {
+		return err
+	}
+	err = a.online()
+	if err != nil {
+		return err
+	}
+
+	exists, id, err := a.c.NodeExists(a.metadataID,
+		backup.ExtraSecretsName(name))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("password %v does not exist", name)
+	}
+	_, err = a.c.TrashJSON(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("password %v removed\n", name)
+
+	return nil
+}
+
+// changePassword seals the keys with a new password and replaces the remote
+// secrets.  The current password is asked for and must open the secrets.
+// A saved password and encrypted local keys are updated as well.
+// Additional passwords are not affected.
+func (a *acdb) changePassword() error {
+	a.Log(acd.DebugTrace, "[TRC] changePassword")
+
+	if a.deriveKeys {
+		return fmt.Errorf("derived keys can not be sealed with " +
+			"another password")
+	}
+	err := a.online()
+	if err != nil {
+		return err
+	}
+
+	exists, id, err := a.c.NodeExists(a.metadataID, backup.SecretsName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("remote secrets not found")
+	}
+	blob, err := a.c.DownloadJSON(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Please enter the current password.\n")
+	p, err := shared.PromptPassword(false)
+	if err != nil {
+		return err
+	}
+	err = a.matchSecrets(p, blob)
+	goutil.Zero(p)
+	if err != nil {
+		return fmt.Errorf("current password: %v", err)
+	}
+
+	fmt.Printf("Please enter the new password.  Loss of this password " +
+		"is unrecoverable!\n")
+	p, err = shared.PromptPassword(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		goutil.Zero(p)
+	}()
+	blob, err = a.keys.Encrypt(p, shared.KeysN, shared.KeysR,
+		shared.KeysP)
+	if err != nil {
+		return err
+	}
+	err = a.storeSecrets(true, id, blob)
+	if err != nil {
+		return err
+	}
+	a.rememberPassword(p)
+
+	// only replace a saved password
+	filename, err := shared.DefaultPasswordFilename()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); err == nil {
+		err = shared.WritePassword(p)
+		if err != nil {
+			return fmt.Errorf("could not update password file: %v",
+				err)
+		}
+	}
+	if !a.keysPlaintext {
+		err = a.encryptKeys()
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("password changed\n")
+
+	return nil
+}
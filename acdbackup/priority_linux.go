@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+// throttleNice is the scheduling priority of a throttled backup, see nice(1).
+const throttleNice = 10
+
+// lowerPriority lowers the scheduling priority of the process so that a
+// throttled backup yields to interactive use.  On linux the priority belongs
+// to a thread rather than to the process, so every thread of the process is
+// lowered.  Threads started later inherit the priority of the thread that
+// starts them, hence the threads are listed again until none was missed.
+func lowerPriority() error {
+	for {
+		lowered, err := lowerThreads()
+		if err != nil || !lowered {
+			return err
+		}
+	}
+}
+
+// lowerThreads lowers the priority of the threads in /proc/self/task that do
+// not have it yet and returns whether there were any.
+func lowerThreads() (bool, error) {
+	fis, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return false, err
+	}
+	lowered := false
+	for _, v := range fis {
+		tid, err := strconv.Atoi(v.Name())
+		if err != nil {
+			continue
+		}
+		prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+		if err == syscall.ESRCH {
+			// exited
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		// the system call returns 20 - nice on linux
+		if 20-prio >= throttleNice {
+			continue
+		}
+		err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, throttleNice)
+		if err == syscall.ESRCH {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		lowered = true
+	}
+	return lowered, nil
+}
@@ -0,0 +1,24 @@
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd netbsd openbsd solaris
+
+package main
+
+import (
+	"syscall"
+)
+
+// throttleNice is the scheduling priority of a throttled backup, see nice(1).
+const throttleNice = 10
+
+// lowerPriority lowers the scheduling priority of the process so that a
+// throttled backup yields to interactive use.
+func lowerPriority() error {
+	prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+	if err != nil {
+		return err
+	}
+	if prio >= throttleNice {
+		return nil
+	}
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, throttleNice)
+}
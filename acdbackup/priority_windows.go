@@ -0,0 +1,7 @@
+package main
+
+// lowerPriority does nothing since the priority class of the process can
+// not be changed without additional dependencies on windows.
+func lowerPriority() error {
+	return nil
+}
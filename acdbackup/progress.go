@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/marcopeereboom/acdb/backup"
+)
+
+// printArchived prints an archived entry for -v and -vv.  Skipped entries
+// are already reported by the backup engine.
+func (a *acdb) printArchived(ev backup.ProgressEvent) {
+	var ds string
+	switch ev.Status {
+	case backup.StatusSkip:
+		return
+	case backup.StatusNew:
+		ds = " new "
+	case backup.StatusDedup:
+		ds = " deduped "
+	}
+	if ev.Digest != "" {
+		ds += "=> " + ev.Digest
+	}
+	if a.veryVerbose && ev.Status == backup.StatusNew {
+		ds += payloadStats(ev)
+	}
+	fmt.Printf("%v %15v %v%v\n", ev.Mode, ev.Size, ev.Name, ds)
+}
+
+// printListed prints an entry that was listed or extracted.
+func printListed(ev backup.ProgressEvent) {
+	fmt.Printf("%v %15v %v\n", ev.Mode, ev.Size, ev.Name)
+}
+
+// payloadStats describes how the entry of ev was stored.
+func payloadStats(ev backup.ProgressEvent) string {
+	comp := "stored"
+	if ev.Compressed {
+		comp = "gzip"
+	}
+	ratio := 100.0
+	if ev.Size != 0 {
+		ratio = float64(ev.Payload) * 100 / float64(ev.Size)
+	}
+
+	return fmt.Sprintf(" (%v, payload %v bytes, %.1f%%)", comp, ev.Payload,
+		ratio)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/backup"
+)
+
+// children returns all children of id that match filter, following
+// pagination.
+func (a *acdb) children(id, filter string) ([]acd.Asset, error) {
+	var (
+		assets []acd.Asset
+		token  string
+	)
+	for {
+		f := filter
+		if token != "" {
+			if f == "" {
+				f = "?"
+			} else {
+				f += "&"
+			}
+			f += "startToken=" + token
+		}
+		children, err := a.c.GetChildrenJSON(id, f)
+		if err != nil {
+			return nil, err
+		}
+		assets = append(assets, children.Data...)
+
+		if children.NextToken == "" {
+			return assets, nil
+		}
+		token = children.NextToken
+	}
+}
+
+// stdin is shared by all prompts so that no buffered input is lost.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm asks question and returns true if the answer is yes.
+func confirm(question string) bool {
+	fmt.Printf("%v [y/N] ", question)
+	answer, err := stdin.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+// repair reports and, after confirmation, fixes problems with the remote
+// folder structure: missing and duplicate data and metadata folders and
+// missing or duplicate secrets.
+func (a *acdb) repair() error {
+	a.Log(acd.DebugTrace, "[TRC] repair")
+
+	err := a.connect()
+	if err != nil {
+		return err
+	}
+
+	folders, err := a.children("", "?filters=kind:"+acd.AssetFolder)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{backup.DataName, backup.MetadataName} {
+		var found []acd.Asset
+		for _, v := range folders {
+			if v.Name == name && v.Status == acd.StatusAvailable {
+				found = append(found, v)
+			}
+		}
+
+		var keep *acd.Asset
+		switch len(found) {
+		case 0:
+			fmt.Printf("%v folder is missing\n", name)
+			if !confirm("Create " + name + " folder?") {
+				continue
+			}
+			keep, err = a.c.MkdirJSON(a.c.GetRoot(), name)
+			if err != nil {
+				return err
+			}
+
+		case 1:
+			fmt.Printf("%v folder: ok\n", name)
+			keep = &found[0]
+
+		default:
+			// keep the oldest, it is the one that was used the longest
+			sort.Slice(found, func(i, j int) bool {
+				return found[i].CreatedDate.Before(
+					found[j].CreatedDate)
+			})
+			keep = &found[0]
+			fmt.Printf("%v folder: %v duplicates\n", name, len(found))
+			for _, v := range found {
+				fmt.Printf("  %v created %v\n", v.ID,
+					v.CreatedDate.Format("Mon 02 Jan 2006 15:04:05"))
+			}
+			if !confirm("Move all content into " + keep.ID +
+				" and trash the duplicates?") {
+				continue
+			}
+			for _, v := range found[1:] {
+				err = a.consolidate(keep.ID, v.ID,
+					name == backup.DataName)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		switch name {
+		case backup.DataName:
+			a.dataID = keep.ID
+		case backup.MetadataName:
+			a.metadataID = keep.ID
+		}
+	}
+
+	if a.dataID == "" || a.metadataID == "" {
+		return fmt.Errorf("remote folder structure not repaired")
+	}
+	err = a.cacheFolders()
+	if err != nil {
+		return err
+	}
+
+	// secrets
+	secrets, err := a.children(a.metadataID,
+		"?filters=name:"+backup.SecretsName)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, v := range secrets {
+		if v.Status == acd.StatusAvailable {
+			count++
+		}
+	}
+	switch count {
+	case 0:
+		fmt.Printf("%v: missing, they will be uploaded on the next run\n",
+			backup.SecretsName)
+	case 1:
+		fmt.Printf("%v: ok\n", backup.SecretsName)
+	default:
+		fmt.Printf("%v: %v duplicates, trash all but the one that "+
+			"matches the local keys\n", backup.SecretsName, count)
+	}
+
+	return nil
+}
+
+// consolidate moves all children of folder dup into folder keep and trashes
+// dup once it is empty.  When dedup is set, children that already exist in
+// keep are identical by name and are trashed instead.
+func (a *acdb) consolidate(keep, dup string, dedup bool) error {
+	a.Log(acd.DebugTrace, "[TRC] consolidate %v %v", keep, dup)
+
+	children, err := a.children(dup, "")
+	if err != nil {
+		return err
+	}
+
+	left := 0
+	for _, v := range children {
+		if v.Status != acd.StatusAvailable {
+			continue
+		}
+		_, err = a.c.MoveJSON(v.ID, dup, keep)
+		if err == nil {
+			continue
+		}
+		if e, ok := acd.IsCombinedError(err); !ok ||
+			e.StatusCode != http.StatusConflict {
+			return err
+		}
+
+		// name exists in keep
+		if !dedup {
+			fmt.Printf("  %v: exists in %v, leaving it in %v\n",
+				v.Name, keep, dup)
+			left++
+			continue
+		}
+		_, err = a.c.TrashJSON(v.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if left != 0 {
+		fmt.Printf("  %v: not empty, not trashed\n", dup)
+		return nil
+	}
+	_, err = a.c.TrashJSON(dup)
+	return err
+}
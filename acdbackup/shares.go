@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/shared"
+	"github.com/marcopeereboom/goutil"
+)
+
+// exportShares splits the keys into n shares, threshold of which restore
+// them, and prints them one per line.  The keys are verified against the
+// remote secrets first so that only keys that work are split.
+func (a *acdb) exportShares(n, threshold int) error {
+	a.Log(acd.DebugTrace, "[TRC] exportShares")
+
+	if a.deriveKeys {
+		return fmt.Errorf("derived keys are restored with the " +
+			"password, not with shares")
+	}
+	err := a.online()
+	if err != nil {
+		return err
+	}
+
+	shares, err := shared.SplitKeys(&a.keys, n, threshold)
+	if err != nil {
+		return err
+	}
+	for i, v := range shares {
+		fmt.Printf("# acdb key share %v of %v, %v required\n%x\n",
+			i+1, n, threshold, v)
+		goutil.Zero(v)
+	}
+
+	return nil
+}
+
+// importShares combines the shares in filename, one per line, into the
+// local keys.  The keys file must not exist.  The restored keys are
+// verified against the remote secrets.
+func (a *acdb) importShares(filename string) error {
+	a.Log(acd.DebugTrace, "[TRC] importShares")
+
+	lines, err := readNames(filename)
+	if err != nil {
+		return err
+	}
+	shares := make([][]byte, 0, len(lines))
+	defer func() {
+		for _, v := range shares {
+			goutil.Zero(v)
+		}
+	}()
+	for _, v := range lines {
+		s, err := hex.DecodeString(v)
+		if err != nil {
+			return fmt.Errorf("invalid share: %v", err)
+		}
+		shares = append(shares, s)
+	}
+
+	k, err := shared.CombineKeys(shares)
+	if err != nil {
+		return err
+	}
+	defer k.Zero()
+	keysFilename, err := shared.DefaultKeysFilename()
+	if err != nil {
+		return err
+	}
+	err = shared.SaveKeys(keysFilename, k)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("keys restored to %v\n", keysFilename)
+
+	return a.online()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/acd/token"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// tokenError explains how to fix err if it is a problem with the token in
+// filename.
+func tokenError(filename string, err error) error {
+	switch err {
+	case token.ErrFileNotFound:
+		return fmt.Errorf("%v: no Cloud Drive token, log in at %v "+
+			"and save the token it shows as this file with "+
+			"permissions 0600", filename, token.ServerURL)
+	case token.ErrTokenMalformed:
+		return fmt.Errorf("%v: the Cloud Drive token can not be "+
+			"used, log in at %v again and replace this file with "+
+			"the token it shows", filename, token.ServerURL)
+	case token.ErrRefreshRejected:
+		return fmt.Errorf("%v: the Cloud Drive token was rejected "+
+			"when refreshing it, it may have been revoked; log in "+
+			"at %v again and replace this file with the token it "+
+			"shows", filename, token.ServerURL)
+	case token.ErrRefreshUnavailable:
+		return fmt.Errorf("%v: the Cloud Drive token could not be "+
+			"refreshed, the refresh service is unavailable; try "+
+			"again later", filename)
+	case token.ErrOpenFile:
+		return fmt.Errorf("%v: could not read the Cloud Drive token, "+
+			"check the permissions of this file", filename)
+	}
+
+	return fmt.Errorf("%v: %v", filename, err)
+}
+
+// login obtains a token with the Login with Amazon flow and saves it, see
+// -login.
+func (a *acdb) login(clientID, clientSecret, listen string) error {
+	a.Log(acd.DebugTrace, "[TRC] login")
+
+	filename, err := tokenFilename()
+	if err != nil {
+		return err
+	}
+	tc, err := a.tlsConfig()
+	if err != nil {
+		return err
+	}
+	client, err := acd.NewHTTPClient(&acd.Options{Proxy: a.proxy, TLS: tc})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err = token.Login(ctx, filename, &token.LoginOptions{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Listen:       listen,
+		Open:         openBrowser,
+		Client:       client,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("token saved in %v\n", filename)
+
+	return nil
+}
+
+// tokenFilename returns the name of the token file.
+func tokenFilename() (string, error) {
+	keysFilename, err := shared.DefaultKeysFilename()
+	if err != nil {
+		return "", err
+	}
+	rootDir := path.Dir(keysFilename)
+	err = os.MkdirAll(rootDir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(rootDir, shared.TokenFilename), nil
+}
+
+// openBrowser shows url and tries to open it in a browser.
+func openBrowser(url string) error {
+	fmt.Printf("log in to Amazon at:\n\n\t%v\n\n", url)
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler",
+			url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if cmd.Start() == nil {
+		// do not leave a zombie behind
+		go func() { _ = cmd.Wait() }()
+	}
+
+	return nil
+}
+
+// account is what -whoami shows.
+type account struct {
+	Expiry time.Time        `json:"expiry"` // of the access token
+	Info   *acd.AccountInfo `json:"info"`
+	Quota  *acd.Quota       `json:"quota"`
+}
+
+// whoami checks the token, refreshing it if needed, and shows the account
+// it is for.
+func (a *acdb) whoami() error {
+	a.Log(acd.DebugTrace, "[TRC] whoami")
+
+	c, err := a.newClient()
+	if err != nil {
+		return err
+	}
+	t, err := c.Token()
+	if err != nil {
+		filename, _ := tokenFilename()
+		return tokenError(filename, err)
+	}
+	ac := account{Expiry: t.Expiry}
+	ac.Info, err = c.GetAccountInfo()
+	if err != nil {
+		return err
+	}
+	ac.Quota, err = c.GetQuota()
+	if err != nil {
+		return err
+	}
+
+	if a.json {
+		return json.NewEncoder(os.Stdout).Encode(ac)
+	}
+	fmt.Printf("token:     valid until %v\n"+
+		"status:    %v\n"+
+		"quota:     %v bytes\n"+
+		"available: %v bytes (as of %v)\n",
+		ac.Expiry.Local().Format(time.RFC1123),
+		ac.Info.Status,
+		ac.Quota.Quota,
+		ac.Quota.Available, ac.Quota.LastCalculated.Local().Format(
+			time.RFC1123))
+
+	return nil
+}
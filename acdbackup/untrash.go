@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/marcopeereboom/acdb/acd"
+)
+
+// untrash restores the trashed metadata called name.
+func (a *acdb) untrash(name string) error {
+	a.Log(acd.DebugTrace, "[TRC] untrash %v", name)
+
+	err := a.online()
+	if err != nil {
+		return err
+	}
+
+	nodes, err := a.children(a.metadataID, "?filters=name:"+
+		acd.FilterValue(name))
+	if err != nil {
+		return err
+	}
+
+	var trashed *acd.Asset
+	for k, v := range nodes {
+		switch v.Status {
+		case acd.StatusAvailable:
+			return fmt.Errorf("%v: not in trash", name)
+		case acd.StatusTrash:
+			// most recently modified is most likely the one
+			if trashed == nil ||
+				v.ModifiedDate.After(trashed.ModifiedDate) {
+				trashed = &nodes[k]
+			}
+		}
+	}
+	if trashed == nil {
+		return fmt.Errorf("%v: not found in trash", name)
+	}
+
+	_, err = a.c.RestoreJSON(trashed.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored: %v\n", name)
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/backup"
+	"github.com/marcopeereboom/acdb/metadata"
+)
+
+// usage displays the cloud drive storage used by the data and metadata
+// folders and compares the logical size of the latest snapshot with the
+// physical size of the data blobs.
+func (a *acdb) usage() error {
+	a.Log(acd.DebugTrace, "[TRC] usage")
+
+	err := a.online()
+	if err != nil {
+		return err
+	}
+
+	data, err := a.children(a.dataID, "")
+	if err != nil {
+		return err
+	}
+	var dataBlobs, dataBytes int64
+	for _, v := range data {
+		if v.Kind != acd.AssetFile {
+			continue
+		}
+		dataBlobs++
+		dataBytes += int64(v.ContentProperties.Size)
+	}
+
+	md, err := a.children(a.metadataID, "")
+	if err != nil {
+		return err
+	}
+	var (
+		mdBlobs, mdBytes int64
+		latest           *acd.Asset
+	)
+	for k, v := range md {
+		if v.Kind != acd.AssetFile {
+			continue
+		}
+		mdBlobs++
+		mdBytes += int64(v.ContentProperties.Size)
+
+		if backup.IsSecretsName(v.Name) || v.Name == backup.DedupName {
+			continue
+		}
+		if latest == nil || v.ModifiedDate.After(latest.ModifiedDate) {
+			latest = &md[k]
+		}
+	}
+
+	fmt.Printf("data:     %15v bytes in %v blobs\n", dataBytes, dataBlobs)
+	fmt.Printf("metadata: %15v bytes in %v blobs\n", mdBytes, mdBlobs)
+	fmt.Printf("total:    %15v bytes\n", dataBytes+mdBytes)
+	if c, ok := a.c.(*acd.Client); ok {
+		used, total, err := c.Quota()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not obtain quota: %v\n", err)
+		} else {
+			fmt.Printf("quota:    %15v bytes used of %v\n", used,
+				total)
+		}
+	}
+
+	if latest == nil {
+		return nil
+	}
+
+	logical, err := a.snapshotSize(latest.ID)
+	if err != nil {
+		return fmt.Errorf("%v: %v", latest.Name, err)
+	}
+	fmt.Printf("latest snapshot %v: %v logical bytes, %v physical bytes",
+		latest.Name, logical, dataBytes)
+	if logical > 0 {
+		fmt.Printf(" (%.1f%%)", float64(dataBytes)*100/float64(logical))
+	}
+	fmt.Printf("\n")
+
+	return nil
+}
+
+// snapshotSize returns the sum of the file sizes in metadata id.
+func (a *acdb) snapshotSize(id string) (int64, error) {
+	blob, err := a.c.DownloadJSON(id)
+	if err != nil {
+		return 0, err
+	}
+	mdd, err := backup.DecryptMetadata(blob, &a.keys.MD)
+	if err != nil {
+		return 0, err
+	}
+	md, err := metadata.NewDecoder(bytes.NewReader(mdd))
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for {
+		t, err := md.Next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if e, ok := t.(metadata.File); ok {
+			size += e.Size
+		}
+	}
+}
+
+// checkQuota warns, or fails with -quota-check abort, if the files to archive
+// may not fit in the available Cloud Drive storage.  The estimate ignores
+// deduplication and compression so it errs on the large side.
+func (a *acdb) checkQuota() error {
+	c, ok := a.c.(*acd.Client)
+	if a.quotaCheck == "off" || !ok {
+		return nil
+	}
+	if a.opts.FromTar != nil {
+		fmt.Fprintf(os.Stderr, "warning: the size of a tar stream can "+
+			"not be checked against the quota\n")
+		return nil
+	}
+
+	used, total, err := c.Quota()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not check the quota: "+
+			"%v\n", err)
+		return nil
+	}
+	files, size, err := backup.Estimate(&a.opts)
+	if err != nil {
+		return err
+	}
+	a.Log(debugApp, "[APP] quota used %v of %v, %v files of %v bytes",
+		used, total, files, size)
+	if size <= total-used {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%v files of %v bytes may not fit in the %v "+
+		"bytes available on Cloud Drive", files, size, total-used)
+	if a.quotaCheck == "abort" {
+		return fmt.Errorf("%v, not starting the backup", msg)
+	}
+	fmt.Fprintf(os.Stderr, "warning: %v\n", msg)
+
+	return nil
+}
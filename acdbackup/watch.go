@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/backup"
+)
+
+// watch archives the paths and keeps uploading their changes until
+// interrupted.  The summary of every snapshot is written to stderr.
+func (a *acdb) watch() error {
+	a.Log(acd.DebugTrace, "[TRC] watch")
+
+	err := a.online()
+	if err != nil {
+		return err
+	}
+	a.opts.Target = ""
+	err = a.prepareBackup()
+	if err != nil {
+		return err
+	}
+	if a.verbose {
+		a.opts.Progress = a.printArchived
+	}
+	a.opts.OnSnapshot = func(s *backup.Summary, err error) {
+		if s != nil {
+			e := s.Write(os.Stderr, a.json)
+			if e != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", e)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+
+	// store a last snapshot when interrupted
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return backup.Watch(ctx, a.c, &a.keys, &a.opts)
+}
@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+)
+
+// openFile opens path, the file described by info, for reading and returns
+// the function that closes it.  With PreserveAtime the file is opened
+// without updating its access time where the platform and the ownership of
+// the file allow it; otherwise closing it restores the access time.
+func (a *archiver) openFile(path string, info os.FileInfo) (*os.File,
+	func(), error) {
+
+	if !a.PreserveAtime {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { _ = f.Close() }, nil
+	}
+
+	if oNoatime != 0 {
+		f, err := os.OpenFile(path, os.O_RDONLY|oNoatime, 0)
+		if err == nil {
+			return f, func() { _ = f.Close() }, nil
+		}
+		if !os.IsPermission(err) {
+			return nil, nil, err
+		}
+		// not the owner, fall back to restoring the access time
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { a.closeRestoreAtime(f, path, info) }, nil
+}
+
+// closeRestoreAtime closes f and sets the access time of path back to the
+// one in info.  The current modification time is kept so that changes made
+// while reading are not hidden.
+func (a *archiver) closeRestoreAtime(f *os.File, path string,
+	info os.FileInfo) {
+
+	fi, err := f.Stat()
+	_ = f.Close()
+	if err != nil {
+		return
+	}
+	atime, ok := accessTime(info)
+	if !ok {
+		if !a.atimeWarned {
+			fmt.Fprintf(a.Stderr, "warning: access times can not "+
+				"be preserved on this platform\n")
+			a.atimeWarned = true
+		}
+		return
+	}
+	err = os.Chtimes(path, atime, fi.ModTime())
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "warning %v: could not restore access "+
+			"time: %v\n", path, err)
+	}
+}
@@ -0,0 +1,21 @@
+package backup
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// oNoatime is zero since darwin can not open files without updating their
+// access time.
+const oNoatime = 0
+
+// accessTime returns the access time recorded in fi.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(stat.Atimespec.Sec),
+		int64(stat.Atimespec.Nsec)), true
+}
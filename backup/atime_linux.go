@@ -0,0 +1,20 @@
+package backup
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// oNoatime opens files without updating their access time.  It is refused
+// for files that are not owned by the caller.
+const oNoatime = syscall.O_NOATIME
+
+// accessTime returns the access time recorded in fi.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)), true
+}
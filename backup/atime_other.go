@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package backup
+
+import (
+	"os"
+	"time"
+)
+
+// oNoatime is zero since files can not be opened without updating their
+// access time on this platform.
+const oNoatime = 0
+
+// accessTime reports that access times are unknown on this platform;
+// -preserve-atime therefore has no effect.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
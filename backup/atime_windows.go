@@ -0,0 +1,20 @@
+package backup
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// oNoatime is zero since windows can not open files without updating their
+// access time.
+const oNoatime = 0
+
+// accessTime returns the access time recorded in fi.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	attr, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, attr.LastAccessTime.Nanoseconds()), true
+}
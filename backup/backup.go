@@ -0,0 +1,2053 @@
+// Package backup creates, lists and extracts encrypted and deduplicated
+// backups on a cloud drive backend.  It is the engine behind acdbackup and
+// leaves keys, passwords and configuration to the caller.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/debug"
+	"github.com/marcopeereboom/acdb/metadata"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// Remote folder and node names.
+const (
+	DataName     = "data"     // folder with the encrypted payloads
+	MetadataName = "metadata" // folder with the encrypted snapshots
+	SecretsName  = "secrets"  // encrypted keys, in MetadataName
+	DedupName    = "dedup"    // dedup key fingerprint, in MetadataName
+)
+
+const (
+	modeCreate = iota
+	modeExtract
+	modeList
+	modeEstimate
+)
+
+// errUnsupported is reported for entries that can not be archived.
+var errUnsupported = errors.New("unsupported file type")
+
+// partialSuffix is appended to the names of incomplete snapshots.
+const partialSuffix = ".partial"
+
+// DefaultNameFormat is the time layout of snapshot names,
+// e.g. 20151017.100837.
+const DefaultNameFormat = "20060102.150405"
+
+// maxSnapshotNames is how many names are tried before giving up on a taken
+// snapshot name.
+const maxSnapshotNames = 100
+
+// Progress statuses.
+const (
+	StatusEntry = ""      // entry without payload, or listed or extracted
+	StatusNew   = "new"   // payload was uploaded
+	StatusDedup = "dedup" // payload was already stored
+	StatusSkip  = "skip"  // entry was not archived, see Err
+)
+
+// ProgressEvent describes an entry that was archived, skipped, listed or
+// extracted.
+type ProgressEvent struct {
+	Name       string      // name in the snapshot, or path when skipped
+	Mode       os.FileMode // mode of the entry
+	Size       int64       // size of the entry
+	Status     string      // one of the Status constants
+	Digest     string      // hex payload digest, if any
+	Payload    int         // stored payload size, StatusNew only
+	Compressed bool        // payload is compressed, StatusNew only
+	Err        error       // why the entry was skipped
+}
+
+var (
+	ErrSkipped  = errors.New("completed but some files were skipped")
+	ErrDeadline = errors.New("deadline exceeded, snapshot is partial")
+	ErrCanceled = errors.New("canceled, snapshot is partial")
+
+	errACLs = errors.New("ACLs are only supported on linux and windows")
+)
+
+// Options control a Backup, Restore or List run.  The zero value is usable
+// and yields an uncompressed, quiet run.
+type Options struct {
+	Debugger debug.Debugger // debug output, nil is none
+	Stdout   io.Writer      // per file errors, nil is os.Stdout
+	Stderr   io.Writer      // warnings, nil is os.Stderr
+
+	// Progress, if set, is called for every entry as it is archived,
+	// skipped, listed or extracted.  It is called from a single goroutine
+	// and must not block for long.
+	Progress func(ev ProgressEvent)
+
+	// Remote folders, looked up or created when empty.  OnFolders, if
+	// set, is called with the folders whenever they had to be looked up,
+	// e.g. to refresh a cache.
+	DataID       string
+	MetadataID   string
+	OnFolders    func(dataID, metadataID string)
+	IncludeTrash bool // consider trashed remote nodes
+	Retries      int  // retries while the token can not be refreshed
+
+	// Target is the snapshot.  Backup writes the metadata to this local
+	// file or, when empty, uploads it.  Restore and List read this local
+	// file or, when it does not exist, the remote snapshot of that name.
+	Target string
+
+	Absolute bool // keep leading '/' in names and extract them in place
+	ACLs     bool // archive and restore ACLs and file capabilities
+
+	// Backup only.
+	Paths         []string      // files and directories to archive
+	FromTar       io.Reader     // tar stream to archive before Paths
+	Compress      bool          // compress payloads
+	Level         int           // gzip level, 0 is the default
+	BlockSize     int           // parallel compression block size
+	Blocks        int           // blocks compressed in parallel
+	CompressTypes CompressTypes // compression overrides by extension
+	Digest        [4]byte       // digest algorithm, zero is sha256
+	Follow        bool          // archive symlink targets
+	Base          string        // record names relative to Base
+	OneFS         bool          // do not cross file systems
+	ExcludeCaches bool          // skip directories with a CACHEDIR.TAG
+	PreserveAtime bool          // do not change access times of files
+	Throttle      int64         // file bytes read per second, 0 is no limit
+	MaxSize       int64         // skip larger files, 0 is no limit
+	WarnChanged   bool          // warn about files changing during backup
+	Deadline      time.Time     // stop and store a partial snapshot
+	NameFormat    string        // time layout of the snapshot name
+	Append        bool          // add to the local snapshot Target
+	Split         int64         // split Target into parts, 0 is one file
+	PlainMetadata bool          // do not encrypt Target, for debugging
+	Tags          []string      // labels attached to the snapshot
+
+	// ExcludeIfPresent skips the directories that contain a file with
+	// one of these names.
+	ExcludeIfPresent []string
+
+	// Own lists the files and directories of acdbackup itself, e.g. its
+	// keys or the local Target and its LocalDataDir, which are never
+	// archived.  A file also covers its split parts.
+	Own []string
+
+	// CompressionStats adds the sizes of the uploaded payloads, by MIME
+	// type, to the Summary.
+	CompressionStats bool
+
+	// Watch only.  OnSnapshot, if set, is called after every snapshot
+	// with what Backup would have returned.
+	Settle     time.Duration // quiet time before uploading, 0 is 2s
+	Interval   time.Duration // time between snapshots, 0 is 10m
+	OnSnapshot func(s *Summary, err error)
+
+	// Restore and List.
+	Root        string // extract path
+	Strip       int    // leading path elements to strip on extract
+	Jobs        int    // concurrent downloads, 0 is 4
+	Perms       bool   // restore permissions, ownership and times
+	StrictPerms bool   // fail when permissions can not be restored
+	NoSync      bool   // do not flush extracted files
+	ResumeFile  string // record extract progress here and resume from it
+}
+
+// archiver is the state of a single Backup, Restore or List run.
+type archiver struct {
+	debug.Debugger
+	Options
+
+	me *metadata.MetadataEncoder
+	md *metadata.MetadataDecoder
+
+	// c is aborted along with the run, see bind, unbound is not so that
+	// a partial snapshot can still be stored
+	c       acd.Backend
+	unbound acd.Backend
+	keys    *shared.Keys
+
+	dataID     string
+	metadataID string
+
+	mode int
+
+	// ctx cancels the run and run, if set, pauses it
+	ctx context.Context
+	run *Run
+
+	// permission for directories
+	permList *list.List
+
+	// real parent directories of the symlinks currently being followed
+	links []string
+
+	// device id of the argument currently being archived
+	dev uint64
+
+	// absolute Own paths and the working directory they are relative to
+	own []string
+	cwd string
+
+	// access times can not be preserved and this was reported
+	atimeWarned bool
+
+	// limits reading files, nil is no limit
+	throttle *throttle
+
+	// results of the current archive run
+	stats Summary
+
+	// payloads known to be stored during the current archive run
+	stored digestSet
+
+	// number of permissions that could not be restored, atomic
+	permFailures int64
+
+	// data node ids resolved ahead of extraction, by name
+	resolvedMtx sync.Mutex
+	resolved    map[string]string
+
+	// digests of unchanged files by path, only kept by Watch
+	cache map[string]cachedFile
+}
+
+// newArchiver returns an archiver for mode that fills in the defaults of o
+// and validates it.
+func newArchiver(c acd.Backend, keys *shared.Keys, o *Options,
+	mode int) (*archiver, error) {
+
+	if o == nil {
+		o = &Options{}
+	}
+	a := &archiver{
+		Debugger:   o.Debugger,
+		Options:    *o,
+		c:          c,
+		unbound:    c,
+		keys:       keys,
+		dataID:     o.DataID,
+		metadataID: o.MetadataID,
+		mode:       mode,
+		ctx:        context.Background(),
+		permList:   list.New(),
+	}
+	if a.Debugger == nil {
+		a.Debugger = debug.NewDebugNil()
+	}
+	if a.Stdout == nil {
+		a.Stdout = os.Stdout
+	}
+	if a.Stderr == nil {
+		a.Stderr = os.Stderr
+	}
+	if a.Level == 0 {
+		a.Level = gzip.DefaultCompression
+	}
+	if a.NameFormat == "" {
+		a.NameFormat = DefaultNameFormat
+	}
+	if a.Digest == ([4]byte{}) {
+		a.Digest = shared.DigestSHA256
+	}
+	if a.Jobs == 0 {
+		a.Jobs = 4
+	}
+	if keys == nil && mode != modeEstimate {
+		return nil, errors.New("no keys")
+	}
+	if mode != modeCreate && mode != modeEstimate && a.Target == "" {
+		return nil, errors.New("must provide archive metadata file")
+	}
+
+	err := a.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if a.Base != "" {
+		a.Base, err = filepath.Abs(a.Base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mode == modeCreate && a.Throttle > 0 {
+		a.throttle = &throttle{rate: a.Throttle}
+	}
+	if (mode == modeCreate || mode == modeEstimate) && len(a.Own) != 0 {
+		a.cwd, err = os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range a.Own {
+			a.own = append(a.own, a.abs(v))
+		}
+	}
+
+	return a, nil
+}
+
+// Validate returns an error if o is invalid.  Backup, Restore and List
+// validate their options but callers may want to do so before going online.
+func (o *Options) Validate() error {
+	switch {
+	case o.Level != 0 && o.Level != gzip.DefaultCompression &&
+		(o.Level < gzip.BestSpeed || o.Level > gzip.BestCompression):
+		return fmt.Errorf("invalid compression level %v", o.Level)
+	case o.BlockSize < 0 || (o.BlockSize > 0 && o.BlockSize <= 16384):
+		return fmt.Errorf("invalid block size %v, must be larger "+
+			"than 16384", o.BlockSize)
+	case o.Blocks < 0:
+		return fmt.Errorf("invalid number of blocks %v", o.Blocks)
+	case o.MaxSize < 0:
+		return fmt.Errorf("invalid maximum size %v", o.MaxSize)
+	case o.Jobs < 0:
+		return fmt.Errorf("invalid number of jobs %v", o.Jobs)
+	case o.Retries < 0:
+		return fmt.Errorf("invalid number of retries %v", o.Retries)
+	case o.ACLs && !aclsSupported:
+		return errACLs
+	case o.Append && o.Target == "":
+		return errors.New("can only append to a local snapshot")
+	case o.Split < 0:
+		return fmt.Errorf("invalid split size %v", o.Split)
+	case o.Throttle < 0:
+		return fmt.Errorf("invalid throttle %v", o.Throttle)
+	case o.Split > 0 && o.Target == "":
+		return errors.New("can only split a local snapshot")
+	case o.Split > 0 && o.Append:
+		return errors.New("can not append to a split snapshot")
+	case o.NameFormat != "" && !validName(time.Now().Format(o.NameFormat)):
+		return fmt.Errorf("invalid name format %q", o.NameFormat)
+	case !validTags(o.Tags):
+		return fmt.Errorf("invalid tags %q", o.Tags)
+	case !validMarkers(o.ExcludeIfPresent):
+		return fmt.Errorf("invalid exclude marker %q", o.ExcludeIfPresent)
+	case o.Base == "":
+		return nil
+	case o.FromTar != nil:
+		return errors.New("base can not be used with a tar stream")
+	}
+
+	base, err := filepath.Abs(o.Base)
+	if err != nil {
+		return err
+	}
+	for _, v := range o.Paths {
+		p, err := filepath.Abs(v)
+		if err != nil {
+			return err
+		}
+		if !isAncestor(base, p) {
+			return fmt.Errorf("%v is not under base %v", v, o.Base)
+		}
+	}
+
+	return nil
+}
+
+// Backup archives o.FromTar, if set, and o.Paths to c, encrypted with keys,
+// and returns what it did.  The summary is also returned along with
+// ErrSkipped when files were skipped on error and with ErrDeadline when
+// o.Deadline cut the snapshot short.
+func Backup(c acd.Backend, keys *shared.Keys, o *Options) (*Summary, error) {
+	return BackupContext(context.Background(), c, keys, o)
+}
+
+// BackupContext is Backup that stops archiving once ctx is done.  What was
+// archived until then is stored as a partial snapshot and ErrCanceled is
+// returned along with the summary.
+func BackupContext(ctx context.Context, c acd.Backend, keys *shared.Keys,
+	o *Options) (*Summary, error) {
+
+	a, err := newArchiver(c, keys, o, modeCreate)
+	if err != nil {
+		return nil, err
+	}
+	a.ctx = ctx
+
+	return a.backup()
+}
+
+// backup runs the archive and returns the summary unless it failed.
+func (a *archiver) backup() (*Summary, error) {
+	err := a.archive()
+	if err != nil && err != ErrSkipped && err != ErrDeadline &&
+		err != ErrCanceled {
+		return nil, err
+	}
+
+	return &a.stats, err
+}
+
+// Restore extracts snapshot o.Target into o.Root.  It returns ErrSkipped
+// when some files could not be extracted.
+func Restore(c acd.Backend, keys *shared.Keys, o *Options) error {
+	a, err := newArchiver(c, keys, o, modeExtract)
+	if err != nil {
+		return err
+	}
+
+	return a.list()
+}
+
+// List reports the entries of snapshot o.Target to o.Progress.  C is only used
+// when o.Target is not a local file and may be nil otherwise.
+func List(c acd.Backend, keys *shared.Keys, o *Options) error {
+	a, err := newArchiver(c, keys, o, modeList)
+	if err != nil {
+		return err
+	}
+
+	return a.list()
+}
+
+// FindFolders returns the ids of the data and metadata folders of c and
+// creates the ones that do not exist.  Trashed folders are only considered
+// when includeTrash is set.
+func FindFolders(c acd.Backend, includeTrash bool) (dataID,
+	metadataID string, err error) {
+
+	// get root folders
+	filter := "?filters=kind:" + acd.AssetFolder
+	if !includeTrash {
+		filter += acd.FilterAnd + acd.FilterAvailable
+	}
+	children, err := c.GetChildrenJSON("", filter)
+	if err != nil {
+		return "", "", err
+	}
+
+	// save off data and metadata ids
+	for _, v := range children.Data {
+		switch v.Name {
+		case DataName:
+			dataID = v.ID
+		case MetadataName:
+			metadataID = v.ID
+		}
+	}
+	if dataID == "" {
+		dataID, err = mkdir(c, DataName)
+	}
+	if err == nil && metadataID == "" {
+		metadataID, err = mkdir(c, MetadataName)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("could not create required "+
+			"directories: %v", err)
+	}
+
+	return dataID, metadataID, nil
+}
+
+// mkdir creates folder name in the root of c and returns its id.  A folder
+// that exists already is not an error but yields no id.
+func mkdir(c acd.Backend, name string) (string, error) {
+	asset, err := c.MkdirJSON(c.GetRoot(), name)
+	if err != nil {
+		if e, ok := acd.IsCombinedError(err); ok &&
+			e.StatusCode == http.StatusConflict {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return asset.ID, nil
+}
+
+// findFolders looks up the data and metadata folders, e.g. when the ones
+// that were given turned out to be stale.
+func (a *archiver) findFolders() error {
+	a.Log(acd.DebugTrace, "[TRC] findFolders")
+
+	var err error
+	a.dataID, a.metadataID, err = FindFolders(a.unbound, a.IncludeTrash)
+	if err != nil {
+		return err
+	}
+	if a.OnFolders != nil {
+		a.OnFolders(a.dataID, a.metadataID)
+	}
+
+	return nil
+}
+
+// online ensures that the remote folders are known.
+func (a *archiver) online() error {
+	a.Log(acd.DebugTrace, "[TRC] online")
+
+	if a.c == nil {
+		return errors.New("no cloud drive backend")
+	}
+	if a.dataID != "" && a.metadataID != "" {
+		return nil
+	}
+
+	return a.findFolders()
+}
+
+// validName returns true if name can be used as a snapshot name.
+func validName(name string) bool {
+	return name != "" && !IsSecretsName(name) && name != DedupName &&
+		!strings.ContainsAny(name, "/\\")
+}
+
+// ExtraSecretsName returns the name of the additional secrets called name.
+// They seal the same keys as SecretsName with another password.
+func ExtraSecretsName(name string) string {
+	return SecretsName + "." + name
+}
+
+// IsSecretsName returns true if name is the name of the secrets or of
+// additional secrets.
+func IsSecretsName(name string) bool {
+	return name == SecretsName || strings.HasPrefix(name, SecretsName+".")
+}
+
+// validTags returns true if tags can be attached to a snapshot.
+func validTags(tags []string) bool {
+	for _, v := range tags {
+		if v == "" || strings.ContainsAny(v, ", \t\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// IsNotFound returns true if err is a cloud drive not found error which,
+// for operations on cached folder ids, means that the cache is stale.
+func IsNotFound(err error) bool {
+	e, ok := acd.IsCombinedError(err)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// isAncestor returns true if dir is parent or one of its ancestors.  Both
+// paths must be absolute and clean.
+func isAncestor(dir, parent string) bool {
+	if dir == parent || dir == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(parent, dir+string(filepath.Separator))
+}
+
+// followSymlink passes the target of symlink path to walk as if it lived at
+// path.  Directories are walked recursively unless doing so would result in a
+// loop.
+func (a *archiver) followSymlink(path string, walk filepath.WalkFunc) error {
+	a.Log(acd.DebugLoud, "[TRC] followSymlink %v", path)
+
+	target, err := filepath.Abs(path)
+	if err == nil {
+		target, err = filepath.EvalSymlinks(target)
+	}
+	if err != nil {
+		a.skip(path, err, false)
+		return nil
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		a.skip(path, err, false)
+		return nil
+	}
+	if !info.IsDir() {
+		return walk(path, info, nil)
+	}
+
+	// a loop exists if the target contains any directory we are in
+	parent, err := filepath.Abs(filepath.Dir(path))
+	if err == nil {
+		parent, err = filepath.EvalSymlinks(parent)
+	}
+	if err != nil {
+		a.skip(path, err, false)
+		return nil
+	}
+	for _, v := range append(a.links, parent) {
+		if isAncestor(target, v) {
+			a.skip(path, errors.New("symlink loop"), false)
+			return nil
+		}
+	}
+
+	a.links = append(a.links, parent)
+	defer func() { a.links = a.links[:len(a.links)-1] }()
+
+	return filepath.Walk(target, func(p string, fi os.FileInfo,
+		errIn error) error {
+
+		rel, err := filepath.Rel(target, p)
+		if err != nil {
+			return err
+		}
+		return walk(filepath.Join(path, rel), fi, errIn)
+	})
+}
+
+// walkPath walks argument path, which may be a file, with walk.
+func (a *archiver) walkPath(path string, walk filepath.WalkFunc) error {
+	if a.OneFS {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		a.dev, _ = deviceID(fi)
+	}
+
+	return filepath.Walk(path, walk)
+}
+
+// sizedFileInfo overrides the size of an os.FileInfo.
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (s sizedFileInfo) Size() int64 {
+	return s.size
+}
+
+// checkChanged rereads path and warns if its content no longer matches the
+// digest of the content that was backed up.
+func (a *archiver) checkChanged(path string, info os.FileInfo,
+	digest *[sha256.Size]byte) {
+
+	f, closeFile, err := a.openFile(path, info)
+	if err != nil {
+		fmt.Fprintf(a.Stdout, "warning %v: could not verify "+
+			"content: %v\n", path, err)
+		return
+	}
+	d, err := shared.ReaderDigest(a.Digest, a.reader(f))
+	closeFile()
+	if err != nil {
+		fmt.Fprintf(a.Stdout, "warning %v: could not verify "+
+			"content: %v\n", path, err)
+		return
+	}
+	if !bytes.Equal(d[:], digest[:]) {
+		fmt.Fprintf(a.Stdout, "warning %v: content changed during "+
+			"backup\n", path)
+	}
+}
+
+// archiveName returns the name under which path is recorded in the
+// metadata.  With -base the name is relative to the base directory.
+// Otherwise, unless absolute names were requested, leading '/' and, like tar
+// does, leading '../' are stripped so that extraction always lands below the
+// extract path.
+func (a *archiver) archiveName(p string) string {
+	if a.Base != "" {
+		// arguments were verified to live under base
+		abs, err := filepath.Abs(p)
+		if err == nil {
+			p, err = filepath.Rel(a.Base, abs)
+		}
+		if err == nil {
+			return filepath.ToSlash(p)
+		}
+	}
+
+	name := filepath.Clean(p)
+	if a.Absolute {
+		return filepath.ToSlash(name)
+	}
+	// like the leading '/' the volume, e.g. C:, is not part of the name
+	name = filepath.ToSlash(name[len(filepath.VolumeName(name)):])
+	name = stripDotDot(strings.TrimLeft(name, "/"))
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// stripDotDot removes the leading '..' elements from clean slash separated
+// name.  Clean leaves them nowhere else.
+func stripDotDot(name string) string {
+	for name == ".." || strings.HasPrefix(name, "../") {
+		name = strings.TrimPrefix(name[2:], "/")
+	}
+	return name
+}
+
+// stripName removes the leading strip path elements from name.  It returns
+// false if name does not have more than strip elements and should therefore
+// be skipped.
+func (a *archiver) stripName(name string) (string, bool) {
+	if a.Strip <= 0 {
+		return name, true
+	}
+
+	var elements []string
+	for _, v := range strings.Split(name, "/") {
+		if v == "" || v == "." {
+			continue
+		}
+		elements = append(elements, v)
+	}
+	if len(elements) <= a.Strip {
+		return "", false
+	}
+
+	return path.Join(elements[a.Strip:]...), true
+}
+
+// localPath returns the location name is extracted to.  Absolute names are
+// only honored when absolute names were requested; otherwise all names are
+// relative to the extract path.  Names are stored with / and translated to
+// the local separator.
+func (a *archiver) localPath(name string) string {
+	if a.Absolute && path.IsAbs(name) {
+		return filepath.FromSlash(name)
+	}
+	return filepath.Join(a.Root,
+		filepath.FromSlash(strings.TrimLeft(name, "/")))
+}
+
+// nameMax is the longest path element, in bytes, file systems accept.
+const nameMax = 255
+
+// checkPath returns an error naming the limit that local path p exceeds, if
+// any.  This turns the cryptic errors of creating such paths into a clear
+// per-entry error.
+func checkPath(p string) error {
+	if len(p) >= pathMax {
+		return fmt.Errorf("path is %v bytes, limit is %v", len(p),
+			pathMax-1)
+	}
+	for _, v := range strings.Split(p, string(filepath.Separator)) {
+		if len(v) > nameMax {
+			return fmt.Errorf("element %v... is %v bytes, limit is %v",
+				v[:16], len(v), nameMax)
+		}
+	}
+	return nil
+}
+
+// CompressTypes maps file name extensions to compression decisions.  It is
+// a flag.Value that is set from a comma separated list of
+// extension=compress|skip pairs.
+type CompressTypes map[string]int
+
+func (ct CompressTypes) String() string {
+	var s []string
+	for k, v := range ct {
+		if v == shared.CompressAlways {
+			s = append(s, k+"=compress")
+		} else {
+			s = append(s, k+"=skip")
+		}
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (ct CompressTypes) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid compression type: %v", v)
+		}
+		switch kv[1] {
+		case "compress":
+			ct[kv[0]] = shared.CompressAlways
+		case "skip":
+			ct[kv[0]] = shared.CompressNever
+		default:
+			return fmt.Errorf("invalid compression type: %v", v)
+		}
+	}
+	return nil
+}
+
+// mode returns the compression decision for name.  The longest matching
+// extension wins, e.g. .log.1 over .1.
+func (ct CompressTypes) mode(name string) int {
+	mode, match := shared.CompressAuto, ""
+	for k, v := range ct {
+		if strings.HasSuffix(name, k) && len(k) > len(match) {
+			mode, match = v, k
+		}
+	}
+	return mode
+}
+
+// compressOptions returns the options to compress file name with.
+func (a *archiver) compressOptions(name string) *shared.CompressOptions {
+	if !a.Compress {
+		return shared.DefaultCompressOptions(gzip.NoCompression)
+	}
+
+	co := shared.DefaultCompressOptions(a.Level)
+	co.Mode = a.CompressTypes.mode(name)
+	if a.BlockSize != 0 {
+		co.BlockSize = a.BlockSize
+	}
+	if a.Blocks != 0 {
+		co.Blocks = a.Blocks
+	}
+	return co
+}
+
+// progress reports ev to the Progress callback, if any.
+func (a *archiver) progress(ev ProgressEvent) {
+	if a.Progress != nil {
+		a.Progress(ev)
+	}
+}
+
+// skip reports that the entry at path was not archived because of err.  An
+// excluded entry was left out on purpose, e.g. by MaxSize, and is counted
+// separately from entries that failed.
+func (a *archiver) skip(path string, err error, excluded bool) {
+	fmt.Fprintf(a.Stdout, "skipping %v: %v\n", path, err)
+	if excluded {
+		a.stats.Excluded++
+	} else {
+		a.stats.Skipped++
+	}
+	a.progress(ProgressEvent{
+		Name:   path,
+		Status: StatusSkip,
+		Err:    err,
+	})
+}
+
+// checkpoint is called before every entry that is archived.  It blocks while
+// the run is paused and returns ErrCanceled once it was canceled or
+// ErrDeadline once Deadline passed.
+func (a *archiver) checkpoint() error {
+	if a.run != nil {
+		a.run.wait(a.ctx)
+	}
+
+	return a.halted()
+}
+
+// halted returns ErrCanceled once the run was canceled or ErrDeadline once
+// Deadline passed.
+func (a *archiver) halted() error {
+	if a.ctx.Err() != nil {
+		return ErrCanceled
+	}
+	if !a.Deadline.IsZero() && time.Now().After(a.Deadline) {
+		return ErrDeadline
+	}
+
+	return nil
+}
+
+// bind aborts the requests of the run once it is canceled or Deadline passed
+// until the returned function is called.
+func (a *archiver) bind() func() {
+	ctx, cancel := a.ctx, context.CancelFunc(func() {})
+	if !a.Deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, a.Deadline)
+	}
+	a.c = acd.WithContext(a.unbound, ctx)
+
+	return func() {
+		cancel()
+		a.c = a.unbound
+	}
+}
+
+// stopped returns true if err cut the snapshot short.
+func stopped(err error) bool {
+	return err == ErrDeadline || err == ErrCanceled
+}
+
+// tooLarge returns true and warns if a file of size exceeds -max-size.
+func (a *archiver) tooLarge(path string, size int64) bool {
+	if a.MaxSize == 0 || size <= a.MaxSize {
+		return false
+	}
+	a.skip(path, fmt.Errorf("size %v exceeds maximum %v", size,
+		a.MaxSize), true)
+
+	return true
+}
+
+// walk archives the entry at path.  It is called by filepath.Walk, which
+// visits entries in lexical order, and encodes the entry before returning.
+// Metadata entries therefore appear in argument order and lexically by path
+// within each argument, which keeps snapshots of an unchanged tree
+// comparable.  Work that may complete out of order, such as uploads, must
+// never encode entries itself.
+func (a *archiver) walk(path string, info os.FileInfo, errIn error) error {
+	a.Log(acd.DebugLoud, "[TRC] walk")
+
+	err := a.checkpoint()
+	if err != nil {
+		return err
+	}
+
+	if errIn != nil {
+		a.skip(path, errIn, false)
+		return nil
+	}
+
+	var (
+		h       *shared.Header
+		payload []byte
+		digest  *[sha256.Size]byte
+	)
+	name := a.archiveName(path)
+
+	if e := a.excluded(path, info); e != nil {
+		a.skip(path, e, true)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	switch {
+	case info.Mode()&os.ModeDir == os.ModeDir:
+		// dir
+		err = a.archiveACLs(path, name)
+		if err != nil {
+			break
+		}
+		err = a.me.Dir(name, info)
+		if err != nil {
+			break
+		}
+
+	case info.Mode()&os.ModeSymlink == os.ModeSymlink && a.Follow:
+		// archive symlink target instead
+		return a.followSymlink(path, a.walk)
+
+	case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+		// symlink
+		err = a.me.Symlink(name, path, info)
+		if err != nil {
+			break
+		}
+
+	case info.Mode().IsRegular() && info.Size() == 0:
+		// zero sized file
+		err = a.archiveACLs(path, name)
+		if err != nil {
+			break
+		}
+		err = a.me.File(name, info, "", nil)
+		if err != nil {
+			break
+		}
+
+	case info.Mode().IsRegular():
+		// regular file
+		if a.tooLarge(path, info.Size()) {
+			return nil
+		}
+
+		h, payload, digest, err = a.readFile(path, info)
+		if err != nil {
+			break
+		}
+
+		// record what was read, not what stat claimed
+		if int64(h.Size) != info.Size() {
+			fmt.Fprintf(a.Stdout, "warning %v: size changed from "+
+				"%v to %v during backup\n", path, info.Size(),
+				h.Size)
+			info = sizedFileInfo{FileInfo: info, size: int64(h.Size)}
+		}
+		if a.WarnChanged {
+			a.checkChanged(path, info, &h.Digest)
+		}
+
+		err = a.archiveACLs(path, name)
+		if err != nil {
+			break
+		}
+		err = a.me.File(name, info, h.MimeType, digest)
+		if err != nil {
+			break
+		}
+
+	default:
+		a.skip(path, errUnsupported, true)
+		return nil
+	}
+
+	if err != nil {
+		a.skip(path, err, false)
+		return nil
+	}
+
+	return a.store(path, name, info, h, digest, payload)
+}
+
+// readFile returns the header and digest of regular file path and, unless
+// the payload is stored already, the encrypted payload.
+func (a *archiver) readFile(path string, info os.FileInfo) (*shared.Header,
+	[]byte, *[sha256.Size]byte, error) {
+
+	if h, digest, ok := a.cached(path, info); ok {
+		return h, nil, digest, nil
+	}
+
+	f, closeFile, err := a.openFile(path, info)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer closeFile()
+
+	// digesting is cheap compared to compressing and encrypting so find
+	// out if the payload already exists first
+	h, digest, err := shared.DedupDigest(a.reader(f), a.Digest,
+		&a.keys.Dedup)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	exists := a.stored.has(digest)
+	var e error
+	if !exists {
+		exists, _, e = a.c.NodeExists(a.dataID,
+			hex.EncodeToString(digest[:]))
+	}
+	if e != nil {
+		// let the upload sort it out
+		a.Log(acd.DebugTrace, "[TRC] NodeExists %v: %v", path, e)
+	}
+	var payload []byte
+	if !exists {
+		// payload and external pointer AND digest in one pass
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		h, payload, digest, err = shared.NaClEncrypt(a.reader(f),
+			fi.Size(), a.compressOptions(path), a.Digest,
+			&a.keys.Data, &a.keys.Dedup)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	a.remember(path, info, h, digest)
+
+	return h, payload, digest, nil
+}
+
+// archiveACLs records the ACLs and file capabilities of path, if any, for
+// the entry called name that is archived next.  Failing to read them is not
+// fatal since the entry itself can still be archived.
+func (a *archiver) archiveACLs(path, name string) error {
+	if !a.ACLs {
+		return nil
+	}
+
+	attrs, err := getACLs(path)
+	if err != nil {
+		fmt.Fprintf(a.Stdout, "warning %v: could not read ACLs: %v\n",
+			path, err)
+		return nil
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	return a.me.Xattr(name, attrs)
+}
+
+// upload uploads payload as node into parent through c.  It retries while the
+// token can not be refreshed, see retry, and returns ErrTokenRejected if the
+// token was rejected.
+func (a *archiver) upload(c acd.Backend, parent string, node *acd.NodeJSON,
+	payload []byte) error {
+
+	return a.retry(func() error {
+		return a.uploadOnce(c, parent, node, payload)
+	})
+}
+
+// uploadOnce uploads payload as node into parent and retries once when no
+// response was received.  Such an upload may have succeeded anyway so the
+// node is looked up first and, if present, the upload is considered done;
+// re-posting would create a duplicate node that breaks path lookups.
+func (a *archiver) uploadOnce(c acd.Backend, parent string,
+	node *acd.NodeJSON, payload []byte) error {
+
+	_, err := c.UploadNode(parent, node, payload)
+	if err == nil {
+		return nil
+	}
+	if _, ok := acd.IsCombinedError(err); ok {
+		// the server answered
+		return err
+	}
+
+	a.Log(acd.DebugTrace, "[TRC] upload %v: %v", node.Name, err)
+	exists, _, e := c.NodeExists(parent, node.Name)
+	if e != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err = c.UploadNode(parent, node, payload)
+
+	return err
+}
+
+// uploadSnapshot uploads the encrypted metadata md as a snapshot named after
+// the current time and returns that name.  A counter is appended when the
+// name is taken, e.g. by a backup that started in the same second.
+func (a *archiver) uploadSnapshot(md []byte, partial bool) (string, error) {
+	desc, err := a.description()
+	if err != nil {
+		return "", err
+	}
+
+	base := time.Now().Format(a.NameFormat)
+	for i := 0; ; i++ {
+		node := acd.NodeJSON{
+			Name:        base,
+			Labels:      a.Tags,
+			Description: desc,
+		}
+		if i > 0 {
+			node.Name = fmt.Sprintf("%v-%v", base, i)
+		}
+		if partial {
+			node.Name += partialSuffix
+		}
+
+		err := a.upload(a.unbound, a.metadataID, &node, md)
+		if IsNotFound(err) {
+			// cached folder is gone
+			err = a.findFolders()
+			if err == nil {
+				err = a.upload(a.unbound, a.metadataID, &node,
+					md)
+			}
+		}
+		if e, ok := acd.IsCombinedError(err); ok &&
+			e.StatusCode == http.StatusConflict &&
+			i < maxSnapshotNames {
+			continue
+		}
+
+		return node.Name, err
+	}
+}
+
+// store uploads payload, if any, under digest and reports the archived entry
+// called name.  A digest without payload was found to exist already.  H is
+// the payload header, if any, and path is only used for reporting errors.
+// Upload failures skip the entry, store only returns an error when the backup
+// can not continue, i.e. ErrTokenRejected, ErrCanceled or ErrDeadline.
+func (a *archiver) store(path, name string, info os.FileInfo, h *shared.Header,
+	digest *[sha256.Size]byte, payload []byte) error {
+
+	var (
+		d  string
+		ev ProgressEvent
+	)
+	if digest != nil {
+		d = hex.EncodeToString(digest[:])
+	}
+
+	if digest != nil && (payload == nil || a.stored.has(digest)) {
+		ev.Status = StatusDedup
+		a.stats.Deduped++
+		a.stored.add(digest)
+	} else if digest != nil {
+		err := a.upload(a.c, a.dataID, &acd.NodeJSON{Name: d}, payload)
+		if IsNotFound(err) {
+			// cached folder is gone
+			err = a.findFolders()
+			if err == nil {
+				err = a.upload(a.c, a.dataID,
+					&acd.NodeJSON{Name: d}, payload)
+			}
+		}
+		if err != nil && a.halted() != nil {
+			// aborted, the entry is not part of the snapshot
+			return a.halted()
+		}
+		if err == ErrTokenRejected || err == ErrCanceled {
+			return err
+		} else if err != nil {
+			if e, ok := acd.IsCombinedError(err); ok {
+				if e.StatusCode != http.StatusConflict {
+					a.skip(path, err, false)
+					return nil
+				}
+				ev.Status = StatusDedup
+				a.stats.Deduped++
+				a.stored.add(digest)
+			} else {
+				a.skip(path, err, false)
+				return nil
+			}
+		} else {
+			ev.Status = StatusNew
+			ev.Payload = len(payload)
+			ev.Compressed = h != nil &&
+				h.Compression == shared.CompGZIP
+			a.stats.New++
+			a.stats.Uploaded += int64(len(payload))
+			a.stored.add(digest)
+			if a.stats.Compression != nil && h != nil {
+				a.stats.Compression.add(h, payload)
+			}
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		a.stats.Dirs++
+	case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+		a.stats.Symlinks++
+	default:
+		a.stats.Files++
+		a.stats.Read += info.Size()
+	}
+
+	ev.Name = name
+	ev.Mode = info.Mode()
+	ev.Size = info.Size()
+	ev.Digest = d
+	a.progress(ev)
+
+	return nil
+}
+
+// archive archives the tar stream and paths and stores the metadata.
+func (a *archiver) archive() error {
+	a.Log(acd.DebugTrace, "[TRC] archive")
+
+	if a.CompressionStats {
+		a.stats.Compression = &CompressionStats{}
+	}
+	defer a.bind()()
+
+	// metadata goes through a temporary file so that the local archive is
+	// only replaced once it is complete
+	f, err := ioutil.TempFile("", "acdb")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+	defer f.Close()
+
+	// setup metadata encoder
+	if a.Append {
+		md, err := a.readTarget()
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(md)
+		if err != nil {
+			return err
+		}
+
+		// digests must match the ones already recorded
+		a.me, err = metadata.NewAppendEncoder(f)
+		if err != nil {
+			return err
+		}
+		a.Digest = a.me.Algorithm()
+	} else {
+		a.me, err = metadata.NewEncoder(f, a.compressOptions("").Level,
+			a.Digest)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = a.me.Close() }()
+
+	// go online
+	err = a.online()
+	if err != nil {
+		return err
+	}
+
+	// ErrDeadline or ErrCanceled when cut short
+	var partial error
+	if a.FromTar != nil {
+		err = a.walkTar(a.FromTar)
+		if stopped(err) {
+			partial = err
+		} else if err != nil {
+			return err
+		}
+	}
+
+	warned, warnedDotDot := false, false
+	for _, v := range a.Paths {
+		if partial != nil {
+			break
+		}
+		if filepath.IsAbs(v) && !a.Absolute && a.Base == "" && !warned {
+			fmt.Fprintf(a.Stdout, "removing leading '/' from "+
+				"member names\n")
+			warned = true
+		}
+		n := filepath.ToSlash(filepath.Clean(v))
+		if stripDotDot(n) != n && !a.Absolute && a.Base == "" &&
+			!warnedDotDot {
+			fmt.Fprintf(a.Stdout, "removing leading '../' from "+
+				"member names\n")
+			warnedDotDot = true
+		}
+		err := a.walkPath(v, a.walk)
+		if stopped(err) {
+			partial = err
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// metadata is only complete once it is closed
+	err = a.me.Close()
+	if err != nil {
+		return err
+	}
+
+	// determine what to do with metadata
+	md, err := readAll(f)
+	if err != nil {
+		return err
+	}
+	if a.Target == "" || !a.PlainMetadata {
+		md, err = SealMetadata(md, &a.keys.MD)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.Target != "" {
+		err = a.writeTarget(md)
+		if err != nil {
+			return err
+		}
+	} else {
+		// upload to cloud drive
+		name, err := a.uploadSnapshot(md, partial != nil)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(a.Stdout, "backup complete: %v\n", name)
+		a.stats.Snapshot = name
+	}
+
+	st := a.c.Stats()
+	a.stats.Client = &st
+	if partial != nil {
+		return partial
+	}
+	if a.stats.Skipped != 0 {
+		return ErrSkipped
+	}
+
+	return nil
+}
+
+func (a *archiver) downloadPayload(fullpath string, id [sha256.Size]byte,
+	perm os.FileMode) error {
+
+	ids := hex.EncodeToString(id[:])
+
+	a.Log(acd.DebugTrace, "[TRC] downloadPayload %v", ids)
+
+	nodeID, err := a.resolve(ids)
+	if err != nil {
+		return fmt.Errorf("remote object not found")
+	}
+	a.Log(acd.DebugTrace, "[TRC] found asset: %v -> %v\n", nodeID, ids)
+	var body []byte
+	err = a.retry(func() error {
+		var err error
+		body, err = a.c.DownloadJSON(nodeID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// decrypt
+	_, payload, err := shared.NaClDecrypt(body, &a.keys.Data)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(a.localPath(fullpath), payload, perm, !a.NoSync)
+}
+
+// prefetch resolves the data nodes of files with as few requests as possible
+// so that extracting them does not cost a lookup each.  Failures are only
+// logged since resolve falls back to looking up every file on its own.
+func (a *archiver) prefetch(files []metadata.File) {
+	names := make([]string, 0, len(files))
+	for _, v := range files {
+		if v.Size != 0 {
+			names = append(names, hex.EncodeToString(v.Digest[:]))
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	ids, err := a.c.ResolveNames(a.dataID, names)
+	if err != nil {
+		a.Log(acd.DebugTrace, "[TRC] prefetch: %v", err)
+		return
+	}
+
+	a.resolvedMtx.Lock()
+	defer a.resolvedMtx.Unlock()
+	if a.resolved == nil {
+		a.resolved = make(map[string]string)
+	}
+	for k, v := range ids {
+		a.resolved[k] = v
+	}
+}
+
+// resolve returns the id of the data node called name.
+func (a *archiver) resolve(name string) (string, error) {
+	a.resolvedMtx.Lock()
+	id, ok := a.resolved[name]
+	a.resolvedMtx.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	asset, err := a.c.GetMetadataFS(DataName + "/" + name)
+	if err != nil {
+		return "", err
+	}
+
+	return asset.ID, nil
+}
+
+// symlink creates the symlink name pointing at link.  The interrupted run
+// that is being resumed may have created name already, in that case a link
+// with another target is replaced.
+func symlink(link, name string, resuming bool) error {
+	err := os.Symlink(link, name)
+	if err == nil || !resuming || !os.IsExist(err) {
+		return err
+	}
+	current, e := os.Readlink(name)
+	if e != nil {
+		// not a symlink, leave it alone
+		return err
+	}
+	if current == link {
+		return nil
+	}
+	err = os.Remove(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(link, name)
+}
+
+// writeFile writes payload to a temporary file next to filename, created
+// with perm, and renames it into place.  The temporary file is removed on
+// any failure so that only a complete filename is ever left behind.  When
+// sync is set the file is flushed to stable storage before the rename and
+// the directory after it so that a crash can not leave a partial filename
+// behind either.
+func writeFile(filename string, payload []byte, perm os.FileMode,
+	sync bool) (err error) {
+
+	out, err := createTemp(filepath.Dir(filename), perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+
+	_, err = out.Write(payload)
+	if err != nil {
+		return err
+	}
+	if sync {
+		err = out.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(out.Name(), filename)
+	if err != nil {
+		return err
+	}
+	if !sync {
+		return nil
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
+
+// createTemp creates a new file with a unique name in dir.  Unlike
+// ioutil.TempFile the file is created with perm, subject to the umask.
+func createTemp(dir string, perm os.FileMode) (*os.File, error) {
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, ".acdb"+strconv.Itoa(rand.Int()))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL,
+			perm)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+
+	return nil, fmt.Errorf("could not create temporary file in %v", dir)
+}
+
+// chmodMode returns the part of mode that os.Chmod applies: the permission
+// bits plus setuid, setgid and sticky.  Type bits are dropped.
+func chmodMode(mode os.FileMode) os.FileMode {
+	return mode.Perm() | mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+}
+
+// depth returns how deeply name is nested: 0 for a top level name, 1 for its
+// children and so on.  Sorting by decreasing depth puts children before
+// their parents.
+func depth(name string) int {
+	return strings.Count(strings.Trim(path.Clean(name), "/"), "/")
+}
+
+// permError returns err if permissions must be restored strictly.
+// Otherwise it warns about and counts err and returns nil.
+func (a *archiver) permError(err error) error {
+	if err == nil || a.StrictPerms {
+		return err
+	}
+
+	fmt.Fprintf(a.Stdout, "warning: %v\n", err)
+	atomic.AddInt64(&a.permFailures, 1)
+
+	return nil
+}
+
+// dirPerms are the permissions and ACLs that are restored on a directory
+// once it was populated.
+type dirPerms struct {
+	dir   metadata.Dir
+	attrs []metadata.Attr
+}
+
+func (a *archiver) extract(e *metadata.File, attrs []metadata.Attr) (bool,
+	error) {
+
+	a.Log(acd.DebugTrace, "[TRC] extract")
+
+	// ensure we have a valid path
+	err := checkPath(a.localPath(e.Name))
+	if err != nil {
+		return false, err
+	}
+	err = os.MkdirAll(filepath.Dir(a.localPath(e.Name)), 0755)
+	if err != nil {
+		return true, err
+	}
+
+	evalpath := a.localPath(e.Name)
+	switch {
+	case a.mode == modeExtract && e.Size == 0:
+		f, err := os.OpenFile(evalpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+			e.Mode.Perm())
+		if err != nil {
+			return true, err
+		}
+		f.Close()
+
+	default:
+		err = a.downloadPayload(e.Name, e.Digest, e.Mode.Perm())
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if a.Perms {
+		// set UID/GID/perms, chown first since it clears setuid/setgid
+		err = a.permError(chown(evalpath, e.Owner, e.Group))
+		if err != nil {
+			return true, err
+		}
+
+		err = a.permError(os.Chmod(evalpath, chmodMode(e.Mode)))
+		if err != nil {
+			return true, err
+		}
+
+		if !e.Created.IsZero() {
+			err = a.permError(setCreated(evalpath, e.Created))
+			if err != nil {
+				return true, err
+			}
+		}
+
+		err = a.permError(os.Chtimes(evalpath, e.Accessed,
+			e.Modified))
+		if err != nil {
+			return true, err
+		}
+	}
+
+	if a.ACLs && len(attrs) != 0 {
+		// after chown which clears capabilities
+		err = setACLs(evalpath, attrs)
+		if err != nil {
+			return false, fmt.Errorf("could not set ACLs: %v", err)
+		}
+	}
+
+	return false, nil
+}
+
+// list reads snapshot Target, from the local file or else from Cloud Drive,
+// and lists or, in extract mode, extracts its entries.
+func (a *archiver) list() error {
+	a.Log(acd.DebugTrace, "[TRC] list %v", a.mode)
+
+	if a.mode == modeExtract {
+		err := a.online()
+		if err != nil {
+			return err
+		}
+	}
+
+	// determine where md resides
+	mdd, err := a.readTarget()
+	if os.IsNotExist(err) {
+		// not localy so try cloud drive
+		err = a.online()
+		if err != nil {
+			return err
+		}
+
+		// get metadata
+		var md []byte
+		md, err = a.downloadMD(a.Target)
+		if err != nil {
+			return err
+		}
+
+		// decrypt
+		mdd, err = DecryptMetadata(md, &a.keys.MD)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.md, err = metadata.NewDecoder(bytes.NewReader(mdd))
+	if err != nil {
+		return err
+	}
+
+	// skip files that were extracted by a previous run
+	var (
+		resumeAt string
+		resuming bool // entries past resumeAt may exist already
+		prog     *progress
+	)
+	if a.mode == modeExtract && a.ResumeFile != "" {
+		rs, err := loadResume(a.ResumeFile)
+		if err != nil {
+			return err
+		}
+		if rs != nil && rs.Target == a.Target && rs.Root == a.Root {
+			resumeAt = rs.Name
+			resuming = true
+		} else if rs != nil {
+			fmt.Fprintf(a.Stdout, "resume state is for %v, "+
+				"starting from the beginning\n", rs.Target)
+		}
+		prog = newProgress(a.ResumeFile, a.Target, a.Root)
+		prog.state.Name = resumeAt
+	}
+
+	// file content is extracted by a pool of workers
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		fatalErr error
+		skipped  bool
+	)
+	type job struct {
+		seq   int
+		file  metadata.File
+		attrs []metadata.Attr
+	}
+	jobs := make(chan job)
+	if a.mode == modeExtract {
+		for i := 0; i < a.Jobs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range jobs {
+					e := j.file
+					fatal, err := a.extract(&e, j.attrs)
+					if err == nil {
+						err = prog.complete(j.seq)
+						fatal = err != nil
+					}
+					if fatal && err != nil {
+						mtx.Lock()
+						if fatalErr == nil {
+							fatalErr = err
+						}
+						mtx.Unlock()
+						continue
+					}
+					if err != nil {
+						fmt.Fprintf(a.Stdout, "could "+
+							"not extract %v: %v\n",
+							e.Name, err)
+						mtx.Lock()
+						skipped = true
+						mtx.Unlock()
+					}
+				}
+			}()
+		}
+	}
+	fatal := func() error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return fatalErr
+	}
+	skip := func(name string, err error) {
+		fmt.Fprintf(a.Stdout, "could not extract %v: %v\n", name, err)
+		mtx.Lock()
+		skipped = true
+		mtx.Unlock()
+	}
+	// setFatal stops the loop so that the workers are shut down below.
+	setFatal := func(err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if fatalErr == nil {
+			fatalErr = err
+		}
+	}
+
+	// files are handed to the workers a window at a time so that their
+	// data nodes can be resolved in bulk
+	var pending []job
+	flush := func() {
+		files := make([]metadata.File, 0, len(pending))
+		for _, v := range pending {
+			files = append(files, v.file)
+		}
+		a.prefetch(files)
+		for _, v := range pending {
+			jobs <- v
+		}
+		pending = pending[:0]
+	}
+
+	var (
+		fullpath string
+		mode     os.FileMode
+		size     int64
+		seq      int
+		xattr    *metadata.Xattr // applies to the next entry
+	)
+	// acls returns the attributes recorded for entry name.
+	acls := func(name string) []metadata.Attr {
+		x := xattr
+		xattr = nil
+		if x == nil || x.Name != name {
+			return nil
+		}
+		return x.Attrs
+	}
+	for fatal() == nil {
+		t, err := a.md.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			close(jobs)
+			wg.Wait()
+			return err
+		}
+
+		switch e := t.(type) {
+		case metadata.Xattr:
+			xattr = &e
+			continue
+
+		case metadata.Dir:
+			attrs := acls(e.Name)
+			if a.mode == modeExtract {
+				var ok bool
+				e.Name, ok = a.stripName(e.Name)
+				if !ok {
+					continue
+				}
+			}
+			fullpath = e.Name
+			mode = e.Mode
+			size = 0
+
+			if a.mode == modeExtract {
+				err := checkPath(a.localPath(fullpath))
+				if err != nil {
+					skip(fullpath, err)
+					continue
+				}
+
+				// owner needs access to populate it, -p
+				// restores the exact mode afterwards
+				err = os.MkdirAll(a.localPath(fullpath),
+					e.Mode.Perm()|0700)
+				if err != nil {
+					setFatal(err)
+					continue
+				}
+
+				if a.Perms || (a.ACLs && len(attrs) != 0) {
+					// set perms after extracting
+					a.permList.PushFront(dirPerms{
+						dir:   e,
+						attrs: attrs,
+					})
+				}
+			}
+
+		case metadata.Symlink:
+			acls(e.Name)
+			if a.mode == modeExtract {
+				var ok bool
+				e.Name, ok = a.stripName(e.Name)
+				if !ok {
+					continue
+				}
+			}
+			if resumeAt != "" {
+				// extracted by a previous run
+				continue
+			}
+			fullpath = e.Name
+			mode = os.ModeSymlink | 0755
+			size = 0
+
+			if a.mode == modeExtract {
+				err := checkPath(a.localPath(fullpath))
+				if err != nil {
+					skip(fullpath, err)
+					continue
+				}
+
+				// the target is recorded verbatim except
+				// in old snapshots
+				link := e.Link
+				if a.md.ResolvedLinks() {
+					link = path.Join(a.Root, e.Link)
+				}
+				err = symlink(link, a.localPath(fullpath),
+					resuming)
+				if err != nil {
+					skip(fullpath, err)
+					continue
+				}
+			}
+
+		case metadata.File:
+			attrs := acls(e.Name)
+			if a.mode == modeExtract {
+				var ok bool
+				e.Name, ok = a.stripName(e.Name)
+				if !ok {
+					continue
+				}
+			}
+			if resumeAt != "" {
+				// extracted by a previous run
+				if e.Name == resumeAt {
+					resumeAt = ""
+				}
+				continue
+			}
+			fullpath = e.Name
+			mode = e.Mode
+			size = e.Size
+
+			if a.mode == modeExtract {
+				prog.add(seq, e.Name)
+				pending = append(pending, job{seq: seq,
+					file: e, attrs: attrs})
+				seq++
+				if len(pending) == acd.ResolveBatch {
+					flush()
+				}
+			}
+
+		default:
+			close(jobs)
+			wg.Wait()
+			return fmt.Errorf("unsupported type: %T", t)
+		}
+
+		a.progress(ProgressEvent{
+			Name: fullpath,
+			Mode: mode,
+			Size: size,
+		})
+	}
+
+	// wait for all files to be extracted
+	if fatal() == nil {
+		flush()
+	}
+	close(jobs)
+	wg.Wait()
+	if err := fatal(); err != nil {
+		return err
+	}
+	if resumeAt != "" {
+		return fmt.Errorf("resume point not found: %v", resumeAt)
+	}
+
+	// set directory permissions deepest first so that children are done
+	// before a restrictive parent mode gets in the way
+	dirs := make([]dirPerms, 0, a.permList.Len())
+	for e := a.permList.Front(); e != nil; e = e.Next() {
+		dp, ok := e.Value.(dirPerms)
+		if !ok {
+			continue
+		}
+		dirs = append(dirs, dp)
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return depth(dirs[i].dir.Name) > depth(dirs[j].dir.Name)
+	})
+	for _, dp := range dirs {
+		ee := dp.dir
+
+		evalpath := a.localPath(ee.Name)
+		if a.Perms {
+			// set UID/GID/perms, chown first since it clears
+			// setgid
+			err = a.permError(chown(evalpath, ee.Owner,
+				ee.Group))
+			if err != nil {
+				return err
+			}
+
+			err = a.permError(os.Chmod(evalpath,
+				chmodMode(ee.Mode)))
+			if err != nil {
+				return err
+			}
+
+			if !ee.Created.IsZero() {
+				err = a.permError(setCreated(evalpath,
+					ee.Created))
+				if err != nil {
+					return err
+				}
+			}
+
+			err = a.permError(os.Chtimes(evalpath, ee.Accessed,
+				ee.Modified))
+			if err != nil {
+				return err
+			}
+		}
+
+		if a.ACLs && len(dp.attrs) != 0 {
+			// after chown which clears capabilities
+			err = setACLs(evalpath, dp.attrs)
+			if err != nil {
+				return fmt.Errorf("%v: could not set ACLs: %v",
+					ee.Name, err)
+			}
+		}
+	}
+
+	if n := atomic.LoadInt64(&a.permFailures); n != 0 {
+		fmt.Fprintf(a.Stderr, "could not restore permissions, "+
+			"ownership or times %v times\n", n)
+	}
+	if skipped {
+		return ErrSkipped
+	}
+
+	if prog != nil {
+		return removeResume(a.ResumeFile)
+	}
+
+	return nil
+}
+
+// downloadMD returns the remote metadata blob called name.
+func (a *archiver) downloadMD(name string) ([]byte, error) {
+	a.Log(acd.DebugTrace, "[TRC] downloadMD %v", name)
+
+	asset, err := a.c.GetMetadataFS(MetadataName + "/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("remote metadata %v: not found", name)
+	}
+	a.Log(acd.DebugTrace, "[TRC] found asset: %v -> %v\n",
+		asset.ID,
+		asset.Name)
+	blob, err := a.c.DownloadJSON(asset.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+// DecryptMetadata decrypts metadata blob md with key.
+func DecryptMetadata(md []byte, key *[shared.KeySize]byte) ([]byte, error) {
+	if len(md) < shared.NonceSize+secretbox.Overhead {
+		return nil, fmt.Errorf("metadata too short: %v", len(md))
+	}
+	var nonce [shared.NonceSize]byte
+	copy(nonce[:], md[:shared.NonceSize])
+	mdd, ok := secretbox.Open(nil, md[shared.NonceSize:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("could not decrypt metadata")
+	}
+
+	return mdd, nil
+}
@@ -0,0 +1,1009 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/acd/token"
+	"github.com/marcopeereboom/acdb/internal/random"
+	"github.com/marcopeereboom/acdb/metadata"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// testKeys returns fixed keys so that tests do not depend on randomness.
+func testKeys() *shared.Keys {
+	var k shared.Keys
+	for i := range k.MD {
+		k.MD[i] = byte(i)
+		k.Data[i] = byte(i + 1)
+		k.Dedup[i] = byte(i + 2)
+	}
+	return &k
+}
+
+// testTree creates a synthetic tree with files of various sizes, nested and
+// empty directories, symlinks and zero sized files in dir/tree.
+func testTree(t *testing.T, dir string) {
+	t.Helper()
+
+	random := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	files := map[string][]byte{
+		"tree/small":           []byte("hello world\n"),
+		"tree/empty":           nil,
+		"tree/a/text":          bytes.Repeat([]byte("compressible "), 10000),
+		"tree/a/b/random":      random,
+		"tree/a/b/c/duplicate": []byte("hello world\n"),
+		"tree/a/b/c/empty":     nil,
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(filename), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filename, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.MkdirAll(filepath.Join(dir, "tree/emptydir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"tree/link":     "small",
+		"tree/a/uplink": "../small",
+		"tree/dirlink":  "a/b",
+	} {
+		err = os.Symlink(target, filepath.Join(dir, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// treeEntry describes an entry of a tree for comparison.
+type treeEntry struct {
+	mode    os.FileMode
+	content []byte // regular files
+	link    string // symlinks
+}
+
+// readTree returns the entries below root keyed by their relative path.
+func readTree(t *testing.T, root string) map[string]treeEntry {
+	t.Helper()
+
+	entries := make(map[string]treeEntry)
+	err := filepath.Walk(root, func(p string, fi os.FileInfo,
+		err error) error {
+
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		e := treeEntry{mode: fi.Mode().Type()}
+		switch {
+		case fi.Mode().IsRegular():
+			e.content, err = ioutil.ReadFile(p)
+		case fi.Mode()&os.ModeSymlink != 0:
+			e.link, err = os.Readlink(p)
+		}
+		entries[filepath.ToSlash(rel)] = e
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return entries
+}
+
+// compareTrees fails t unless the trees below want and got are identical.
+func compareTrees(t *testing.T, want, got string) {
+	t.Helper()
+
+	w := readTree(t, want)
+	g := readTree(t, got)
+	var names []string
+	for k := range w {
+		names = append(names, k)
+	}
+	for k := range g {
+		if _, ok := w[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		we, wok := w[name]
+		ge, gok := g[name]
+		switch {
+		case !wok:
+			t.Errorf("%v: unexpected entry", name)
+		case !gok:
+			t.Errorf("%v: missing", name)
+		case we.mode != ge.mode:
+			t.Errorf("%v: mode %v, want %v", name, ge.mode, we.mode)
+		case !bytes.Equal(we.content, ge.content):
+			t.Errorf("%v: content differs", name)
+		case we.link != ge.link:
+			t.Errorf("%v: link %q, want %q", name, ge.link, we.link)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		local bool // write the snapshot to a local file
+		o     Options
+	}{
+		{name: "default"},
+		{name: "compressed", o: Options{Compress: true}},
+		{name: "parallel", o: Options{Compress: true, BlockSize: 1 << 17,
+			Blocks: 4}},
+		{name: "blake2b", o: Options{Digest: shared.DigestBLAKE2b}},
+		{name: "local", local: true},
+		{name: "plain", local: true, o: Options{PlainMetadata: true}},
+		{name: "split", local: true, o: Options{Split: 256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := t.TempDir()
+			testTree(t, src)
+			c := acd.NewMemoryBackend()
+			keys := testKeys()
+
+			o := tt.o
+			o.Stdout = ioutil.Discard
+			o.Paths = []string{filepath.Join(src, "tree")}
+			o.Base = src
+			if tt.local {
+				o.Target = filepath.Join(t.TempDir(), "snapshot")
+			}
+			s, err := Backup(c, keys, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Files != 6 || s.New != 3 || s.Deduped != 1 ||
+				s.Symlinks != 3 || s.Skipped != 0 {
+				t.Fatalf("summary %+v", s)
+			}
+			target := o.Target
+			if target == "" {
+				target = s.Snapshot
+			}
+
+			var names []string
+			err = List(c, keys, &Options{
+				Target: target,
+				Stdout: ioutil.Discard,
+				Progress: func(ev ProgressEvent) {
+					names = append(names, ev.Name)
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for k := range readTree(t, src) {
+				if k != "." {
+					want = append(want, k)
+				}
+			}
+			sort.Strings(want)
+			sort.Strings(names)
+			if len(names) != len(want) {
+				t.Fatalf("listed %v, want %v", names, want)
+			}
+			for k := range want {
+				if names[k] != want[k] {
+					t.Fatalf("listed %v, want %v", names, want)
+				}
+			}
+
+			dst := t.TempDir()
+			err = Restore(c, keys, &Options{
+				Target: target,
+				Root:   dst,
+				Stdout: ioutil.Discard,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			compareTrees(t, src, dst)
+		})
+	}
+}
+
+// dirNames returns the names in dir.
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range fis {
+		names = append(names, v.Name())
+	}
+	return names
+}
+
+func TestWriteTarget(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "archive")
+	a := archiver{
+		Options: Options{Target: target, Split: 40},
+		keys:    testKeys(),
+	}
+	write := func(md string) error {
+		b, err := SealMetadata([]byte(md), &a.keys.MD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a.writeTarget(b)
+	}
+	read := func(want string) {
+		t.Helper()
+		md, err := a.readTarget()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(md) != want {
+			t.Fatalf("got %q, want %q", md, want)
+		}
+	}
+
+	// shrinking a split archive removes the parts that are left over
+	err := write(strings.Repeat("long", 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dirNames(t, dir); len(got) != 3 {
+		t.Fatalf("got %v", got)
+	}
+	err = write("short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dirNames(t, dir); len(got) != 2 {
+		t.Fatalf("got %v", got)
+	}
+	read("short")
+
+	// a failed replace leaves no temporary files behind
+	busy := filepath.Join(dir, "archive.001")
+	err = os.Remove(busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(busy, "busy"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = write(strings.Repeat("long", 20)); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := dirNames(t, dir); len(got) != 2 {
+		t.Fatalf("got %v", got)
+	}
+	err = os.RemoveAll(busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unsplit archive replaces the parts and the other way around
+	a.Split = 0
+	err = write("whole")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dirNames(t, dir); len(got) != 1 || got[0] != "archive" {
+		t.Fatalf("got %v", got)
+	}
+	read("whole")
+	a.Split = 40
+	err = write("parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dirNames(t, dir); len(got) != 2 || got[0] != "archive.000" {
+		t.Fatalf("got %v", got)
+	}
+	read("parts")
+}
+
+func TestSymlinks(t *testing.T) {
+	src := t.TempDir()
+	links := map[string]string{
+		"tree/dangling": "missing/target",
+		"tree/self":     "self",
+		"tree/loop1":    "loop2",
+		"tree/loop2":    "loop1",
+		"tree/absolute": "/nonexistent/acdb",
+	}
+	err := os.MkdirAll(filepath.Join(src, "tree"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range links {
+		err = os.Symlink(target, filepath.Join(src, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := acd.NewMemoryBackend()
+	keys := testKeys()
+	s, err := Backup(c, keys, &Options{
+		Stdout: ioutil.Discard,
+		Paths:  []string{filepath.Join(src, "tree")},
+		Base:   src,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Symlinks != len(links) {
+		t.Fatalf("archived %v symlinks, want %v", s.Symlinks, len(links))
+	}
+
+	dst := t.TempDir()
+	err = Restore(c, keys, &Options{
+		Target: s.Snapshot,
+		Root:   dst,
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, src, dst)
+}
+
+func TestResolvedLinks(t *testing.T) {
+	var b bytes.Buffer
+	me, err := metadata.NewEncoder(&b, gzip.NoCompression,
+		shared.DigestSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = me.SymlinkTarget("tree/link", "tree/target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = me.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the version follows the magic in the header
+	md := b.Bytes()
+	binary.BigEndian.PutUint32(md[4:8], 6)
+
+	keys := testKeys()
+	blob, err := SealMetadata(md, &keys.MD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(t.TempDir(), "archive")
+	err = ioutil.WriteFile(target, blob, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream carries no directory entry
+	dst := t.TempDir()
+	err = os.Mkdir(filepath.Join(dst, "tree"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Restore(acd.NewMemoryBackend(), keys, &Options{
+		Target: target,
+		Root:   dst,
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := os.Readlink(filepath.Join(dst, "tree", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := path.Join(dst, "tree/target"); link != want {
+		t.Fatalf("got %v, want %v", link, want)
+	}
+}
+
+// fixedRandom makes random.Reader reproducible for the duration of t.
+func fixedRandom(t *testing.T) {
+	old := random.Reader
+	random.Reader = rand.New(rand.NewSource(1))
+	t.Cleanup(func() { random.Reader = old })
+}
+
+func TestDeterministic(t *testing.T) {
+	src := t.TempDir()
+	testTree(t, src)
+
+	// settle the access times of the symlinks, which are read once
+	readTree(t, src)
+
+	c := acd.NewMemoryBackend()
+	keys := testKeys()
+	snapshot := func(plain bool) []byte {
+		t.Helper()
+
+		// the walk records the times of an entry before reading it
+		mtime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		atime := time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC)
+		err := filepath.Walk(src, func(p string, fi os.FileInfo,
+			err error) error {
+
+			if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+				return err
+			}
+			return os.Chtimes(p, atime, mtime)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fixedRandom(t)
+		target := filepath.Join(t.TempDir(), "snapshot")
+		_, err = Backup(c, keys, &Options{
+			Stdout:        ioutil.Discard,
+			Paths:         []string{filepath.Join(src, "tree")},
+			Base:          src,
+			Target:        target,
+			PlainMetadata: plain,
+			Compress:      true,
+			BlockSize:     1 << 17,
+			Blocks:        4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	for _, plain := range []bool{true, false} {
+		if !bytes.Equal(snapshot(plain), snapshot(plain)) {
+			t.Fatalf("plain %v: snapshots differ", plain)
+		}
+	}
+}
+
+func TestSealMetadataGolden(t *testing.T) {
+	fixedRandom(t)
+	keys := testKeys()
+	md := bytes.Repeat([]byte("metadata stream "), 1024)
+	b, err := SealMetadata(md, &keys.MD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(b)
+	want := "b9d455102c595293167f940d1dca37b2" +
+		"5ea9357d87a6da0710d3f180be74606f"
+	if got := hex.EncodeToString(sum[:]); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	got, err := DecryptMetadata(b, &keys.MD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, md) {
+		t.Fatal("metadata differs")
+	}
+}
+
+// blockingBackend is a MemoryBackend whose uploads block until the context
+// they were bound to with WithContext is done.
+type blockingBackend struct {
+	*acd.MemoryBackend
+	ctx     context.Context
+	started chan struct{} // closed once an upload blocks
+	once    *sync.Once
+}
+
+func newBlockingBackend() *blockingBackend {
+	return &blockingBackend{
+		MemoryBackend: acd.NewMemoryBackend(),
+		started:       make(chan struct{}),
+		once:          new(sync.Once),
+	}
+}
+
+func (b *blockingBackend) WithContext(ctx context.Context) acd.Backend {
+	bb := *b
+	bb.ctx = ctx
+	return &bb
+}
+
+func (b *blockingBackend) UploadNode(parent string, node *acd.NodeJSON,
+	payload []byte) (*acd.Asset, error) {
+
+	if b.ctx == nil {
+		return b.MemoryBackend.UploadNode(parent, node, payload)
+	}
+	b.once.Do(func() { close(b.started) })
+	<-b.ctx.Done()
+	return nil, b.ctx.Err()
+}
+
+func TestDeadlineAbortsUpload(t *testing.T) {
+	src := t.TempDir()
+	testTree(t, src)
+
+	c := newBlockingBackend()
+	start := time.Now()
+	s, err := Backup(c, testKeys(), &Options{
+		Stdout:   ioutil.Discard,
+		Paths:    []string{filepath.Join(src, "tree")},
+		Base:     src,
+		Deadline: start.Add(100 * time.Millisecond),
+	})
+	if err != ErrDeadline {
+		t.Fatalf("got %v, want %v", err, ErrDeadline)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("upload was not aborted")
+	}
+	if s.New != 0 || s.Skipped != 0 {
+		t.Fatalf("summary %+v", s)
+	}
+	if !strings.HasSuffix(s.Snapshot, partialSuffix) {
+		t.Fatalf("snapshot %v", s.Snapshot)
+	}
+}
+
+func TestCancelAbortsUpload(t *testing.T) {
+	src := t.TempDir()
+	testTree(t, src)
+
+	c := newBlockingBackend()
+	r, err := Start(context.Background(), c, testKeys(), &Options{
+		Stdout: ioutil.Discard,
+		Paths:  []string{filepath.Join(src, "tree")},
+		Base:   src,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-c.started
+	r.Cancel()
+	s, err := r.Wait()
+	if err != ErrCanceled {
+		t.Fatalf("got %v, want %v", err, ErrCanceled)
+	}
+	if s.New != 0 || s.Skipped != 0 {
+		t.Fatalf("summary %+v", s)
+	}
+	if !strings.HasSuffix(s.Snapshot, partialSuffix) {
+		t.Fatalf("snapshot %v", s.Snapshot)
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	tests := []struct {
+		path     string
+		absolute bool
+		want     string
+	}{
+		{path: "x/y", want: "x/y"},
+		{path: "./x", want: "x"},
+		{path: "/etc/hosts", want: "etc/hosts"},
+		{path: "/", want: "."},
+		{path: "..", want: "."},
+		{path: "../x", want: "x"},
+		{path: "../../x/y", want: "x/y"},
+		{path: "a/../../b", want: "b"},
+		{path: "..x/y", want: "..x/y"},
+		{path: "/../x", want: "x"},
+		{path: "/etc/hosts", absolute: true, want: "/etc/hosts"},
+		{path: "../x", absolute: true, want: "../x"},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests, []struct {
+			path     string
+			absolute bool
+			want     string
+		}{
+			{path: `C:\data\x`, want: "data/x"},
+			{path: `C:data\x`, want: "data/x"},
+			{path: `C:\`, want: "."},
+			{path: `\\server\share\x`, want: "x"},
+			{path: `C:\data\x`, absolute: true, want: "C:/data/x"},
+		}...)
+	}
+	for _, tt := range tests {
+		a := archiver{Options: Options{Absolute: tt.absolute}}
+		got := a.archiveName(filepath.FromSlash(tt.path))
+		if got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSourceArguments(t *testing.T) {
+	src := t.TempDir()
+	testTree(t, src)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(filepath.Join(src, "tree", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := os.Chdir(wd)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// a relative argument that climbs out of the working directory and
+	// an absolute one
+	abs := filepath.Join(src, "tree", "a", "text")
+	c := acd.NewMemoryBackend()
+	keys := testKeys()
+	var out bytes.Buffer
+	s, err := Backup(c, keys, &Options{
+		Stdout: &out,
+		Paths:  []string{"../small", abs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"removing leading '/'",
+		"removing leading '../'"} {
+		if !strings.Contains(out.String(), v) {
+			t.Fatalf("%q not in %q", v, out.String())
+		}
+	}
+
+	dst := t.TempDir()
+	err = Restore(c, keys, &Options{
+		Target: s.Snapshot,
+		Root:   dst,
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readTree(t, dst)
+	rel := strings.TrimLeft(filepath.ToSlash(abs), "/")
+	if string(got["small"].content) != "hello world\n" ||
+		!bytes.Equal(got[rel].content, bytes.Repeat([]byte("compressible "),
+			10000)) {
+		var names []string
+		for k := range got {
+			names = append(names, k)
+		}
+		t.Fatalf("extracted %v", names)
+	}
+}
+
+func TestReadOnlyDirs(t *testing.T) {
+	src := t.TempDir()
+	modes := map[string]os.FileMode{
+		"ro":       0555,
+		"ro/a":     0500,
+		"ro/a/b":   0555,
+		"ro/a/b/c": 0500,
+	}
+	err := os.MkdirAll(filepath.Join(src, "ro/a/b/c"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(src, "ro/a/b/c/file"),
+		[]byte("read only\n"), 0444)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for k := range modes {
+		dirs = append(dirs, k)
+	}
+	sort.Strings(dirs)
+
+	// unlock parents first so that the temporary dirs can be removed
+	unlock := func(root string) {
+		t.Cleanup(func() {
+			for _, v := range dirs {
+				_ = os.Chmod(filepath.Join(root, v), 0755)
+			}
+		})
+	}
+	unlock(src)
+	for k := len(dirs) - 1; k >= 0; k-- {
+		err := os.Chmod(filepath.Join(src, dirs[k]), modes[dirs[k]])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := acd.NewMemoryBackend()
+	keys := testKeys()
+	s, err := Backup(c, keys, &Options{
+		Paths:  []string{filepath.Join(src, "ro")},
+		Base:   src,
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	unlock(dst)
+	err = Restore(c, keys, &Options{
+		Target:      s.Snapshot,
+		Root:        dst,
+		Perms:       true,
+		StrictPerms: true,
+		Stdout:      ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, src, dst)
+	for _, v := range dirs {
+		fi, err := os.Stat(filepath.Join(dst, v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != modes[v] {
+			t.Errorf("%v: mode %v, want %v", v, fi.Mode().Perm(),
+				modes[v])
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		err     error
+		want    error
+		calls   int
+	}{
+		{"disabled", 0, token.ErrRefreshUnavailable,
+			token.ErrRefreshUnavailable, 1},
+		{"retried", 1, token.ErrRefreshUnavailable,
+			token.ErrRefreshUnavailable, 2},
+		{"rejected", 1, token.ErrRefreshRejected, ErrTokenRejected, 1},
+		{"permanent", 1, acd.ErrNotFound, acd.ErrNotFound, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &archiver{ctx: context.Background()}
+			a.Retries = tt.retries
+			a.Stderr = ioutil.Discard
+			calls := 0
+			err := a.retry(func() error {
+				calls++
+				return tt.err
+			})
+			if err != tt.want || calls != tt.calls {
+				t.Fatalf("got %v after %v calls, want %v after %v",
+					err, calls, tt.want, tt.calls)
+			}
+		})
+	}
+}
+
+// noResolveBackend is a MemoryBackend that can not resolve names in bulk.
+type noResolveBackend struct {
+	*acd.MemoryBackend
+}
+
+func (b noResolveBackend) ResolveNames(parent string,
+	names []string) (map[string]string, error) {
+
+	return nil, errors.New("not supported")
+}
+
+func TestPrefetchRequests(t *testing.T) {
+	const files = 3*acd.ResolveBatch + 1
+	src := t.TempDir()
+	for i := 0; i < files; i++ {
+		filename := filepath.Join(src, "many", strconv.Itoa(i))
+		err := os.MkdirAll(filepath.Dir(filename), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filename, []byte(filename), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := acd.NewMemoryBackend()
+	keys := testKeys()
+	s, err := Backup(m, keys, &Options{
+		Paths:  []string{filepath.Join(src, "many")},
+		Base:   src,
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := func(c acd.Backend) int64 {
+		t.Helper()
+
+		before := m.Stats().Requests
+		dst := t.TempDir()
+		err := Restore(c, keys, &Options{
+			Target: s.Snapshot,
+			Root:   dst,
+			Stdout: ioutil.Discard,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compareTrees(t, src, dst)
+		return m.Stats().Requests - before
+	}
+	single := restore(noResolveBackend{m})
+	bulk := restore(m)
+
+	// a lookup per file turns into a request per batch
+	batches := int64((files + acd.ResolveBatch - 1) / acd.ResolveBatch)
+	if single-bulk != files-batches {
+		t.Fatalf("%v requests with prefetching, %v without", bulk,
+			single)
+	}
+}
+
+func TestRestoreMkdirError(t *testing.T) {
+	src := t.TempDir()
+	testTree(t, src)
+	c := acd.NewMemoryBackend()
+	keys := testKeys()
+	s, err := Backup(c, keys, &Options{
+		Paths:  []string{filepath.Join(src, "tree")},
+		Base:   src,
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a file where a directory goes
+	dst := t.TempDir()
+	err = os.MkdirAll(filepath.Join(dst, "tree"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dst, "tree/a"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	err = Restore(c, keys, &Options{
+		Target: s.Snapshot,
+		Root:   dst,
+		Jobs:   8,
+		Stdout: ioutil.Discard,
+	})
+	if err == nil {
+		t.Fatal("restore succeeded")
+	}
+	// the workers are gone once Restore returns
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%v goroutines, %v before", n, before)
+	}
+}
+
+func TestResumeSymlinks(t *testing.T) {
+	// files and the links to them alternate in metadata order
+	src := t.TempDir()
+	dir := filepath.Join(src, "links")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		name := "f" + strconv.Itoa(i)
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name),
+			0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Symlink(name, filepath.Join(dir, name+".link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := acd.NewMemoryBackend()
+	keys := testKeys()
+	s, err := Backup(c, keys, &Options{
+		Paths:  []string{dir},
+		Base:   src,
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	resume := filepath.Join(t.TempDir(), "resume")
+	o := Options{
+		Target:     s.Snapshot,
+		Root:       dst,
+		ResumeFile: resume,
+		Stdout:     ioutil.Discard,
+	}
+	err = Restore(c, keys, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fake a run that was interrupted after f3 while the links ahead of
+	// the workers were all created, one with a stale target
+	for i := 4; i < 10; i++ {
+		err = os.Remove(filepath.Join(dst, "links/f"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale := filepath.Join(dst, "links/f7.link")
+	err = os.Remove(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("elsewhere", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := resumeState{Target: s.Snapshot, Root: dst, Name: "links/f3"}
+	err = rs.save(resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore(c, keys, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, src, dst)
+}
+
+func TestValidateACLs(t *testing.T) {
+	err := (&Options{ACLs: true}).Validate()
+	if aclsSupported && err != nil {
+		t.Fatal(err)
+	}
+	if !aclsSupported && err != errACLs {
+		t.Fatalf("got %v, want %v", err, errACLs)
+	}
+}
@@ -0,0 +1,13 @@
+package backup
+
+import (
+	"os"
+	"time"
+)
+
+// setCreated sets the birth time of path.  The file system lowers the birth
+// time to the modification time when the latter is older, so this must be
+// followed by setting the real times.
+func setCreated(path string, created time.Time) error {
+	return os.Chtimes(path, created, created)
+}
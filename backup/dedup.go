@@ -0,0 +1,35 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// digestSet is a set of dedup digests that is safe for concurrent use.  It
+// remembers which payloads are already stored so that identical files within
+// a single run do not cost a round trip each.
+type digestSet struct {
+	sync.Mutex
+
+	digests map[[sha256.Size]byte]struct{}
+}
+
+// add adds digest to the set.
+func (s *digestSet) add(digest *[sha256.Size]byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.digests == nil {
+		s.digests = make(map[[sha256.Size]byte]struct{})
+	}
+	s.digests[*digest] = struct{}{}
+}
+
+// has returns true if digest was added to the set.
+func (s *digestSet) has(digest *[sha256.Size]byte) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.digests[*digest]
+	return ok
+}
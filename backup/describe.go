@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// Version identifies the backup engine in snapshot descriptions.
+const Version = "1.0"
+
+// maxDescription is the longest node description the cloud drive accepts.
+const maxDescription = 500
+
+// Description identifies a snapshot without downloading it.  It is stored in
+// the description of the snapshot node, encrypted with the metadata key like
+// the snapshot itself, since names and paths are as private as the content.
+type Description struct {
+	Host      string   `json:"host,omitempty"`      // machine backed up
+	Paths     []string `json:"paths,omitempty"`     // paths archived
+	MorePaths int      `json:"morePaths,omitempty"` // paths left out
+	Files     int      `json:"files"`               // regular files archived
+	Version   string   `json:"version"`             // backup engine
+}
+
+// description returns the encrypted description of the snapshot that is
+// being stored.  Paths are left out as needed to fit.
+func (a *archiver) description() (string, error) {
+	host, _ := os.Hostname()
+	d := Description{
+		Host:    host,
+		Paths:   a.Paths,
+		Files:   a.stats.Files,
+		Version: Version,
+	}
+	for {
+		s, err := EncodeDescription(&d, &a.keys.MD)
+		if err != nil || len(s) <= maxDescription {
+			return s, err
+		}
+		if len(d.Paths) == 0 {
+			// a very long host name
+			return "", nil
+		}
+		d.Paths = d.Paths[:len(d.Paths)-1]
+		d.MorePaths++
+	}
+}
+
+// EncodeDescription encrypts d with key and returns it as a node description.
+func EncodeDescription(d *Description, key *[shared.KeySize]byte) (string,
+	error) {
+
+	j, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := shared.NaClNonce()
+	if err != nil {
+		return "", err
+	}
+	b := secretbox.Seal(nonce[:], j, nonce, key)
+
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// DecodeDescription decrypts a node description that was encoded with key.
+func DecodeDescription(s string, key *[shared.KeySize]byte) (*Description,
+	error) {
+
+	b, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	j, err := DecryptMetadata(b, key)
+	if err != nil {
+		return nil, err
+	}
+	var d Description
+	err = json.Unmarshal(j, &d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Estimate returns the number and size of the regular files Backup would
+// read for o.Paths.  The size is an upper bound of what is uploaded since
+// payloads are deduplicated and compressed.  Files that can not be read are
+// left out, as are the ones Backup excludes or skips for being larger than
+// o.MaxSize.  A tar stream can not be estimated without consuming it.
+func Estimate(o *Options) (files int, size int64, err error) {
+	eo := *o
+	eo.Stdout = ioutil.Discard
+	eo.Progress = nil
+	a, err := newArchiver(nil, nil, &eo, modeEstimate)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var walk filepath.WalkFunc
+	walk = func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Backup reports these
+			return nil
+		}
+		if a.excluded(path, info) != nil {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink == os.ModeSymlink && a.Follow:
+			return a.followSymlink(path, walk)
+		case !info.Mode().IsRegular():
+		case a.MaxSize > 0 && info.Size() > a.MaxSize:
+		default:
+			files++
+			size += info.Size()
+		}
+		return nil
+	}
+	for _, v := range a.Paths {
+		err = a.walkPath(v, walk)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return files, size, nil
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/marcopeereboom/acdb/acd"
+)
+
+func TestEstimate(t *testing.T) {
+	src := t.TempDir()
+	testTree(t, src)
+	err := ioutil.WriteFile(filepath.Join(src, "tree/a/b/.nobackup"), nil,
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := filepath.Join(src, "tree")
+
+	tests := []struct {
+		name  string
+		o     Options
+		files int
+		size  int64
+	}{
+		{name: "all", files: 7, size: 12 + 130000 + 3<<20 + 12},
+		{name: "marker", o: Options{ExcludeIfPresent: []string{
+			".nobackup"}}, files: 3, size: 12 + 130000},
+		{name: "own", o: Options{Own: []string{filepath.Join(tree,
+			"small")}}, files: 6, size: 130000 + 3<<20 + 12},
+		{name: "follow", o: Options{Follow: true}, files: 13,
+			size: 3*12 + 130000 + 2*(3<<20) + 2*12},
+		{name: "max size", o: Options{MaxSize: 1 << 20}, files: 6,
+			size: 12 + 130000 + 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := tt.o
+			o.Paths = []string{tree}
+			o.Base = src
+			files, size, err := Estimate(&o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files != tt.files || size != tt.size {
+				t.Fatalf("got %v files of %v bytes, want %v of %v",
+					files, size, tt.files, tt.size)
+			}
+
+			// Backup reads the same files
+			o.Stdout = ioutil.Discard
+			s, err := Backup(acd.NewMemoryBackend(), testKeys(), &o)
+			if err != nil && err != ErrSkipped {
+				t.Fatal(err)
+			}
+			if s.Files != files {
+				t.Fatalf("estimated %v files, archived %v", files,
+					s.Files)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CACHEDIR.TAG marks a cache directory, see https://bford.info/cachedir/.
+// Only tags that start with the signature count.
+const (
+	cacheDirTag       = "CACHEDIR.TAG"
+	cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// validMarkers returns true if names can be used as Options.ExcludeIfPresent.
+func validMarkers(names []string) bool {
+	for _, v := range names {
+		if v == "" || v == "." || v == ".." ||
+			strings.ContainsAny(v, "/\\") {
+			return false
+		}
+	}
+	return true
+}
+
+// excluded returns why the entry at path is left out, or nil if it is
+// archived.  Directories are left out along with their contents.
+func (a *archiver) excluded(path string, info os.FileInfo) error {
+	if a.isOwn(path) {
+		return errors.New("file of acdbackup")
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	if a.OneFS {
+		if dev, ok := deviceID(info); ok && dev != a.dev {
+			return errors.New("different file system")
+		}
+	}
+
+	return a.excludedDir(path)
+}
+
+// excludedDir returns why directory path is left out, or nil if it is
+// archived.
+func (a *archiver) excludedDir(path string) error {
+	for _, v := range a.ExcludeIfPresent {
+		_, err := os.Lstat(filepath.Join(path, v))
+		if err == nil {
+			return fmt.Errorf("contains %v", v)
+		}
+	}
+	if a.ExcludeCaches && isCacheDir(path) {
+		return errors.New("cache directory")
+	}
+
+	return nil
+}
+
+// isCacheDir returns true if dir holds a valid CACHEDIR.TAG.
+func isCacheDir(dir string) bool {
+	f, err := os.Open(filepath.Join(dir, cacheDirTag))
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	b := make([]byte, len(cacheDirSignature))
+	_, err = io.ReadFull(f, b)
+
+	return err == nil && string(b) == cacheDirSignature
+}
+
+// abs returns path as a clean absolute path without asking the operating
+// system for the working directory every time.
+func (a *archiver) abs(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(a.cwd, path)
+}
+
+// isOwn returns true if path is one of the Own files or directories or a
+// split part of one.
+func (a *archiver) isOwn(path string) bool {
+	if len(a.own) == 0 {
+		return false
+	}
+	path = a.abs(path)
+	for _, v := range a.own {
+		if path == v {
+			return true
+		}
+		// name.000, name.001 and so on, see partName
+		if !strings.HasPrefix(path, v+".") {
+			continue
+		}
+		part := path[len(v)+1:]
+		if len(part) >= 3 && strings.Trim(part, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/marcopeereboom/acdb/metadata"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// Index records the versions of every file in a set of snapshots so that
+// the snapshots that hold a file can be found without downloading and
+// decoding all of them.  It is stored locally, encrypted with the metadata
+// key since it holds all file names.
+type Index struct {
+	Metadata  string                  // metadata folder id of the snapshots
+	Snapshots []string                // indexed snapshots, in indexing order
+	Files     map[string][]IndexEntry // path to versions
+}
+
+// IndexEntry is a version of a file.
+type IndexEntry struct {
+	Snapshot int // into Index.Snapshots
+	Digest   [sha256.Size]byte
+	Size     int64
+	Modified time.Time
+}
+
+// IndexMatch is a version of a file found by Find.
+type IndexMatch struct {
+	Name     string
+	Snapshot string
+	Digest   [sha256.Size]byte
+	Size     int64
+	Modified time.Time
+}
+
+// NewIndex returns an empty index of the snapshots in metadata folder
+// metadataID.
+func NewIndex(metadataID string) *Index {
+	return &Index{
+		Metadata: metadataID,
+		Files:    make(map[string][]IndexEntry),
+	}
+}
+
+// LoadIndex reads the index in filename and decrypts it with key.  It
+// returns an error that satisfies os.IsNotExist if there is no index.
+func LoadIndex(filename string, key *[shared.KeySize]byte) (*Index, error) {
+	blob, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	b, err := DecryptMetadata(blob, key)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var ix Index
+	err = gob.NewDecoder(zr).Decode(&ix)
+	if err != nil {
+		return nil, err
+	}
+	if ix.Files == nil {
+		ix.Files = make(map[string][]IndexEntry)
+	}
+
+	return &ix, nil
+}
+
+// Save encrypts the index with key and replaces filename with it.
+func (ix *Index) Save(filename string, key *[shared.KeySize]byte) error {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	err := gob.NewEncoder(zw).Encode(ix)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	blob, err := SealMetadata(b.Bytes(), key)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filename, blob, 0600, true)
+}
+
+// Has returns true if snapshot name is indexed.
+func (ix *Index) Has(name string) bool {
+	for _, v := range ix.Snapshots {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Add indexes the files in snapshot name, md is its decrypted metadata
+// stream.
+func (ix *Index) Add(name string, md []byte) error {
+	d, err := metadata.NewDecoder(bytes.NewReader(md))
+	if err != nil {
+		return err
+	}
+
+	// the snapshot is only recorded once it was decoded completely
+	n := len(ix.Snapshots)
+	files := make(map[string]IndexEntry)
+	for {
+		t, err := d.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if f, ok := t.(metadata.File); ok {
+			files[f.Name] = IndexEntry{
+				Snapshot: n,
+				Digest:   f.Digest,
+				Size:     f.Size,
+				Modified: f.Modified,
+			}
+		}
+	}
+	ix.Snapshots = append(ix.Snapshots, name)
+	for k, v := range files {
+		ix.Files[k] = append(ix.Files[k], v)
+	}
+
+	return nil
+}
+
+// Retain drops the snapshots that are not in names, e.g. because they were
+// trashed.
+func (ix *Index) Retain(names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, v := range names {
+		keep[v] = true
+	}
+
+	// renumber the remaining snapshots
+	renumber := make(map[int]int)
+	var snapshots []string
+	for k, v := range ix.Snapshots {
+		if keep[v] {
+			renumber[k] = len(snapshots)
+			snapshots = append(snapshots, v)
+		}
+	}
+	if len(snapshots) == len(ix.Snapshots) {
+		return
+	}
+	ix.Snapshots = snapshots
+
+	for k, v := range ix.Files {
+		var entries []IndexEntry
+		for _, e := range v {
+			n, ok := renumber[e.Snapshot]
+			if !ok {
+				continue
+			}
+			e.Snapshot = n
+			entries = append(entries, e)
+		}
+		if len(entries) == 0 {
+			delete(ix.Files, k)
+		} else {
+			ix.Files[k] = entries
+		}
+	}
+}
+
+// Find returns all versions of the files whose path or base name matches
+// the shell pattern, see path.Match.  The matches are sorted by path and
+// then in indexing order.
+func (ix *Index) Find(pattern string) ([]IndexMatch, error) {
+	// report a bad pattern even if nothing is indexed
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for k := range ix.Files {
+		ok, _ := path.Match(pattern, k)
+		if !ok {
+			ok, _ = path.Match(pattern, path.Base(k))
+		}
+		if ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	var matches []IndexMatch
+	for _, name := range names {
+		for _, v := range ix.Files[name] {
+			matches = append(matches, IndexMatch{
+				Name:     name,
+				Snapshot: ix.Snapshots[v.Snapshot],
+				Digest:   v.Digest,
+				Size:     v.Size,
+				Modified: v.Modified,
+			})
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/marcopeereboom/acdb/metadata"
+	"github.com/marcopeereboom/acdb/shared"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// SealMetadata encrypts the metadata stream md with key the way snapshots
+// are stored: a nonce followed by the secretbox.
+func SealMetadata(md []byte, key *[shared.KeySize]byte) ([]byte, error) {
+	nonce, err := shared.NaClNonce()
+	if err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], md, nonce, key), nil
+}
+
+// writeTarget replaces the local archive with b, in parts when it is split.
+// The archive is replaced atomically, a failure leaves the previous archive
+// as it was.
+func (a *archiver) writeTarget(b []byte) error {
+	if a.Split > 0 {
+		return writeSplit(a.Target, b, a.Split)
+	}
+	err := writeFile(a.Target, b, 0666, true)
+	if err != nil {
+		return err
+	}
+	// the parts of a previous split archive would be ignored
+	return removeParts(a.Target, 0)
+}
+
+// readTarget returns the metadata stream of the local archive, decrypted
+// unless it was stored in the clear.  It returns an error that satisfies
+// os.IsNotExist if there is no local archive.
+func (a *archiver) readTarget() ([]byte, error) {
+	b, err := ioutil.ReadFile(a.Target)
+	if os.IsNotExist(err) {
+		// a local archive may have been split into parts
+		s, serr := openSplit(a.Target)
+		if serr != nil {
+			return nil, err
+		}
+		defer s.Close()
+		b, err = ioutil.ReadAll(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := DecryptMetadata(b, &a.keys.MD)
+	if err != nil && metadata.HasMagic(b) {
+		// written with PlainMetadata
+		return b, nil
+	}
+	return md, err
+}
+
+// readAll returns the contents of f from the start.
+func readAll(f *os.File) ([]byte, error) {
+	_, err := f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+// LocalDataDir returns the directory that holds the file data of the
+// self-contained local archive target.  Backup and Restore use it when given
+// an acd.DirBackend for it instead of a Cloud Drive client.
+func LocalDataDir(target string) string {
+	return target + ".data"
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics describe a backup run in the Prometheus text format, e.g. for the
+// textfile collector of node_exporter.
+type Metrics struct {
+	Start    time.Time     // start of the run
+	Duration time.Duration // length of the run
+	Err      error         // result of the run
+	Summary  *Summary      // nil if the run failed before archiving
+
+	// end of the last run that stored a complete snapshot, zero if none
+	LastSuccess time.Time
+}
+
+const lastSuccessMetric = "acdb_backup_last_success_timestamp_seconds"
+
+// complete returns true if the run stored a complete snapshot.
+func (m *Metrics) complete() bool {
+	status := RunStatus(m.Summary, m.Err)
+	return status == RunOK || status == RunSkipped
+}
+
+// Write writes the metrics to w.
+func (m *Metrics) Write(w io.Writer) error {
+	var b bytes.Buffer
+	metric := func(name, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v gauge\n%v %v\n", name,
+			help, name, name, value)
+	}
+	bit := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	seconds := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 3,
+			64)
+	}
+
+	end := m.Start.Add(m.Duration)
+	last := m.LastSuccess
+	if m.complete() {
+		last = end
+	}
+	metric("acdb_backup_last_run_timestamp_seconds",
+		"End of the last backup run.", seconds(end))
+	metric(lastSuccessMetric, "End of the last backup run that stored a "+
+		"complete snapshot.", seconds(last))
+	metric("acdb_backup_success", "1 if the last backup run stored a "+
+		"complete snapshot.", bit(m.complete()))
+	metric("acdb_backup_partial", "1 if the last backup run stored a "+
+		"partial snapshot.", bit(RunStatus(m.Summary, m.Err) ==
+		RunPartial))
+	metric("acdb_backup_duration_seconds", "Duration of the last backup "+
+		"run.", strconv.FormatFloat(m.Duration.Seconds(), 'f', 3, 64))
+
+	var s Summary
+	if m.Summary != nil {
+		s = *m.Summary
+	}
+	dedup := 0.0
+	if s.New+s.Deduped != 0 {
+		dedup = float64(s.Deduped) / float64(s.New+s.Deduped)
+	}
+	metric("acdb_backup_files", "Regular files archived by the last "+
+		"backup run.", s.Files)
+	metric("acdb_backup_new_files", "Payloads uploaded by the last backup "+
+		"run.", s.New)
+	metric("acdb_backup_deduped_files", "Payloads that were already "+
+		"present in the last backup run.", s.Deduped)
+	metric("acdb_backup_skipped_files", "Entries skipped on error in the "+
+		"last backup run.", s.Skipped)
+	metric("acdb_backup_read_bytes", "File bytes read by the last backup "+
+		"run.", s.Read)
+	metric("acdb_backup_uploaded_bytes", "Payload bytes uploaded by the "+
+		"last backup run.", s.Uploaded)
+	metric("acdb_backup_dedup_ratio", "Fraction of the payloads of the "+
+		"last backup run that were already present.",
+		strconv.FormatFloat(dedup, 'f', 4, 64))
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// lastSuccess returns the last success recorded in the metrics file
+// filename, or the zero time.
+func lastSuccess(filename string) time.Time {
+	f, err := os.Open(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	defer func() { _ = f.Close() }()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 || fields[0] != lastSuccessMetric {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || v <= 0 {
+			break
+		}
+		return time.Unix(0, int64(v*1e9))
+	}
+
+	return time.Time{}
+}
+
+// WriteMetricsFile replaces the metrics file filename with m.  The last
+// success is carried over from the previous file if m did not store a
+// complete snapshot.  The file is replaced atomically so that a collector
+// never reads a partial file.
+func WriteMetricsFile(filename string, m *Metrics) error {
+	if m.LastSuccess.IsZero() {
+		m.LastSuccess = lastSuccess(filename)
+	}
+	var b bytes.Buffer
+	err := m.Write(&b)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filename, b.Bytes(), 0644, true)
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/marcopeereboom/acdb/acd"
+)
+
+// Run statuses reported by Notification and Metrics.
+const (
+	RunOK      = "ok"      // complete snapshot
+	RunSkipped = "skipped" // complete snapshot, some files skipped on error
+	RunPartial = "partial" // partial snapshot, see ErrDeadline
+	RunFailed  = "failed"  // no snapshot
+)
+
+// RunStatus returns the status of a backup run that returned summary s and
+// err.
+func RunStatus(s *Summary, err error) string {
+	switch {
+	case s == nil:
+		return RunFailed
+	case err == nil:
+		return RunOK
+	case err == ErrSkipped:
+		return RunSkipped
+	case err == ErrDeadline || err == ErrCanceled:
+		return RunPartial
+	}
+	return RunFailed
+}
+
+// Notification is the JSON object that Notify posts when a backup run ends.
+// Text and Content hold a one line description so that Slack and Discord
+// webhooks can be used as is.
+type Notification struct {
+	Status   string    `json:"status"` // see RunStatus
+	Snapshot string    `json:"snapshot,omitempty"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // seconds
+	Error    string    `json:"error,omitempty"`
+	Summary  *Summary  `json:"summary,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Text     string    `json:"text"`
+	Content  string    `json:"content"`
+}
+
+// NewNotification returns the notification of the backup run on host that
+// started at start, took duration and returned summary s and err.
+func NewNotification(host string, start time.Time, duration time.Duration,
+	s *Summary, err error) *Notification {
+
+	n := Notification{
+		Status:   RunStatus(s, err),
+		Start:    start,
+		Duration: duration.Seconds(),
+		Summary:  s,
+		Host:     host,
+	}
+	if s != nil {
+		n.Snapshot = s.Snapshot
+	}
+	if err != nil {
+		n.Error = err.Error()
+	}
+
+	n.Text = fmt.Sprintf("acdb backup on %v: %v", host, n.Status)
+	if n.Snapshot != "" {
+		n.Text += fmt.Sprintf(", snapshot %v", n.Snapshot)
+	}
+	if s != nil {
+		n.Text += fmt.Sprintf(", %v files (%v new, %v deduped, %v "+
+			"skipped)", s.Files, s.New, s.Deduped, s.Skipped)
+	}
+	n.Text += fmt.Sprintf(" in %v", duration.Round(time.Second))
+	if n.Error != "" {
+		n.Text += ": " + n.Error
+	}
+	n.Content = n.Text
+
+	return &n
+}
+
+// Notify posts n as JSON to url.  The post goes through the proxy and uses
+// the TLS configuration of o, if any, just like the cloud drive requests.
+// Every attempt is limited to timeout and failed attempts are retried up to
+// retries times, except when the server rejects the request with a 4xx
+// status other than 429.
+func Notify(url string, n *Notification, o *acd.Options,
+	timeout time.Duration, retries int) error {
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		o = &acd.Options{}
+	}
+	client, err := acd.NewHTTPClient(o)
+	if err != nil {
+		return err
+	}
+	client.Timeout = timeout
+
+	delay := retryDelay
+	for i := 0; ; i++ {
+		var retry bool
+		retry, err = post(client, url, body)
+		if err == nil || !retry || i >= retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post posts body to url and returns whether a failure may be retried.
+func post(client *http.Client, url string, body []byte) (bool, error) {
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 &&
+		res.StatusCode != http.StatusTooManyRequests:
+		return false, fmt.Errorf("%v: %v", url, res.Status)
+	}
+	return true, fmt.Errorf("%v: %v", url, res.Status)
+}
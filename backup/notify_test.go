@@ -0,0 +1,31 @@
+package backup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/acdb/acd"
+)
+
+func TestNotifyProxy(t *testing.T) {
+	var got []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+
+		got = append(got, r.Method+" "+r.URL.String())
+	}))
+	defer proxy.Close()
+
+	// the host does not exist so only the proxy can answer
+	const url = "http://notify.invalid/hook"
+	err := Notify(url, &Notification{Status: RunOK},
+		&acd.Options{Proxy: proxy.URL}, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "POST "+url {
+		t.Fatalf("proxy got %v", got)
+	}
+}
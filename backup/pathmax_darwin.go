@@ -0,0 +1,4 @@
+package backup
+
+// pathMax is the longest path, in bytes, the system calls accept.
+const pathMax = 1024
@@ -0,0 +1,7 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package backup
+
+// pathMax is the longest path, in bytes, the system calls accept.
+const pathMax = 4096
@@ -0,0 +1,6 @@
+package backup
+
+// pathMax is the longest path the system calls accept.  The limit is in
+// UTF-16 code units since os adds the \\?\ prefix to long paths itself,
+// counting bytes instead errs on the safe side.
+const pathMax = 32767
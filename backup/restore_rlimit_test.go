@@ -0,0 +1,122 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/marcopeereboom/acdb/acd"
+)
+
+// limitFileSize makes writes beyond n bytes fail with EFBIG for the
+// duration of t.  Unlike permissions the limit also applies to root.  It
+// applies to the whole process so n must leave room for the files written
+// by go test itself.
+func limitFileSize(t *testing.T, n uint64) {
+	t.Helper()
+
+	var old syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Setrlimit(syscall.RLIMIT_FSIZE,
+		&syscall.Rlimit{Cur: n, Max: old.Max})
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// checkNoPartial fails t if dst holds temporary files or files whose
+// content differs from the same file below src.
+func checkNoPartial(t *testing.T, src, dst string) {
+	t.Helper()
+
+	want := readTree(t, src)
+	for name, e := range readTree(t, dst) {
+		if strings.HasPrefix(filepath.Base(name), ".acdb") {
+			t.Errorf("%v: temporary file left behind", name)
+			continue
+		}
+		if e.mode.IsRegular() && !bytes.Equal(e.content,
+			want[name].content) {
+			t.Errorf("%v: partial file left behind", name)
+		}
+	}
+}
+
+func TestRestoreWriteError(t *testing.T) {
+	src := t.TempDir()
+	testTree(t, src)
+	c := acd.NewMemoryBackend()
+	keys := testKeys()
+	s, err := Backup(c, keys, &Options{
+		Paths:  []string{filepath.Join(src, "tree")},
+		Base:   src,
+		Stdout: ioutil.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, dst string)
+	}{
+		{"file size", func(t *testing.T, dst string) {
+			// everything but random fits
+			limitFileSize(t, 2<<20)
+		}},
+		{"rename", func(t *testing.T, dst string) {
+			// a non-empty directory can't be replaced
+			err := os.MkdirAll(filepath.Join(dst, "tree/small/x"),
+				0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"read only", func(t *testing.T, dst string) {
+			if os.Geteuid() == 0 {
+				t.Skip("root ignores permissions")
+			}
+			dir := filepath.Join(dst, "tree/a/b")
+			err := os.MkdirAll(dir, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Chmod(dir, 0555)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = os.Chmod(dir, 0755) })
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := t.TempDir()
+			tt.prepare(t, dst)
+			err := Restore(c, keys, &Options{
+				Target: s.Snapshot,
+				Root:   dst,
+				Stdout: ioutil.Discard,
+			})
+			if err == nil {
+				t.Fatal("restore succeeded")
+			}
+			checkNoPartial(t, src, dst)
+		})
+	}
+}
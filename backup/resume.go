@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// resumeState is the on disk record of how far an extract got.
+type resumeState struct {
+	Target string `json:"target"` // metadata being extracted
+	Root   string `json:"root"`   // extract path
+	Name   string `json:"name"`   // last file extracted in metadata order
+}
+
+// loadResume returns the resume state in filename or nil if there is none.
+func loadResume(filename string) (*resumeState, error) {
+	j, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var rs resumeState
+	err = json.Unmarshal(j, &rs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rs, nil
+}
+
+func (rs *resumeState) save(filename string) error {
+	j, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, j, 0600)
+}
+
+// removeResume removes the resume state in filename once an extract
+// completed.
+func removeResume(filename string) error {
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// progress tracks the files handed to the extract workers.  Since workers
+// finish out of order it only records a file once it and all files before
+// it in the metadata were extracted.  A file that failed to extract stops
+// the progress so that it is retried on resume.
+type progress struct {
+	sync.Mutex
+
+	filename string // where state is saved
+	state    resumeState
+	pending  map[int]string // names by sequence number
+	done     map[int]bool   // extracted files past next
+	next     int            // first sequence number not yet extracted
+}
+
+func newProgress(filename, target, root string) *progress {
+	return &progress{
+		filename: filename,
+		state: resumeState{
+			Target: target,
+			Root:   root,
+		},
+		pending: make(map[int]string),
+		done:    make(map[int]bool),
+	}
+}
+
+// add registers file name under sequence number seq.
+func (p *progress) add(seq int, name string) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	p.pending[seq] = name
+}
+
+// complete marks file seq as extracted and saves the resume state if that
+// advanced the progress.
+func (p *progress) complete(seq int) error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+
+	p.done[seq] = true
+	advanced := false
+	for p.done[p.next] {
+		p.state.Name = p.pending[p.next]
+		delete(p.pending, p.next)
+		delete(p.done, p.next)
+		p.next++
+		advanced = true
+	}
+	if !advanced {
+		return nil
+	}
+
+	return p.state.save(p.filename)
+}
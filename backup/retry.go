@@ -0,0 +1,43 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/marcopeereboom/acdb/acd/token"
+)
+
+// retryDelay is the first delay between retries, it doubles with every
+// retry.
+const retryDelay = time.Second
+
+// ErrTokenRejected is returned when the Cloud Drive token was rejected while
+// refreshing it.  Carrying on is pointless since every request would fail.
+var ErrTokenRejected = errors.New("the Cloud Drive token was rejected, " +
+	"it may have been revoked")
+
+// retry calls f until it succeeds or fails for another reason than the
+// token refresh service being unavailable.  It gives up after a.Retries
+// retries and returns the last error.
+func (a *archiver) retry(f func() error) error {
+	delay := retryDelay
+	for i := 0; ; i++ {
+		err := f()
+		if err == token.ErrRefreshRejected {
+			return ErrTokenRejected
+		}
+		if !token.IsTransient(err) || i >= a.Retries {
+			return err
+		}
+
+		fmt.Fprintf(a.Stderr, "warning: %v, retrying in %v\n", err,
+			delay)
+		select {
+		case <-time.After(delay):
+		case <-a.ctx.Done():
+			return ErrCanceled
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"context"
+	"sync"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// Run is a backup running in the background that can be paused, resumed and
+// canceled, e.g. from an interactive frontend.
+type Run struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mtx    sync.Mutex
+	resume chan struct{} // closed by Resume, nil when not paused
+
+	summary *Summary
+	err     error
+}
+
+// Start starts BackupContext in the background and returns a handle to
+// control it.
+func Start(ctx context.Context, c acd.Backend, keys *shared.Keys,
+	o *Options) (*Run, error) {
+
+	a, err := newArchiver(c, keys, o, modeCreate)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Run{
+		done: make(chan struct{}),
+	}
+	a.ctx, r.cancel = context.WithCancel(ctx)
+	a.run = r
+	go func() {
+		r.summary, r.err = a.backup()
+		r.cancel()
+		close(r.done)
+	}()
+
+	return r, nil
+}
+
+// Pause stops archiving before the next entry.  Entries that are being
+// archived are finished and all state is kept until Resume or Cancel.
+func (r *Run) Pause() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.resume == nil {
+		r.resume = make(chan struct{})
+	}
+}
+
+// Resume continues a paused run.
+func (r *Run) Resume() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.resume != nil {
+		close(r.resume)
+		r.resume = nil
+	}
+}
+
+// Paused returns true if the run is paused.
+func (r *Run) Paused() bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.resume != nil
+}
+
+// Cancel stops archiving, paused or not, and stores what was archived so far
+// as a partial snapshot.  Uploads in progress are aborted and their files are
+// left out.  Wait returns ErrCanceled in that case.
+func (r *Run) Cancel() {
+	r.cancel()
+}
+
+// Done returns a channel that is closed once the run completed.
+func (r *Run) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait waits for the run to complete and returns what Backup would have.
+func (r *Run) Wait() (*Summary, error) {
+	<-r.done
+	return r.summary, r.err
+}
+
+// wait blocks while the run is paused and ctx is not done.
+func (r *Run) wait(ctx context.Context) {
+	r.mtx.Lock()
+	resume := r.resume
+	r.mtx.Unlock()
+
+	if resume == nil {
+		return
+	}
+	select {
+	case <-resume:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses a size in bytes with an optional K, M, G or T suffix,
+// e.g. 1G.  Suffixes are powers of 1024.
+func ParseSize(s string) (int64, error) {
+	shift := uint(0)
+	v := s
+	if n := len(v); n > 0 {
+		switch strings.ToUpper(v[n-1:]) {
+		case "K":
+			shift = 10
+		case "M":
+			shift = 20
+		case "G":
+			shift = 30
+		case "T":
+			shift = 40
+		}
+		if shift != 0 {
+			v = v[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 || size > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return size << shift, nil
+}
+
+// partName returns the name of part n of the split archive name.
+func partName(name string, n int) string {
+	return fmt.Sprintf("%v.%03d", name, n)
+}
+
+// writeSplit replaces the split archive name with b in parts of at most size
+// bytes named name.000, name.001 and so on.  Records may straddle parts, the
+// parts are read back as a single stream by splitReader.  All parts are
+// written to temporary files before any is renamed so that a failure while
+// writing leaves the previous parts alone.
+func writeSplit(name string, b []byte, size int64) (err error) {
+	if size <= 0 {
+		return errors.New("invalid split size")
+	}
+
+	dir := filepath.Dir(name)
+	var temps []string
+	defer func() {
+		if err != nil {
+			for _, v := range temps {
+				_ = os.Remove(v)
+			}
+		}
+	}()
+	for len(temps) == 0 || len(b) > 0 {
+		n := int64(len(b))
+		if n > size {
+			n = size
+		}
+		var f *os.File
+		f, err = createTemp(dir, 0666)
+		if err != nil {
+			return err
+		}
+		temps = append(temps, f.Name())
+		_, err = f.Write(b[:n])
+		if err == nil {
+			err = f.Sync()
+		}
+		if e := f.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	for k, v := range temps {
+		err = os.Rename(v, partName(name, k))
+		if err != nil {
+			return err
+		}
+	}
+
+	// leftovers of a previous, larger or unsplit, archive would be read
+	err = removeParts(name, len(temps))
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// removeParts removes the parts of the split archive name from part n on.
+func removeParts(name string, n int) error {
+	for ; ; n++ {
+		err := os.Remove(partName(name, n))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// splitReader reads the parts written by splitWriter in sequence.
+type splitReader struct {
+	name string
+	part int
+	f    *os.File
+}
+
+// openSplit opens the split archive name, it returns an error that
+// satisfies os.IsNotExist if name.000 does not exist.
+func openSplit(name string) (*splitReader, error) {
+	f, err := os.Open(partName(name, 0))
+	if err != nil {
+		return nil, err
+	}
+	return &splitReader{name: name, f: f}, nil
+}
+
+// Read reads from the current part and moves on to the next one at its
+// end.  The archive ends at the first missing part.
+func (s *splitReader) Read(p []byte) (int, error) {
+	for {
+		if s.f == nil {
+			return 0, io.EOF
+		}
+		n, err := s.f.Read(p)
+		if err != io.EOF {
+			return n, err
+		} else if n != 0 {
+			return n, nil
+		}
+		_ = s.f.Close()
+		s.f = nil
+		f, err := os.Open(partName(s.name, s.part+1))
+		if os.IsNotExist(err) {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		s.part++
+		s.f = f
+	}
+}
+
+func (s *splitReader) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
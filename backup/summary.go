@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// Summary tallies the results of a Backup.
+type Summary struct {
+	Snapshot string `json:"snapshot,omitempty"` // remote metadata name
+	Files    int    `json:"files"`              // regular files archived
+	New      int    `json:"new"`                // payloads uploaded
+	Deduped  int    `json:"deduped"`            // payloads already present
+	Dirs     int    `json:"dirs"`               // directories archived
+	Symlinks int    `json:"symlinks"`           // symlinks archived
+	Skipped  int    `json:"skipped"`            // entries skipped on error
+	Excluded int    `json:"excluded"`           // entries left out on purpose
+	Read     int64  `json:"read"`               // file bytes read
+	Uploaded int64  `json:"uploaded"`           // payload bytes uploaded
+
+	// payloads uploaded, only kept with Options.CompressionStats
+	Compression *CompressionStats `json:"compression,omitempty"`
+
+	Client *acd.Stats `json:"client,omitempty"` // cloud drive traffic
+}
+
+// SizeStats add up the sizes of payloads.
+type SizeStats struct {
+	Files      int   `json:"files"`      // payloads
+	Original   int64 `json:"original"`   // content bytes
+	Compressed int64 `json:"compressed"` // content bytes after compression
+	Encrypted  int64 `json:"encrypted"`  // payload bytes
+}
+
+// CompressionStats break the payloads of a backup down by MIME type.
+type CompressionStats struct {
+	SizeStats
+	Types map[string]*SizeStats `json:"types"`
+}
+
+// add adds the payload that NaClEncrypt returned with header h.
+func (c *CompressionStats) add(h *shared.Header, payload []byte) {
+	mime := h.MimeType
+	if mime == "" {
+		mime = "unknown"
+	}
+	if c.Types == nil {
+		c.Types = make(map[string]*SizeStats)
+	}
+	t, ok := c.Types[mime]
+	if !ok {
+		t = &SizeStats{}
+		c.Types[mime] = t
+	}
+	for _, v := range []*SizeStats{&c.SizeStats, t} {
+		v.Files++
+		v.Original += int64(h.Size)
+		v.Compressed += int64(h.CompressedSize())
+		v.Encrypted += int64(len(payload))
+	}
+}
+
+// Write writes the totals and the breakdown, largest types first, to w.
+func (c *CompressionStats) Write(w io.Writer) error {
+	types := make([]string, 0, len(c.Types))
+	for k := range c.Types {
+		types = append(types, k)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		ti, tj := c.Types[types[i]], c.Types[types[j]]
+		if ti.Original != tj.Original {
+			return ti.Original > tj.Original
+		}
+		return types[i] < types[j]
+	})
+
+	_, err := fmt.Fprintf(w, "compression:\n"+
+		"  %-30v %8v %14v %14v %7v %14v\n",
+		"type", "files", "original", "compressed", "ratio", "encrypted")
+	if err != nil {
+		return err
+	}
+	line := func(name string, s *SizeStats) error {
+		ratio := 100.0
+		if s.Original != 0 {
+			ratio = float64(s.Compressed) * 100 / float64(s.Original)
+		}
+		_, err := fmt.Fprintf(w, "  %-30v %8v %14v %14v %6.1f%% %14v\n",
+			name, s.Files, s.Original, s.Compressed, ratio,
+			s.Encrypted)
+		return err
+	}
+	for _, v := range types {
+		err = line(v, c.Types[v])
+		if err != nil {
+			return err
+		}
+	}
+
+	return line("total", &c.SizeStats)
+}
+
+// Write writes the summary to w, as a JSON object if asJSON is set.
+func (s *Summary) Write(w io.Writer, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(s)
+	}
+
+	_, err := fmt.Fprintf(w, "files:    %v (%v new, %v deduped)\n"+
+		"dirs:     %v\n"+
+		"symlinks: %v\n"+
+		"skipped:  %v\n"+
+		"excluded: %v\n"+
+		"read:     %v bytes\n"+
+		"uploaded: %v bytes\n",
+		s.Files, s.New, s.Deduped,
+		s.Dirs,
+		s.Symlinks,
+		s.Skipped,
+		s.Excluded,
+		s.Read,
+		s.Uploaded)
+	if err == nil && s.Compression != nil {
+		err = s.Compression.Write(w)
+	}
+	if err != nil || s.Client == nil {
+		return err
+	}
+
+	return WriteStats(w, s.Client, false)
+}
+
+// WriteStats writes the cloud drive traffic st to w, as a JSON object if
+// asJSON is set.
+func WriteStats(w io.Writer, st *acd.Stats, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(st)
+	}
+
+	_, err := fmt.Fprintf(w, "requests: %v (%v)\n"+
+		"sent:     %v bytes\n"+
+		"received: %v bytes\n",
+		st.Requests, st.Latency,
+		st.Uploaded,
+		st.Downloaded)
+
+	return err
+}
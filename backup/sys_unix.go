@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceID returns the id of the device fi resides on.
+func deviceID(fi os.FileInfo) (uint64, bool) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
+
+// chown sets the owner and group of path.
+func chown(path string, uid, gid int) error {
+	return os.Chown(path, uid, gid)
+}
+
+// syncDir flushes directory dir to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	return d.Sync()
+}
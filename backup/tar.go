@@ -0,0 +1,81 @@
+package backup
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// walkTar archives every entry of tar stream r as if it was found on disk.
+// File content is encrypted and uploaded straight from the stream.
+func (a *archiver) walkTar(r io.Reader) error {
+	a.Log(acd.DebugTrace, "[TRC] walkTar")
+
+	tr := tar.NewReader(r)
+	for {
+		err := a.checkpoint()
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var (
+			h       *shared.Header
+			payload []byte
+			digest  *[sha256.Size]byte
+		)
+		info := hdr.FileInfo()
+		name := a.archiveName(path.Clean(hdr.Name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = a.me.Dir(name, info)
+
+		case tar.TypeSymlink:
+			err = a.me.SymlinkTarget(name, hdr.Linkname)
+
+		case tar.TypeReg, tar.TypeRegA:
+			if hdr.Size == 0 {
+				err = a.me.File(name, info, "", nil)
+				break
+			}
+			if a.tooLarge(hdr.Name, hdr.Size) {
+				continue
+			}
+
+			h, payload, digest, err = shared.NaClEncrypt(tr, hdr.Size,
+				a.compressOptions(hdr.Name), a.Digest, &a.keys.Data,
+				&a.keys.Dedup)
+			if err != nil {
+				// the stream is unusable after a failed read
+				return fmt.Errorf("%v: %v", hdr.Name, err)
+			}
+			err = a.me.File(name, info, h.MimeType, digest)
+
+		default:
+			a.skip(hdr.Name, errUnsupported, true)
+			continue
+		}
+		if err != nil {
+			a.skip(hdr.Name, err, false)
+			continue
+		}
+
+		err = a.store(hdr.Name, name, info, h, digest, payload)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// throttle limits the rate at which file content is read.  Time spent not
+// reading, e.g. while uploading, is not made up for beyond a second so that
+// reads do not burst after a pause.
+type throttle struct {
+	rate  int64     // bytes per second
+	start time.Time // start of the current period
+	n     int64     // bytes read in the current period
+}
+
+// wait records that n bytes were read and sleeps until reading them was due.
+// It returns early when ctx is done, the next checkpoint stops the run.
+func (t *throttle) wait(ctx context.Context, n int) {
+	now := time.Now()
+	if t.start.IsZero() {
+		t.start = now
+	}
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(float64(t.n) / float64(t.rate) *
+		float64(time.Second)))
+	d := due.Sub(now)
+	if d < -time.Second {
+		// idle for a while, start over
+		t.start, t.n = now, 0
+		return
+	}
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
+
+// throttledReader reads from r at the rate of t.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		tr.t.wait(tr.ctx, n)
+	}
+	return n, err
+}
+
+// reader returns r limited to Throttle bytes per second, if set.
+func (a *archiver) reader(r io.Reader) io.Reader {
+	if a.throttle == nil {
+		return r
+	}
+	return &throttledReader{ctx: a.ctx, r: r, t: a.throttle}
+}
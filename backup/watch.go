@@ -0,0 +1,241 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/marcopeereboom/acdb/acd"
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// Watch defaults.
+const (
+	DefaultSettle   = 2 * time.Second
+	DefaultInterval = 10 * time.Minute
+)
+
+// cachedFile is the digest of a file as long as its size and modification
+// time do not change.
+type cachedFile struct {
+	size    int64
+	modTime time.Time
+	h       *shared.Header
+	digest  *[sha256.Size]byte
+}
+
+// cached returns the header and digest of path if it is unchanged since it
+// was last read and its payload is stored.
+func (a *archiver) cached(path string, info os.FileInfo) (*shared.Header,
+	*[sha256.Size]byte, bool) {
+
+	cf, ok := a.cache[path]
+	if !ok || cf.size != info.Size() || !cf.modTime.Equal(info.ModTime()) ||
+		!a.stored.has(cf.digest) {
+		return nil, nil, false
+	}
+
+	return cf.h, cf.digest, true
+}
+
+// remember caches the header and digest of path when watching.
+func (a *archiver) remember(path string, info os.FileInfo, h *shared.Header,
+	digest *[sha256.Size]byte) {
+
+	if a.cache == nil {
+		return
+	}
+	a.cache[path] = cachedFile{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		h:       h,
+		digest:  digest,
+	}
+}
+
+// Watch archives o.Paths like Backup and then watches them for changes until
+// ctx is done.  Changed files are uploaded once they were left alone for
+// o.Settle and a new snapshot is stored every o.Interval if anything changed.
+// Snapshots only read files that changed since they were last read.  A final
+// snapshot is stored when ctx is done and Watch returns nil, or an error if
+// watching failed.
+func Watch(ctx context.Context, c acd.Backend, keys *shared.Keys,
+	o *Options) error {
+
+	if o != nil && (o.Target != "" || o.FromTar != nil) {
+		return errors.New("watch uploads snapshots of paths only")
+	}
+	a, err := newArchiver(c, keys, o, modeCreate)
+	if err != nil {
+		return err
+	}
+	if len(a.Paths) == 0 {
+		return errors.New("nothing to watch")
+	}
+	if a.Settle == 0 {
+		a.Settle = DefaultSettle
+	}
+	if a.Interval == 0 {
+		a.Interval = DefaultInterval
+	}
+	a.cache = make(map[string]cachedFile)
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// watch before the first snapshot so that nothing is missed
+	for _, v := range a.Paths {
+		err = a.watchTree(w, v, nil)
+		if err != nil {
+			return err
+		}
+	}
+	dirty := !a.snapshot()
+
+	// changed paths and when they last changed
+	pending := make(map[string]time.Time)
+
+	settle := time.NewTicker(a.Settle)
+	defer settle.Stop()
+	interval := time.NewTicker(a.Interval)
+	defer interval.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if dirty {
+				a.snapshot()
+			}
+			return nil
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			a.Log(acd.DebugLoud, "[TRC] Watch %v", ev)
+
+			// Editors often write a temporary file and rename it
+			// over the original.  Only the resulting name matters
+			// so every event is tracked by name and the file is
+			// looked at once things settled.
+			now := time.Now()
+			pending[ev.Name] = now
+			dirty = true
+			if ev.Op&fsnotify.Create == 0 {
+				continue
+			}
+			fi, err := os.Lstat(ev.Name)
+			if err != nil || !fi.IsDir() {
+				continue
+			}
+			err = a.watchTree(w, ev.Name, func(path string) {
+				pending[path] = now
+			})
+			if err != nil {
+				fmt.Fprintf(a.Stderr, "warning: %v\n", err)
+			}
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			// events may have been lost, the next snapshot looks
+			// at everything anyway
+			fmt.Fprintf(a.Stderr, "warning: %v\n", err)
+			dirty = true
+
+		case <-settle.C:
+			for k, v := range pending {
+				if time.Since(v) < a.Settle {
+					continue
+				}
+				delete(pending, k)
+				a.uploadChanged(k)
+			}
+
+		case <-interval.C:
+			if dirty {
+				dirty = !a.snapshot()
+			}
+		}
+	}
+}
+
+// watchTree adds a watch for every directory in the tree at root, which
+// catches renames that a watch on a file would lose.  Found, if set, is
+// called for every entry.
+func (a *archiver) watchTree(w *fsnotify.Watcher, root string,
+	found func(path string)) error {
+
+	return filepath.Walk(root, func(path string, info os.FileInfo,
+		err error) error {
+
+		if err != nil {
+			// reported by the next snapshot
+			return nil
+		}
+		if found != nil {
+			found(path)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		return w.Add(path)
+	})
+}
+
+// uploadChanged uploads the payload of the file at path, if it is not stored
+// yet, so that the next snapshot finds it.  Errors are left for the snapshot
+// to report.
+func (a *archiver) uploadChanged(path string) {
+	a.Log(acd.DebugTrace, "[TRC] uploadChanged %v", path)
+
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 ||
+		(a.MaxSize != 0 && info.Size() > a.MaxSize) {
+		// gone, renamed or not archived
+		return
+	}
+
+	delete(a.cache, path)
+	_, payload, digest, err := a.readFile(path, info)
+	if err != nil || payload == nil {
+		return
+	}
+	err = a.upload(a.c, a.dataID,
+		&acd.NodeJSON{Name: hex.EncodeToString(digest[:])}, payload)
+	if e, ok := acd.IsCombinedError(err); ok &&
+		e.StatusCode == http.StatusConflict {
+		err = nil
+	}
+	if err != nil {
+		a.Log(acd.DebugTrace, "[TRC] uploadChanged %v: %v", path, err)
+		return
+	}
+	a.stored.add(digest)
+}
+
+// snapshot archives the paths and stores a new snapshot.  It returns true if
+// the snapshot was stored.
+func (a *archiver) snapshot() bool {
+	a.stats = Summary{}
+	a.links = nil
+	s, err := a.backup()
+	if a.OnSnapshot != nil {
+		a.OnSnapshot(s, err)
+	}
+
+	return s != nil
+}
@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+
+	"github.com/marcopeereboom/acdb/metadata"
+)
+
+// aclsSupported is true if getACLs and setACLs work on this platform.
+const aclsSupported = true
+
+// aclPrefixes are the extended attribute namespaces that carry ACLs and
+// file capabilities.
+var aclPrefixes = []string{
+	"security.",
+	"system.posix_acl_",
+}
+
+func isACL(key string) bool {
+	for _, v := range aclPrefixes {
+		if strings.HasPrefix(key, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// getACLs returns the ACL and capability extended attributes of path.
+// File systems without extended attribute support simply have none.
+func getACLs(path string) ([]metadata.Attr, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	list := make([]byte, size)
+	size, err = syscall.Listxattr(path, list)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs []metadata.Attr
+	for _, key := range bytes.Split(list[:size], []byte{0}) {
+		if len(key) == 0 || !isACL(string(key)) {
+			continue
+		}
+		size, err := syscall.Getxattr(path, string(key), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, string(key), value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, metadata.Attr{
+			Key:   string(key),
+			Value: value[:size],
+		})
+	}
+
+	return attrs, nil
+}
+
+// setACLs sets extended attributes attrs on path.  It must be called after
+// chown since changing ownership clears file capabilities.  Attributes
+// recorded on other platforms are ignored.
+func setACLs(path string, attrs []metadata.Attr) error {
+	for _, v := range attrs {
+		if !isACL(v.Key) {
+			continue
+		}
+		err := syscall.Setxattr(path, v.Key, v.Value, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package backup
+
+import (
+	"github.com/marcopeereboom/acdb/metadata"
+)
+
+// aclsSupported is true if getACLs and setACLs work on this platform.
+const aclsSupported = false
+
+func getACLs(path string) ([]metadata.Attr, error) {
+	return nil, errACLs
+}
+
+func setACLs(path string, attrs []metadata.Attr) error {
+	return errACLs
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"encoding/binary"
+	"syscall"
+
+	"github.com/marcopeereboom/acdb/metadata"
+)
+
+// aclsSupported is true if getACLs and setACLs work on this platform.
+const aclsSupported = true
+
+// attributesKey names the attribute that holds the windows file attributes.
+const attributesKey = "windows.attributes"
+
+// keptAttributes are the windows file attributes that are archived.  The
+// read-only attribute is also reflected in the mode.
+const keptAttributes = syscall.FILE_ATTRIBUTE_READONLY |
+	syscall.FILE_ATTRIBUTE_HIDDEN |
+	syscall.FILE_ATTRIBUTE_SYSTEM |
+	syscall.FILE_ATTRIBUTE_ARCHIVE
+
+// getACLs returns the read-only, hidden, system and archive attributes of
+// path, windows has no POSIX ACLs.
+func getACLs(path string) ([]metadata.Attr, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := syscall.GetFileAttributes(p)
+	if err != nil {
+		return nil, err
+	}
+	attrs &= keptAttributes
+	if attrs == 0 {
+		return nil, nil
+	}
+
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, attrs)
+	return []metadata.Attr{{Key: attributesKey, Value: value}}, nil
+}
+
+// setACLs restores the attributes recorded by getACLs on path.  Attributes
+// recorded on other platforms are ignored.
+func setACLs(path string, attrs []metadata.Attr) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	for _, v := range attrs {
+		if v.Key != attributesKey || len(v.Value) != 4 {
+			continue
+		}
+		current, err := syscall.GetFileAttributes(p)
+		if err != nil {
+			return err
+		}
+		current &^= keptAttributes
+		current |= binary.LittleEndian.Uint32(v.Value) & keptAttributes
+		err = syscall.SetFileAttributes(p, current)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
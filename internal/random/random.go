@@ -0,0 +1,13 @@
+// Package random provides the source of randomness for all keys, salts and
+// nonces.  Reader is crypto/rand.Reader and is only ever replaced by tests
+// that need reproducible output, e.g. to compare encrypted files against
+// golden files.  Being internal it can not be replaced outside of acdb.
+package random
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// Reader is the source of randomness.  Never replace it outside of tests.
+var Reader io.Reader = rand.Reader
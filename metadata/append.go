@@ -0,0 +1,137 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/davecgh/go-xdr/xdr2"
+)
+
+// NewAppendEncoder returns an encoder that adds entries to the metadata
+// stream in f, which must be open for reading and writing.  The stream is
+// validated, digest included, and its trailer is cut off so that Close
+// writes a new one that covers all entries.  The stream keeps its
+// compression and digest algorithm; use Algorithm to record digests that
+// match.
+//
+// Only streams of the current Version can be appended to since entries of
+// older versions are encoded differently.  A gzip stream can not be cut
+// before its trailer so its entries are decompressed to a temporary file and
+// recompressed, with the default level, which takes time and space
+// proportional to the stream.  F is left in an undefined state on error.
+func NewAppendEncoder(f *os.File) (*MetadataEncoder, error) {
+	_, err := f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDecoder(f)
+	if err != nil {
+		return nil, err
+	}
+	if d.version != Version {
+		return nil, ErrVersion
+	}
+
+	// find where the entries end, i.e. where TypeEnd starts
+	var end int64
+	for {
+		end = d.record.total
+		_, err = d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the header is rewritten as is
+	var hb bytes.Buffer
+	_, err = xdr.NewEncoder(&hb).Encode(Header{
+		Magic:       Magic,
+		Version:     Version,
+		Compression: d.compression,
+		Algorithm:   d.algorithm,
+	})
+	if err != nil {
+		return nil, err
+	}
+	headerSize := int64(hb.Len())
+
+	m := MetadataEncoder{
+		algorithm: d.algorithm,
+		digest:    sha256.New(),
+	}
+	switch {
+	case bytes.Equal(d.compression[:], CompNone[:]):
+		// hash the entries and cut off the trailer
+		_, err = f.Seek(headerSize, os.SEEK_SET)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(m.digest, f, end)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Truncate(headerSize + end)
+		if err != nil {
+			return nil, err
+		}
+		m.bw = bufio.NewWriter(f)
+
+	default:
+		// recompress the entries without the trailer
+		tmp, err := ioutil.TempFile("", "acdbmd")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}()
+
+		_, err = f.Seek(headerSize, os.SEEK_SET)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(tmp, zr, end)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tmp.Seek(0, os.SEEK_SET)
+		if err != nil {
+			return nil, err
+		}
+
+		err = f.Truncate(headerSize)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Seek(headerSize, os.SEEK_SET)
+		if err != nil {
+			return nil, err
+		}
+		zw, err := gzip.NewWriterLevel(f, gzip.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(io.MultiWriter(zw, m.digest), tmp)
+		if err != nil {
+			return nil, err
+		}
+		m.bw = zw
+	}
+	m.e = xdr.NewEncoder(io.MultiWriter(m.bw, m.digest))
+	m.r = xdr.NewEncoder(m.bw)
+
+	return &m, nil
+}
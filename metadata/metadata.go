@@ -1,32 +1,77 @@
 package metadata
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"errors"
+	"hash"
 	"io"
 	"os"
-	"path/filepath"
-	"syscall"
 	"time"
 
 	"github.com/davecgh/go-xdr/xdr2"
 	"github.com/klauspost/pgzip"
+
+	"github.com/marcopeereboom/acdb/shared"
 )
 
 const (
-	Version = 1
+	Version = 7
+
+	// versionLegacy is the version of streams that predate Magic.
+	versionLegacy = 1
+
+	// versionNoEnd is the version of streams that predate TypeEnd.
+	versionNoEnd = 2
+
+	// versionNoAccessed is the version of streams that predate the
+	// Accessed time.
+	versionNoAccessed = 3
+
+	// versionNoCreated is the version of streams that predate the Created
+	// time.
+	versionNoCreated = 4
+
+	// versionNoAlgorithm is the version of streams that predate the
+	// digest algorithm in the header; their digests are SHA-256.
+	versionNoAlgorithm = 5
+
+	// versionResolvedLinks is the last version of streams that record
+	// symlink targets resolved instead of verbatim.
+	versionResolvedLinks = 6
+)
+
+// Decoder limits.  The decoder allocates based on length prefixes so without
+// limits a corrupt stream can exhaust memory.  The defaults are well above
+// the longest path and extended attribute.
+const (
+	DefaultMaxString = 64 * 1024   // longest string, e.g. Name or Link
+	DefaultMaxRecord = 1024 * 1024 // largest entry
 )
 
 var (
+	ErrMagic       = errors.New("not an acdb metadata stream")
 	ErrVersion     = errors.New("invalid version")
 	ErrCompression = errors.New("invalid compression")
 	ErrType        = errors.New("invalid type")
 	ErrTypeDir     = errors.New("invalid dir type")
 	ErrTypeSymlink = errors.New("invalid symlink type")
 	ErrTypeFile    = errors.New("invalid file type")
+	ErrTypeEnd     = errors.New("invalid end type")
+	ErrTypeXattr   = errors.New("invalid xattr type")
+	ErrTruncated   = errors.New("truncated metadata stream")
+	ErrDigest      = errors.New("metadata digest mismatch")
+	ErrTooLarge    = errors.New("metadata entry too large")
+
+	// Magic identifies an acdb metadata stream.
+	Magic = [4]byte{'a', 'c', 'd', 'm'}
+
+	// magicLegacy is what streams that predate Magic start with: the XDR
+	// encoding of versionLegacy.
+	magicLegacy = [4]byte{0, 0, 0, versionLegacy}
 
 	CompNone = [4]byte{'n', 'o', 'n', 'e'}
 	CompGZIP = [4]byte{'g', 'z', 'i', 'p'}
@@ -34,6 +79,8 @@ var (
 	TypeDir     = [4]byte{'d', 'i', 'r'}
 	TypeSymlink = [4]byte{'s', 'y', 'm', 'l'}
 	TypeFile    = [4]byte{'f', 'i', 'l', 'e'}
+	TypeEnd     = [4]byte{'e', 'n', 'd'}
+	TypeXattr   = [4]byte{'x', 'a', 't', 'r'}
 )
 
 type flusher interface {
@@ -41,45 +88,178 @@ type flusher interface {
 }
 
 type MetadataDecoder struct {
-	d *xdr.Decoder
+	d *xdr.Decoder // entries, hashed
+	r *xdr.Decoder // trailer, not hashed
+
+	record  *recordReader // limits the size of an entry
+	lastErr error         // last decoding error, for tooLarge
+
+	version     int
+	compression [4]byte   // compression of the entries
+	algorithm   [4]byte   // digest algorithm of the snapshot
+	digest      hash.Hash // running digest of all entries
+}
+
+// Algorithm returns the digest algorithm the snapshot was made with.
+func (m *MetadataDecoder) Algorithm() [4]byte {
+	return m.algorithm
 }
 
+// ResolvedLinks returns true if the snapshot predates recording symlink
+// targets verbatim.  Its targets were resolved when archived and are meant
+// to be extracted relative to the extract path.
+func (m *MetadataDecoder) ResolvedLinks() bool {
+	return m.version <= versionResolvedLinks
+}
+
+// recordReader fails reads once more than max bytes were read since n was
+// reset.  Total counts all bytes read.
+type recordReader struct {
+	r     io.Reader
+	n     int64
+	max   int64
+	total int64
+}
+
+func (l *recordReader) Read(p []byte) (int, error) {
+	if l.n >= l.max {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > l.max-l.n {
+		p = p[:l.max-l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	l.total += int64(n)
+
+	return n, err
+}
+
+// HasMagic reports whether b starts like a metadata stream, either one with
+// Magic or a legacy one.
+func HasMagic(b []byte) bool {
+	return bytes.HasPrefix(b, Magic[:]) || bytes.HasPrefix(b, magicLegacy[:])
+}
+
+// NewDecoder returns a decoder that reads a metadata stream from r with the
+// default limits.
 func NewDecoder(r io.Reader) (*MetadataDecoder, error) {
-	m := MetadataDecoder{}
+	return NewDecoderLimited(r, DefaultMaxString, DefaultMaxRecord)
+}
+
+// NewDecoderLimited returns a decoder that reads a metadata stream from r.
+// It returns ErrMagic if r holds something else and io.ErrUnexpectedEOF if r
+// ends within the magic.  Next returns ErrTooLarge for entries with strings
+// or slices longer than maxString or that are larger than maxRecord bytes.
+func NewDecoderLimited(r io.Reader, maxString, maxRecord int) (
+	*MetadataDecoder, error) {
+
+	if maxString <= 0 || maxRecord <= 0 {
+		return nil, errors.New("invalid limits")
+	}
+	m := MetadataDecoder{
+		digest: sha256.New(),
+	}
 
-	// read header
+	// read header, a stream that is cut short is not a foreign one
 	var h Header
-	d := xdr.NewDecoder(r)
-	_, err := d.Decode(&h)
+	_, err := io.ReadFull(r, h.Magic[:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return nil, err
 	}
+	d := xdr.NewDecoderLimited(r, uint(maxString))
 
-	if h.Version != Version {
-		return nil, ErrVersion
+	switch {
+	case bytes.Equal(h.Magic[:], Magic[:]):
+		_, err = d.Decode(&h.Version)
+		if err != nil {
+			return nil, err
+		}
+		if h.Version < versionNoEnd || h.Version > Version {
+			return nil, ErrVersion
+		}
+	case bytes.Equal(h.Magic[:], magicLegacy[:]):
+		// legacy streams carry no magic, only the version
+		h.Version = versionLegacy
+	default:
+		return nil, ErrMagic
 	}
 
+	_, err = d.Decode(&h.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Version > versionNoAlgorithm {
+		_, err = d.Decode(&h.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		h.Algorithm = shared.DigestSHA256
+	}
+	m.algorithm = h.Algorithm
+
 	switch {
 	case bytes.Compare(h.Compression[:], CompNone[:]) == 0:
-		m.d = d
 	case bytes.Compare(h.Compression[:], CompGZIP[:]) == 0:
-		br, err := pgzip.NewReader(r)
+		r, err = pgzip.NewReader(r)
 		if err != nil {
 			return nil, err
 		}
-		m.d = xdr.NewDecoder(br)
 	default:
 		return nil, ErrCompression
 	}
+	m.record = &recordReader{r: r, max: int64(maxRecord)}
+	m.d = xdr.NewDecoderLimited(io.TeeReader(m.record, m.digest),
+		uint(maxString))
+	m.r = xdr.NewDecoderLimited(m.record, uint(maxString))
+	m.version = h.Version
+	m.compression = h.Compression
 
 	return &m, nil
 }
 
+// Next returns the next entry of the stream and io.EOF once it ended.
 func (m *MetadataDecoder) Next() (interface{}, error) {
+	v, err := m.next()
+	if err != nil && err != io.EOF && m.tooLarge() {
+		return nil, ErrTooLarge
+	}
+
+	return v, err
+}
+
+// tooLarge returns true if decoding failed because a limit was exceeded.
+func (m *MetadataDecoder) tooLarge() bool {
+	if m.record.n >= m.record.max {
+		return true
+	}
+	e, ok := m.lastErr.(*xdr.UnmarshalError)
+	return ok && e.ErrorCode == xdr.ErrOverflow
+}
+
+// decode decodes the next value of an entry into v.
+func (m *MetadataDecoder) decode(v interface{}) error {
+	_, err := m.d.Decode(v)
+	m.lastErr = err
+	return err
+}
+
+func (m *MetadataDecoder) next() (interface{}, error) {
+	m.record.n = 0
+
 	var t [4]byte
-	_, err := m.d.Decode(&t)
+	err := m.decode(&t)
 	if err != nil {
 		if IsEOF(err) {
+			if m.version > versionNoEnd {
+				// stream ended before TypeEnd
+				return nil, ErrTruncated
+			}
 			return nil, io.EOF
 		}
 		return nil, ErrType
@@ -87,8 +267,24 @@ func (m *MetadataDecoder) Next() (interface{}, error) {
 
 	switch {
 	case bytes.Compare(t[:], TypeDir[:]) == 0:
+		switch m.version {
+		case versionLegacy, versionNoEnd, versionNoAccessed:
+			var dir dirV3
+			err = m.decode(&dir)
+			if err != nil {
+				return nil, ErrTypeDir
+			}
+			return dir.Dir(), nil
+		case versionNoCreated:
+			var dir dirV4
+			err = m.decode(&dir)
+			if err != nil {
+				return nil, ErrTypeDir
+			}
+			return dir.Dir(), nil
+		}
 		var dir Dir
-		_, err = m.d.Decode(&dir)
+		err = m.decode(&dir)
 		if err != nil {
 			return nil, ErrTypeDir
 		}
@@ -96,34 +292,89 @@ func (m *MetadataDecoder) Next() (interface{}, error) {
 
 	case bytes.Compare(t[:], TypeSymlink[:]) == 0:
 		var symlink Symlink
-		_, err = m.d.Decode(&symlink)
+		err = m.decode(&symlink)
 		if err != nil {
 			return nil, ErrTypeSymlink
 		}
 		return symlink, nil
 
 	case bytes.Compare(t[:], TypeFile[:]) == 0:
+		switch m.version {
+		case versionLegacy, versionNoEnd, versionNoAccessed:
+			var file fileV3
+			err = m.decode(&file)
+			if err != nil {
+				return nil, ErrTypeFile
+			}
+			return file.File(), nil
+		case versionNoCreated:
+			var file fileV4
+			err = m.decode(&file)
+			if err != nil {
+				return nil, ErrTypeFile
+			}
+			return file.File(), nil
+		}
 		var file File
-		_, err = m.d.Decode(&file)
+		err = m.decode(&file)
 		if err != nil {
 			return nil, ErrTypeFile
 		}
 		return file, nil
+
+	case bytes.Compare(t[:], TypeXattr[:]) == 0:
+		var xattr Xattr
+		err = m.decode(&xattr)
+		if err != nil {
+			return nil, ErrTypeXattr
+		}
+		return xattr, nil
+
+	case bytes.Compare(t[:], TypeEnd[:]) == 0:
+		var end End
+		_, err = m.r.Decode(&end)
+		if err != nil {
+			return nil, ErrTypeEnd
+		}
+		if !bytes.Equal(end.Digest[:], m.digest.Sum(nil)) {
+			return nil, ErrDigest
+		}
+		return nil, io.EOF
 	}
 
 	return nil, ErrType
 }
 
 type MetadataEncoder struct {
-	e  *xdr.Encoder
-	bw io.Writer // for flushing
+	e  *xdr.Encoder // entries, hashed
+	r  *xdr.Encoder // trailer, not hashed
+	bw io.Writer    // for flushing
+
+	algorithm [4]byte   // digest algorithm of the snapshot
+	digest    hash.Hash // running digest of all entries
+	ended     bool      // trailer has been written
+}
+
+// Algorithm returns the digest algorithm of the recorded file digests.
+func (m *MetadataEncoder) Algorithm() [4]byte {
+	return m.algorithm
 }
 
-func NewEncoder(w io.Writer, compress bool) (*MetadataEncoder, error) {
-	m := MetadataEncoder{}
+// NewEncoder returns an encoder that writes a metadata stream to w.  Level
+// is the gzip compression level and gzip.NoCompression disables compression.
+// Alg is the digest algorithm of the recorded file digests.
+func NewEncoder(w io.Writer, level int, alg [4]byte) (*MetadataEncoder,
+	error) {
+
+	m := MetadataEncoder{
+		algorithm: alg,
+	}
+	compress := level != gzip.NoCompression
 
 	h := Header{
-		Version: Version,
+		Magic:     Magic,
+		Version:   Version,
+		Algorithm: alg,
 	}
 	if compress {
 		h.Compression = CompGZIP
@@ -139,11 +390,16 @@ func NewEncoder(w io.Writer, compress bool) (*MetadataEncoder, error) {
 	}
 
 	if compress {
-		m.bw = gzip.NewWriter(w)
+		m.bw, err = gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		m.bw = bufio.NewWriter(w)
 	}
-	m.e = xdr.NewEncoder(m.bw)
+	m.digest = sha256.New()
+	m.e = xdr.NewEncoder(io.MultiWriter(m.bw, m.digest))
+	m.r = xdr.NewEncoder(m.bw)
 
 	return &m, nil
 }
@@ -154,19 +410,15 @@ func (m *MetadataEncoder) Dir(path string, fi os.FileInfo) error {
 		return err
 	}
 
-	stat, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok {
-		stat = &syscall.Stat_t{
-			Uid: 0xffffffff,
-			Gid: 0xffffffff,
-		}
-	}
+	owner, group := ownerInfo(fi)
 	_, err = m.e.Encode(Dir{
 		Name:     path,
 		Mode:     fi.Mode(),
-		Owner:    int(stat.Uid),
-		Group:    int(stat.Gid),
+		Owner:    owner,
+		Group:    group,
 		Modified: fi.ModTime(),
+		Accessed: accessed(fi),
+		Created:  created(fi),
 	})
 	if err != nil {
 		return err
@@ -175,31 +427,62 @@ func (m *MetadataEncoder) Dir(path string, fi os.FileInfo) error {
 	return nil
 }
 
-func (m *MetadataEncoder) Symlink(path string, fi os.FileInfo) error {
-	_, err := m.e.Encode(TypeSymlink)
+// accessed returns the access time recorded in fi or, when fi does not
+// carry one, the modification time.
+func accessed(fi os.FileInfo) time.Time {
+	if h, ok := fi.Sys().(*tar.Header); ok && !h.AccessTime.IsZero() {
+		return h.AccessTime
+	}
+	if t, ok := statAccessed(fi); ok {
+		return t
+	}
+	return fi.ModTime()
+}
+
+// created returns the birth time recorded in fi or the zero time when the
+// platform or file system does not provide one.
+func created(fi os.FileInfo) time.Time {
+	t, _ := statCreated(fi)
+	return t
+}
+
+// UnknownID is recorded as owner or group when fi does not provide one.
+const UnknownID = 0xffffffff
+
+// ownerInfo returns the owner and group ids recorded in fi, or UnknownID.
+// Ids come from tar headers or from the platform specific stat information,
+// which makes it possible to encode fake FileInfos.
+func ownerInfo(fi os.FileInfo) (uid, gid int) {
+	if hdr, ok := fi.Sys().(*tar.Header); ok {
+		return hdr.Uid, hdr.Gid
+	}
+	if uid, gid, ok := statOwner(fi); ok {
+		return uid, gid
+	}
+	return UnknownID, UnknownID
+}
+
+// Symlink encodes the symbolic link at path under name.  The link target is
+// recorded verbatim, without resolving it, so that dangling links and links
+// that form a loop are archived like any other.
+func (m *MetadataEncoder) Symlink(name, path string, fi os.FileInfo) error {
+	link, err := os.Readlink(path)
 	if err != nil {
 		return err
 	}
 
-	var link string
-	if filepath.IsAbs(path) {
-		link, err = filepath.EvalSymlinks(path)
-		if err != nil {
-			return err
-		}
-	} else {
-		link, err = filepath.EvalSymlinks(path)
-		if err != nil {
-			return err
-		}
-		link, err = filepath.Rel(path, link)
-		if err != nil {
-			return err
-		}
+	return m.SymlinkTarget(name, link)
+}
+
+// SymlinkTarget encodes a symbolic link called name that points to link.
+func (m *MetadataEncoder) SymlinkTarget(name, link string) error {
+	_, err := m.e.Encode(TypeSymlink)
+	if err != nil {
+		return err
 	}
 
 	_, err = m.e.Encode(Symlink{
-		Name: path,
+		Name: name,
 		Link: link,
 	})
 	if err != nil {
@@ -220,20 +503,16 @@ func (m *MetadataEncoder) File(path string, fi os.FileInfo, mime string,
 	if digest == nil {
 		digest = &[sha256.Size]byte{}
 	}
-	stat, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok {
-		stat = &syscall.Stat_t{
-			Uid: 0xffffffff,
-			Gid: 0xffffffff,
-		}
-	}
+	owner, group := ownerInfo(fi)
 	_, err = m.e.Encode(File{
 		Name:     path,
 		Mode:     fi.Mode(),
-		Owner:    int(stat.Uid),
-		Group:    int(stat.Gid),
+		Owner:    owner,
+		Group:    group,
 		Size:     fi.Size(),
 		Modified: fi.ModTime(),
+		Accessed: accessed(fi),
+		Created:  created(fi),
 
 		MimeType: mime,
 		Digest:   *digest,
@@ -245,15 +524,68 @@ func (m *MetadataEncoder) File(path string, fi os.FileInfo, mime string,
 	return nil
 }
 
-func (m *MetadataEncoder) Flush() {
+// Xattr encodes the extended attributes of name.  It must be encoded right
+// before the entry of name so that the attributes can be applied once that
+// entry is restored.
+func (m *MetadataEncoder) Xattr(name string, attrs []Attr) error {
+	_, err := m.e.Encode(TypeXattr)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.e.Encode(Xattr{
+		Name:  name,
+		Attrs: attrs,
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Flush flushes buffered entries to the underlying writer.
+func (m *MetadataEncoder) Flush() error {
 	if w, ok := m.bw.(flusher); ok {
-		w.Flush()
+		return w.Flush()
 	}
+	return nil
+}
+
+// Close terminates the stream with TypeEnd and the digest of all entries,
+// flushes it and closes the compressor.  The underlying writer is not
+// closed.  Nothing may be encoded after Close.
+func (m *MetadataEncoder) Close() error {
+	if !m.ended {
+		m.ended = true
+		_, err := m.e.Encode(TypeEnd)
+		if err != nil {
+			return err
+		}
+		var end End
+		copy(end.Digest[:], m.digest.Sum(nil))
+		_, err = m.r.Encode(end)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.Flush()
+	if err != nil {
+		return err
+	}
+	if c, ok := m.bw.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
 }
 
 type Header struct {
+	Magic       [4]byte // metadata magic, absent in version 1
 	Version     int     // metadata version
 	Compression [4]byte // metadata compression
+	Algorithm   [4]byte // digest algorithm, absent before version 6
 }
 
 type File struct {
@@ -263,14 +595,90 @@ type File struct {
 	Group    int         // group id
 	Size     int64       // file size
 	Modified time.Time   // modification time
+	Accessed time.Time   // access time, absent in version 3 and older
+	Created  time.Time   // birth time, zero if unknown, absent in version 4
 
 	MimeType string            // MIME type
 	Digest   [sha256.Size]byte // payload digest AND external pointer
 }
 
+// fileV4 is File as encoded in version 4 streams.
+type fileV4 struct {
+	Name     string
+	Mode     os.FileMode
+	Owner    int
+	Group    int
+	Size     int64
+	Modified time.Time
+	Accessed time.Time
+
+	MimeType string
+	Digest   [sha256.Size]byte
+}
+
+// File returns f as a File with an unknown birth time.
+func (f fileV4) File() File {
+	return File{
+		Name:     f.Name,
+		Mode:     f.Mode,
+		Owner:    f.Owner,
+		Group:    f.Group,
+		Size:     f.Size,
+		Modified: f.Modified,
+		Accessed: f.Accessed,
+		MimeType: f.MimeType,
+		Digest:   f.Digest,
+	}
+}
+
+// fileV3 is File as encoded in version 3 and older streams.
+type fileV3 struct {
+	Name     string
+	Mode     os.FileMode
+	Owner    int
+	Group    int
+	Size     int64
+	Modified time.Time
+
+	MimeType string
+	Digest   [sha256.Size]byte
+}
+
+// File returns f as a File whose access time is its modification time.
+func (f fileV3) File() File {
+	return File{
+		Name:     f.Name,
+		Mode:     f.Mode,
+		Owner:    f.Owner,
+		Group:    f.Group,
+		Size:     f.Size,
+		Modified: f.Modified,
+		Accessed: f.Modified,
+		MimeType: f.MimeType,
+		Digest:   f.Digest,
+	}
+}
+
 type Symlink struct {
 	Name string // filename
-	Link string // symbolic link path
+	Link string // symbolic link target, see ResolvedLinks
+}
+
+// Xattr carries the extended attributes of the entry that follows it.
+type Xattr struct {
+	Name  string // name of the entry that follows
+	Attrs []Attr // extended attributes
+}
+
+type Attr struct {
+	Key   string // attribute name, e.g. security.capability
+	Value []byte // raw attribute value
+}
+
+// End terminates a stream.  Digest covers every encoded entry including
+// the TypeEnd that precedes it.
+type End struct {
+	Digest [sha256.Size]byte // SHA-256 of the stream up to here
 }
 
 type Dir struct {
@@ -279,6 +687,51 @@ type Dir struct {
 	Owner    int         // owner id
 	Group    int         // group id
 	Modified time.Time   // modification time
+	Accessed time.Time   // access time, absent in version 3 and older
+	Created  time.Time   // birth time, zero if unknown, absent in version 4
+}
+
+// dirV4 is Dir as encoded in version 4 streams.
+type dirV4 struct {
+	Name     string
+	Mode     os.FileMode
+	Owner    int
+	Group    int
+	Modified time.Time
+	Accessed time.Time
+}
+
+// Dir returns d as a Dir with an unknown birth time.
+func (d dirV4) Dir() Dir {
+	return Dir{
+		Name:     d.Name,
+		Mode:     d.Mode,
+		Owner:    d.Owner,
+		Group:    d.Group,
+		Modified: d.Modified,
+		Accessed: d.Accessed,
+	}
+}
+
+// dirV3 is Dir as encoded in version 3 and older streams.
+type dirV3 struct {
+	Name     string
+	Mode     os.FileMode
+	Owner    int
+	Group    int
+	Modified time.Time
+}
+
+// Dir returns d as a Dir whose access time is its modification time.
+func (d dirV3) Dir() Dir {
+	return Dir{
+		Name:     d.Name,
+		Mode:     d.Mode,
+		Owner:    d.Owner,
+		Group:    d.Group,
+		Modified: d.Modified,
+		Accessed: d.Modified,
+	}
 }
 
 func IsEOF(err error) bool {
@@ -0,0 +1,194 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/marcopeereboom/acdb/shared"
+)
+
+// testStream returns a stream with one entry of every type, compressed at
+// level.
+func testStream(tb testing.TB, level int) []byte {
+	tb.Helper()
+
+	dir, err := ioutil.TempDir("", "acdb")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(filename, []byte("hello"), 0644)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dfi, err := os.Stat(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ffi, err := os.Stat(filename)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	m, err := NewEncoder(&b, level, shared.DigestSHA256)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("hello"))
+	for _, f := range []func() error{
+		func() error { return m.Dir("dir", dfi) },
+		func() error {
+			return m.Xattr("dir/file", []Attr{{Key: "user.a",
+				Value: []byte("b")}})
+		},
+		func() error {
+			return m.File("dir/file", ffi, "text/plain", &digest)
+		},
+		func() error { return m.SymlinkTarget("dir/link", "file") },
+		m.Close,
+	} {
+		err = f()
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return b.Bytes()
+}
+
+// FuzzNext decodes arbitrary streams with small limits.  Decoding must fail
+// cleanly instead of panicking or allocating without bounds.
+func FuzzNext(f *testing.F) {
+	f.Add(testStream(f, gzip.NoCompression))
+	f.Add(testStream(f, gzip.DefaultCompression))
+	f.Add([]byte{})
+	f.Add(Magic[:])
+	f.Add(magicLegacy[:])
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		d, err := NewDecoderLimited(bytes.NewReader(stream), 1024, 4096)
+		if err != nil {
+			return
+		}
+		// every entry consumes input so this always ends
+		for {
+			_, err = d.Next()
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+// errReader fails every read with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+func TestNewDecoderErrors(t *testing.T) {
+	errRead := errors.New("read error")
+	tests := []struct {
+		name string
+		r    io.Reader
+		want error
+	}{
+		{"empty", bytes.NewReader(nil), io.ErrUnexpectedEOF},
+		{"short", bytes.NewReader(Magic[:2]), io.ErrUnexpectedEOF},
+		{"read error", errReader{errRead}, errRead},
+		{"read error after magic", io.MultiReader(
+			bytes.NewReader(Magic[:2]), errReader{errRead}), errRead},
+		{"foreign", bytes.NewReader([]byte("PK\x03\x04")), ErrMagic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoder(tt.r)
+			if err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// xattrStream returns an uncompressed stream with a single xattr entry of
+// name carrying value and the size of that entry.
+func xattrStream(t *testing.T, name string, value []byte) ([]byte, int) {
+	t.Helper()
+
+	encode := func(xattr bool) []byte {
+		var b bytes.Buffer
+		m, err := NewEncoder(&b, gzip.NoCompression, shared.DigestSHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if xattr {
+			err = m.Xattr(name, []Attr{{Key: "user.a", Value: value}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = m.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	stream := encode(true)
+
+	return stream, len(stream) - len(encode(false))
+}
+
+// decodeAll decodes every entry of stream and returns the first error other
+// than io.EOF.
+func decodeAll(stream []byte, maxString, maxRecord int) error {
+	d, err := NewDecoderLimited(bytes.NewReader(stream), maxString,
+		maxRecord)
+	if err != nil {
+		return err
+	}
+	for {
+		_, err = d.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestNextLimits(t *testing.T) {
+	const maxString = 1024
+
+	long := string(bytes.Repeat([]byte("a"), maxString+1))
+	stream, _ := xattrStream(t, long, []byte("b"))
+	err := decodeAll(stream, maxString, DefaultMaxRecord)
+	if err != ErrTooLarge {
+		t.Fatalf("string: got %v, want %v", err, ErrTooLarge)
+	}
+
+	// every string fits, only the record as a whole does not
+	value := bytes.Repeat([]byte("b"), maxString)
+	stream, size := xattrStream(t, "dir/file", value)
+	err = decodeAll(stream, maxString, size-1)
+	if err != ErrTooLarge {
+		t.Fatalf("record: got %v, want %v", err, ErrTooLarge)
+	}
+
+	err = decodeAll(stream, maxString, size)
+	if err != nil {
+		t.Fatalf("exact record: %v", err)
+	}
+}
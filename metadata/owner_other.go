@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package metadata
+
+import (
+	"os"
+)
+
+// statOwner reports that files have no numeric owner on this platform.
+func statOwner(fi os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,25 @@
+package metadata
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// statAccessed returns the access time from the stat information in fi.
+func statAccessed(fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Atimespec.Unix()), true
+}
+
+// statCreated returns the birth time from the stat information in fi.
+func statCreated(fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Birthtimespec.Unix()), true
+}
@@ -0,0 +1,22 @@
+package metadata
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// statAccessed returns the access time from the stat information in fi.
+func statAccessed(fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Atim.Unix()), true
+}
+
+// statCreated reports that the birth time is unknown; it requires statx
+// which syscall does not provide.
+func statCreated(fi os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package metadata
+
+import (
+	"os"
+	"time"
+)
+
+// statAccessed reports that the access time is unknown on this platform.
+func statAccessed(fi os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// statCreated reports that the birth time is unknown on this platform.
+func statCreated(fi os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,25 @@
+package metadata
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// statAccessed returns the access time from the file attributes in fi.
+func statAccessed(fi os.FileInfo) (time.Time, bool) {
+	fa, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, fa.LastAccessTime.Nanoseconds()), true
+}
+
+// statCreated returns the creation time from the file attributes in fi.
+func statCreated(fi os.FileInfo) (time.Time, bool) {
+	fa, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, fa.CreationTime.Nanoseconds()), true
+}
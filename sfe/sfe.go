@@ -1,6 +1,7 @@
 package main
 
 import (
+	"compress/gzip"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -10,7 +11,6 @@ import (
 
 	"github.com/marcopeereboom/acdb/debug"
 	"github.com/marcopeereboom/acdb/shared"
-	"github.com/marcopeereboom/goutil"
 )
 
 const (
@@ -32,11 +32,21 @@ func (s *sfe) decrypt(filename string) error {
 		return err
 	}
 
-	// save file
-	out, err := ioutil.TempFile(".", "sfe")
-	defer func() { _ = out.Close() }()
+	// save file, the original name is unknown so name it by type
+	out, err := ioutil.TempFile(".",
+		"sfe*"+shared.MimeExtension(md.MimeType))
+	if err != nil {
+		return err
+	}
 	_, err = out.Write(payload)
 	if err != nil {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		_ = os.Remove(out.Name())
 		return err
 	}
 
@@ -46,8 +56,13 @@ func (s *sfe) decrypt(filename string) error {
 }
 
 func (s *sfe) encrypt(filename string) error {
-	payload, err := shared.FileNaClEncrypt(filename, s.compress,
-		&s.keys.Data)
+	level := gzip.NoCompression
+	if s.compress {
+		level = gzip.DefaultCompression
+	}
+	_, payload, _, err := shared.FileNaClEncrypt(filename,
+		shared.DefaultCompressOptions(level), shared.DigestSHA256,
+		&s.keys.Data, &s.keys.Dedup)
 	if err != nil {
 		return err
 	}
@@ -62,9 +77,18 @@ func (s *sfe) encrypt(filename string) error {
 	}
 
 	out, err := os.OpenFile(outFilename, os.O_CREATE|os.O_RDWR, 0600)
-	defer func() { _ = out.Close() }()
+	if err != nil {
+		return err
+	}
 	_, err = out.Write(payload)
 	if err != nil {
+		_ = out.Close()
+		_ = os.Remove(outFilename)
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		_ = os.Remove(outFilename)
 		return err
 	}
 
@@ -76,8 +100,12 @@ func _main() error {
 	debugTarget := flag.String("l", "-", "debug target file name, - is stdout")
 	compress := flag.Bool("c", false, "try to compress (default = false)")
 	extract := flag.Bool("e", false, "extract files")
+	home := flag.String("home", "", "directory that holds the keys "+
+		"(default $"+shared.HomeEnv+" or ~/"+shared.RootDirectory+")")
 	flag.Parse()
 
+	shared.SetHome(*home)
+
 	args := flag.Args()
 	if len(args) == 0 {
 		fmt.Printf("sfe [-d][-l target] <filename> ...\n")
@@ -92,11 +120,7 @@ func _main() error {
 	s := sfe{
 		compress: *compress,
 	}
-	defer func() {
-		goutil.Zero(s.keys.MD[:])
-		goutil.Zero(s.keys.Data[:])
-		goutil.Zero(s.keys.Dedup[:])
-	}()
+	defer s.keys.Zero()
 
 	// debug target
 	if *debugTarget == "-" {
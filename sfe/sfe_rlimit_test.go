@@ -0,0 +1,163 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/marcopeereboom/acdb/debug"
+)
+
+// testSfe returns an sfe with fixed keys.
+func testSfe() *sfe {
+	s := &sfe{Debugger: debug.NewDebugNil()}
+	for i := range s.keys.Data {
+		s.keys.Data[i] = byte(i)
+		s.keys.Dedup[i] = byte(i + 1)
+	}
+	return s
+}
+
+// limitFileSize makes writes beyond n bytes fail with EFBIG for the
+// duration of t.  Unlike permissions the limit also applies to root.  It
+// applies to the whole process so n must leave room for the files written
+// by go test itself.
+func limitFileSize(t *testing.T, n uint64) {
+	t.Helper()
+
+	var old syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Setrlimit(syscall.RLIMIT_FSIZE,
+		&syscall.Rlimit{Cur: n, Max: old.Max})
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// chdir changes into dir for the duration of t.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		err := os.Chdir(wd)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// dirNames returns the names in dir.
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+// testFile writes 4MB of incompressible data to dir/name.
+func testFile(t *testing.T, dir, name string) ([]byte, string) {
+	t.Helper()
+
+	content := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	filename := filepath.Join(dir, name)
+	err := ioutil.WriteFile(filename, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content, filename
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	content, filename := testFile(t, dir, "file")
+	s := testSfe()
+	err := s.encrypt(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	chdir(t, out)
+	err = s.decrypt(filename + ".sfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := dirNames(t, out)
+	if len(names) != 1 {
+		t.Fatalf("extracted %v", names)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(out, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("content differs")
+	}
+}
+
+func TestEncryptWriteError(t *testing.T) {
+	dir := t.TempDir()
+	_, filename := testFile(t, dir, "file")
+	limitFileSize(t, 1<<20)
+	err := testSfe().encrypt(filename)
+	if err == nil {
+		t.Fatal("encrypt succeeded")
+	}
+	names := dirNames(t, dir)
+	if len(names) != 1 || names[0] != "file" {
+		t.Fatalf("left behind %v", names)
+	}
+}
+
+func TestDecryptWriteError(t *testing.T) {
+	dir := t.TempDir()
+	_, filename := testFile(t, dir, "file")
+	s := testSfe()
+	err := s.encrypt(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	chdir(t, out)
+	limitFileSize(t, 1<<20)
+	err = s.decrypt(filename + ".sfe")
+	if err == nil {
+		t.Fatal("decrypt succeeded")
+	}
+	if names := dirNames(t, out); len(names) != 0 {
+		t.Fatalf("left behind %v", names)
+	}
+}
@@ -0,0 +1,118 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/marcopeereboom/goutil"
+
+	"github.com/marcopeereboom/acdb/internal/random"
+)
+
+// SaltSize is the size of the salt keys are derived with.
+const SaltSize = 32
+
+// derivedMagic starts secrets blobs that hold a salt instead of keys.  The
+// magic is followed by the salt and by the fingerprint of the derived keys,
+// which tells a wrong passphrase apart from a right one.
+var derivedMagic = []byte("acdb derived keys\n")
+
+// derivedKeyInfo are the HKDF infos of the MD, Data and Dedup keys.
+var derivedKeyInfo = []string{"acdb md key", "acdb data key",
+	"acdb dedup key"}
+
+var (
+	ErrNotDerived = errors.New("secrets do not hold a salt")
+	ErrPassphrase = errors.New("passphrase does not match the salt")
+)
+
+// NewSalt returns a new random salt to derive keys with.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	_, err := io.ReadFull(random.Reader, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+// DeriveKeys derives all keys from passphrase and salt.  The passphrase is
+// stretched with scrypt and expanded into the individual keys with HKDF.  The
+// same passphrase and salt always yield the same keys, which keeps dedup
+// working across machines.
+func DeriveKeys(passphrase, salt []byte) (*Keys, error) {
+	master, err := scrypt.Key(passphrase, salt, KeysN, KeysR, KeysP,
+		KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer goutil.Zero(master)
+
+	var k Keys
+	for i, v := range k.fields() {
+		r := hkdf.Expand(sha256.New, master, []byte(derivedKeyInfo[i]))
+		_, err = io.ReadFull(r, v.key[:])
+		if err != nil {
+			k.Zero()
+			return nil, err
+		}
+	}
+
+	return &k, nil
+}
+
+// EncodeDerived returns the secrets blob for keys k derived with salt.
+func EncodeDerived(salt []byte, k *Keys) []byte {
+	fp := k.derivedFingerprint()
+	blob := make([]byte, 0, len(derivedMagic)+len(salt)+len(fp))
+	blob = append(blob, derivedMagic...)
+	blob = append(blob, salt...)
+	return append(blob, fp[:]...)
+}
+
+// IsDerived returns true if secrets blob holds a salt instead of keys.
+func IsDerived(blob []byte) bool {
+	return bytes.HasPrefix(blob, derivedMagic)
+}
+
+// DecodeDerived derives the keys from passphrase and the salt in secrets
+// blob.  It returns ErrPassphrase if the keys do not match the ones the blob
+// was created with.
+func DecodeDerived(passphrase, blob []byte) (*Keys, error) {
+	if !IsDerived(blob) ||
+		len(blob) != len(derivedMagic)+SaltSize+sha256.Size {
+		return nil, ErrNotDerived
+	}
+	salt := blob[len(derivedMagic) : len(derivedMagic)+SaltSize]
+	fp := blob[len(derivedMagic)+SaltSize:]
+
+	k, err := DeriveKeys(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	kfp := k.derivedFingerprint()
+	if !hmac.Equal(kfp[:], fp) {
+		k.Zero()
+		return nil, ErrPassphrase
+	}
+
+	return k, nil
+}
+
+// derivedFingerprint returns a fingerprint of all keys.  It reveals nothing
+// about the keys but differs when any of them does.
+func (k *Keys) derivedFingerprint() [sha256.Size]byte {
+	var fp [sha256.Size]byte
+	mac := hmac.New(sha256.New, k.MD[:])
+	mac.Write(k.Data[:])
+	mac.Write(k.Dedup[:])
+	copy(fp[:], mac.Sum(nil))
+	return fp
+}
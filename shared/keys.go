@@ -0,0 +1,234 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/marcopeereboom/goutil"
+
+	"github.com/marcopeereboom/acdb/internal/random"
+)
+
+// The keys file is a JSON object that maps MD, Data and Dedup to their keys
+// in hex, unless it is encrypted with a password.  Keys files that predate
+// hex store every key as an array of byte values and are still read.  The
+// file is encoded and decoded by hand, in buffers that are zeroed
+// afterwards, so that no copies of the keys are left behind in memory.
+
+// maxKeysSize is the size of the largest keys file that is read.
+const maxKeysSize = 4096
+
+// Scrypt parameters of the keys encrypted with a password.
+const (
+	KeysN = 32768
+	KeysR = 16
+	KeysP = 2
+)
+
+// keysMagic starts keys files that are encrypted with a password.  The
+// magic is followed by the blob of Keys.Encrypt.
+var keysMagic = []byte("acdb encrypted keys\n")
+
+var (
+	ErrKeysTooLarge  = errors.New("keys file too large")
+	ErrKeysInvalid   = errors.New("invalid keys file")
+	ErrKeysEncrypted = errors.New("keys file is encrypted")
+)
+
+// NewKeys returns new random keys.
+func NewKeys() (*Keys, error) {
+	var k Keys
+	for _, v := range k.fields() {
+		_, err := io.ReadFull(random.Reader, v.key[:])
+		if err != nil {
+			k.Zero()
+			return nil, err
+		}
+	}
+
+	return &k, nil
+}
+
+// Zero overwrites all keys.
+func (k *Keys) Zero() {
+	goutil.Zero(k.MD[:])
+	goutil.Zero(k.Data[:])
+	goutil.Zero(k.Dedup[:])
+}
+
+// fields returns the keys by their name in the keys file.
+func (k *Keys) fields() []struct {
+	name string
+	key  *[KeySize]byte
+} {
+	return []struct {
+		name string
+		key  *[KeySize]byte
+	}{
+		{"MD", &k.MD},
+		{"Data", &k.Data},
+		{"Dedup", &k.Dedup},
+	}
+}
+
+// ReadKeys reads keys in the format of the keys file from r.
+func ReadKeys(r io.Reader) (*Keys, error) {
+	var k Keys
+	err := readKeys(r, &k)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// readKeys decodes the keys in r into keys.  Keys is zeroed on error.
+func readKeys(r io.Reader, keys *Keys) error {
+	buf := make([]byte, maxKeysSize+1)
+	defer goutil.Zero(buf)
+
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case err == nil:
+		return ErrKeysTooLarge
+	case err != io.ErrUnexpectedEOF && err != io.EOF:
+		return err
+	case bytes.HasPrefix(buf[:n], keysMagic):
+		return ErrKeysEncrypted
+	}
+
+	// only the keys are copied out of buf, into buffers of their own
+	var raw map[string]json.RawMessage
+	defer func() {
+		for _, v := range raw {
+			goutil.Zero(v)
+		}
+	}()
+	err = json.Unmarshal(buf[:n], &raw)
+	if err != nil {
+		return ErrKeysInvalid
+	}
+
+	for _, v := range keys.fields() {
+		err = decodeKey(raw[v.name], v.key)
+		if err != nil {
+			keys.Zero()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeKey decodes the keys file value v into key.
+func decodeKey(v json.RawMessage, key *[KeySize]byte) error {
+	v = bytes.TrimSpace(v)
+	switch {
+	case len(v) == 2*KeySize+2 && v[0] == '"' && v[len(v)-1] == '"':
+		_, err := hex.Decode(key[:], v[1:len(v)-1])
+		if err != nil {
+			return ErrKeysInvalid
+		}
+
+	case len(v) != 0 && v[0] == '[':
+		b := make([]byte, 0, KeySize)
+		defer func() { goutil.Zero(b) }()
+		err := json.Unmarshal(v, &b)
+		if err != nil || len(b) != KeySize {
+			return ErrKeysInvalid
+		}
+		copy(key[:], b)
+
+	default:
+		return ErrKeysInvalid
+	}
+
+	return nil
+}
+
+// WriteKeys writes k to w in the format of the keys file.
+func WriteKeys(w io.Writer, k *Keys) error {
+	fields := k.fields()
+
+	// {"name":"hex",...}\n
+	size := 2
+	for _, v := range fields {
+		size += len(v.name) + 2*KeySize + 6
+	}
+	buf := make([]byte, 0, size)
+	defer func() { goutil.Zero(buf[:cap(buf)]) }()
+
+	buf = append(buf, '{')
+	for i, v := range fields {
+		if i != 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, '"')
+		buf = append(buf, v.name...)
+		buf = append(buf, `":"`...)
+		n := len(buf)
+		buf = buf[:n+2*KeySize]
+		hex.Encode(buf[n:], v.key[:])
+		buf = append(buf, '"')
+	}
+	buf = append(buf, '}', '\n')
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// LoadEncryptedKeys reads keys file filename, which is encrypted with
+// password, into keys.
+func LoadEncryptedKeys(filename string, password []byte, keys *Keys) error {
+	blob, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(blob, keysMagic) {
+		return ErrKeysInvalid
+	}
+
+	k, err := KeysDecrypt(password, KeysN, KeysR, KeysP,
+		blob[len(keysMagic):])
+	if err != nil {
+		return err
+	}
+	*keys = *k
+	k.Zero()
+
+	return nil
+}
+
+// SaveEncryptedKeys replaces keys file filename with keys encrypted with
+// password.  The file is replaced atomically so that a failure never loses
+// the keys.
+func SaveEncryptedKeys(filename string, password []byte, keys *Keys) error {
+	blob, err := keys.Encrypt(password, KeysN, KeysR, KeysP)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(append([]byte{}, keysMagic...), blob...))
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,164 @@
+package shared
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/marcopeereboom/goutil"
+
+	"github.com/marcopeereboom/acdb/internal/random"
+)
+
+// Keys are split with Shamir's secret sharing over GF(2^8), byte by byte.
+// A share is encoded as
+//	[version][threshold][x][MD Data Dedup evaluated at x][fingerprint]
+// where the fingerprint of the keys tells a successful combination apart
+// from garbage.
+
+const shareVersion = 1
+
+// shareSize is the size of an encoded share.
+const shareSize = 3 + 3*KeySize + 32
+
+var (
+	ErrShareInvalid = errors.New("invalid share")
+	ErrShares       = errors.New("shares do not combine into keys")
+)
+
+// gfExp and gfLog are the exponent and logarithm tables of GF(2^8) with
+// the AES polynomial and generator 3.
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+		// multiply by 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// SplitKeys splits k into n shares any threshold of which combine into k
+// again, see CombineKeys.  Fewer shares reveal nothing about k.
+func SplitKeys(k *Keys, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || n < threshold || n > 255 {
+		return nil, fmt.Errorf("invalid split: %v of %v shares",
+			threshold, n)
+	}
+
+	secret := make([]byte, 0, 3*KeySize)
+	for _, v := range k.fields() {
+		secret = append(secret, v.key[:]...)
+	}
+	defer goutil.Zero(secret)
+	fp := k.derivedFingerprint()
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		s := make([]byte, 3, shareSize)
+		s[0], s[1], s[2] = shareVersion, byte(threshold), byte(i+1)
+		shares[i] = s
+	}
+
+	// coefficients of the polynomial of the current byte, the constant
+	// term is the byte itself
+	coef := make([]byte, threshold)
+	defer goutil.Zero(coef)
+	for _, b := range secret {
+		coef[0] = b
+		_, err := io.ReadFull(random.Reader, coef[1:])
+		if err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner
+			var y byte
+			for j := threshold - 1; j >= 0; j-- {
+				y = gfMul(y, x) ^ coef[j]
+			}
+			shares[i] = append(shares[i], y)
+		}
+	}
+	for i := range shares {
+		shares[i] = append(shares[i], fp[:]...)
+	}
+
+	return shares, nil
+}
+
+// CombineKeys combines shares created by SplitKeys into keys.  It returns
+// ErrShares if there are too few shares or if they do not belong together.
+func CombineKeys(shares [][]byte) (*Keys, error) {
+	if len(shares) == 0 {
+		return nil, ErrShares
+	}
+	seen := make(map[byte]bool)
+	for _, s := range shares {
+		if len(s) != shareSize || s[0] != shareVersion || s[2] == 0 ||
+			s[1] != shares[0][1] {
+			return nil, ErrShareInvalid
+		}
+		if seen[s[2]] {
+			return nil, fmt.Errorf("duplicate share %v", s[2])
+		}
+		seen[s[2]] = true
+	}
+	threshold := int(shares[0][1])
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("%v shares required, got %v", threshold,
+			len(shares))
+	}
+	shares = shares[:threshold]
+
+	// Lagrange interpolation at 0
+	secret := make([]byte, 3*KeySize)
+	defer goutil.Zero(secret)
+	for i, si := range shares {
+		xi := si[2]
+		l := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				l = gfMul(l, gfDiv(sj[2], sj[2]^xi))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(si[3+b], l)
+		}
+	}
+
+	var k Keys
+	for i, v := range k.fields() {
+		copy(v.key[:], secret[i*KeySize:])
+	}
+	fp := k.derivedFingerprint()
+	if !hmac.Equal(fp[:], shares[0][3+3*KeySize:]) {
+		k.Zero()
+		return nil, ErrShares
+	}
+
+	return &k, nil
+}
@@ -0,0 +1,130 @@
+package shared
+
+import (
+	"testing"
+)
+
+// subsets returns the subsets of shares picked by every bit mask.
+func subsets(shares [][]byte) [][][]byte {
+	var r [][][]byte
+	for mask := 1; mask < 1<<len(shares); mask++ {
+		var s [][]byte
+		for i := range shares {
+			if mask&(1<<i) != 0 {
+				s = append(s, shares[i])
+			}
+		}
+		r = append(r, s)
+	}
+	return r
+}
+
+// copyShares returns a deep copy of shares.
+func copyShares(shares [][]byte) [][]byte {
+	r := make([][]byte, len(shares))
+	for i, v := range shares {
+		r[i] = append([]byte(nil), v...)
+	}
+	return r
+}
+
+func TestSplitKeys(t *testing.T) {
+	k := testKeys()
+	for n := 2; n <= 5; n++ {
+		for threshold := 2; threshold <= n; threshold++ {
+			shares, err := SplitKeys(k, n, threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range subsets(shares) {
+				got, err := CombineKeys(s)
+				if len(s) < threshold {
+					if err == nil {
+						t.Fatalf("%v of %v: combined %v "+
+							"shares", threshold, n, len(s))
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%v of %v: %v", threshold, n, err)
+				}
+				if *got != *k {
+					t.Fatalf("%v of %v: wrong keys", threshold, n)
+				}
+			}
+		}
+	}
+}
+
+func TestCombineTooFewShares(t *testing.T) {
+	// claim a lower threshold so that the shares are interpolated
+	shares, err := SplitKeys(testKeys(), 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range subsets(shares) {
+		if len(s) != 2 {
+			continue
+		}
+		s = copyShares(s)
+		for _, v := range s {
+			v[1] = 2
+		}
+		_, err = CombineKeys(s)
+		if err != ErrShares {
+			t.Fatalf("got %v, want %v", err, ErrShares)
+		}
+	}
+}
+
+func TestCombineInvalidShares(t *testing.T) {
+	shares, err := SplitKeys(testKeys(), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		shares func(s [][]byte) [][]byte
+	}{
+		{"none", func(s [][]byte) [][]byte { return nil }},
+		{"duplicate", func(s [][]byte) [][]byte {
+			return [][]byte{s[0], s[0]}
+		}},
+		{"duplicate x", func(s [][]byte) [][]byte {
+			s[1][2] = s[0][2]
+			return s[:2]
+		}},
+		{"zero x", func(s [][]byte) [][]byte {
+			s[0][2] = 0
+			return s[:2]
+		}},
+		{"threshold", func(s [][]byte) [][]byte {
+			s[0][1] = 3
+			return s
+		}},
+		{"version", func(s [][]byte) [][]byte {
+			s[0][0] = shareVersion + 1
+			return s[:2]
+		}},
+		{"short", func(s [][]byte) [][]byte {
+			s[0] = s[0][:shareSize-1]
+			return s[:2]
+		}},
+		{"other keys", func(s [][]byte) [][]byte {
+			other, err := SplitKeys(&Keys{}, 3, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return [][]byte{s[0], other[1]}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := CombineKeys(tt.shares(copyShares(shares)))
+			if err == nil {
+				t.Fatalf("combined into %x", k.MD)
+			}
+		})
+	}
+}
@@ -4,24 +4,32 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"crypto/rand"
+	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math"
+	"net/http"
 	"os"
 	"os/user"
 	"path"
+	"runtime"
+	"strings"
 
 	"github.com/davecgh/go-xdr/xdr2"
 	"github.com/klauspost/pgzip"
 
+	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/scrypt"
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/marcopeereboom/goutil"
+
+	"github.com/marcopeereboom/acdb/internal/random"
 )
 
 const (
@@ -29,6 +37,13 @@ const (
 	TokenFilename    = "acd-token.json"
 	KeysFilename     = "keys.json"
 	PasswordFilename = "password"
+	ConfigFilename   = "config.json"
+	CacheFilename    = "cache.json"
+	ResumeFilename   = "resume.json"
+	IndexFilename    = "index"
+
+	HomeEnv     = "ACDB_HOME"     // overrides RootDirectory
+	PasswordEnv = "ACDB_PASSWORD" // supplies password non-interactively
 )
 
 type Keys struct {
@@ -39,15 +54,66 @@ type Keys struct {
 
 // internal metadata
 const (
-	Version = 1
+	Version = 2
+
+	// versionNoAlgorithm is the version of payload headers that predate
+	// Algorithm; their digests are SHA-256.
+	versionNoAlgorithm = 1
 
 	KeySize   = 32
 	NonceSize = 24
+
+	// maxMimeType is the longest MIME type that is decoded from a
+	// payload header.
+	maxMimeType = 1024
+
+	// maxKeysBlob is the largest keys blob KeysDecrypt accepts, well
+	// above the salt, nonce and sealed Keys.
+	maxKeysBlob = 4096
+)
+
+// compressibility estimation
+const (
+	// CompressSampleSize is the number of bytes at the head of a file that
+	// are used to estimate MIME type and compressibility.
+	CompressSampleSize = 64 * 1024
+
+	// CompressMaxEntropy is the Shannon entropy, in bits per byte, above
+	// which a sample is considered incompressible.
+	CompressMaxEntropy = 7.5
+
+	// CompressMaxRatio is the compressed to uncompressed size ratio of the
+	// sample above which compression is skipped.
+	CompressMaxRatio = 0.9
+
+	// CompressParallelSize is the content size above which pgzip is used
+	// instead of gzip; below it pgzip's setup cost outweighs the gain.
+	// See https://github.com/klauspost/pgzip.
+	CompressParallelSize = 1024 * 1024
+
+	// CompressBlockSize is the default pgzip block size.
+	CompressBlockSize = 1024 * 1024
 )
 
 var (
+	// Magic identifies an encrypted container and its format version.
+	Magic = [4]byte{'S', 'F', 'E', '1'}
+
+	ErrNotSFE = errors.New("not an sfe file")
+
 	CompNone = [4]byte{'n', 'o', 'n', 'e'}
 	CompGZIP = [4]byte{'g', 'z', 'i', 'p'}
+
+	ErrAlgorithm = errors.New("invalid digest algorithm")
+	ErrDigest    = errors.New("payload digest mismatch")
+
+	// DigestSHA256 selects SHA-256 payload digests and HMAC-SHA256 dedup
+	// digests.
+	DigestSHA256 = [4]byte{'s', '2', '5', '6'}
+
+	// DigestBLAKE2b selects BLAKE2b-256 payload digests and keyed
+	// BLAKE2b-256 dedup digests.
+	DigestBLAKE2b = [4]byte{'b', '2', 'b'}
 )
 
 type Header struct {
@@ -56,6 +122,92 @@ type Header struct {
 	Size        uint64            // payload size
 	Digest      [sha256.Size]byte // payload digest
 	MimeType    string            // MIME type
+	Algorithm   [4]byte           // digest algorithm, absent in version 1
+
+	// compressed is the content size after compression.  It is not
+	// encoded since it is unexported.
+	compressed int
+}
+
+// CompressedSize returns the size of the, possibly compressed, content of
+// the payload that NaClEncrypt returned h with, i.e. the payload without its
+// magic, nonce, header and encryption overhead.  It is 0 for headers that
+// were not returned by NaClEncrypt.
+func (h *Header) CompressedSize() int {
+	return h.compressed
+}
+
+// NewDigest returns the payload digest for algorithm alg.
+func NewDigest(alg [4]byte) (hash.Hash, error) {
+	switch alg {
+	case DigestSHA256:
+		return sha256.New(), nil
+	case DigestBLAKE2b:
+		return blake2b.New256(nil)
+	}
+	return nil, ErrAlgorithm
+}
+
+// NewMAC returns the dedup digest, keyed with key, for algorithm alg.
+func NewMAC(alg [4]byte, key []byte) (hash.Hash, error) {
+	switch alg {
+	case DigestSHA256:
+		return hmac.New(sha256.New, key), nil
+	case DigestBLAKE2b:
+		return blake2b.New256(key)
+	}
+	return nil, ErrAlgorithm
+}
+
+// ParseAlgorithm returns the digest algorithm called name.
+func ParseAlgorithm(name string) ([4]byte, error) {
+	switch name {
+	case "sha256":
+		return DigestSHA256, nil
+	case "blake2b":
+		return DigestBLAKE2b, nil
+	}
+	return [4]byte{}, ErrAlgorithm
+}
+
+// FileDigest returns the payload digest of filename for algorithm alg.
+func FileDigest(alg [4]byte, filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	return ReaderDigest(alg, f)
+}
+
+// ReaderDigest returns the payload digest of the content of r for algorithm
+// alg.
+func ReaderDigest(alg [4]byte, r io.Reader) ([]byte, error) {
+	h, err := NewDigest(alg)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// dedupFingerprintLabel is the constant whose HMAC fingerprints the dedup
+// key.
+const dedupFingerprintLabel = "acdb dedup key fingerprint"
+
+// DedupFingerprint returns a fingerprint of the dedup key.  It reveals
+// nothing about the key but differs when the key does.
+func (k *Keys) DedupFingerprint() [sha256.Size]byte {
+	var fp [sha256.Size]byte
+	mac := hmac.New(sha256.New, k.Dedup[:])
+	mac.Write([]byte(dedupFingerprintLabel))
+	copy(fp[:], mac.Sum(nil))
+	return fp
 }
 
 // Encrypt returns an encrypted Keys blob.  The format of the blob is
@@ -63,6 +215,10 @@ type Header struct {
 func (k *Keys) Encrypt(password []byte, N, r, p int) ([]byte, error) {
 	// encode Keys
 	var keysXDR bytes.Buffer
+	// room for all keys so that the buffer never moves and leaves
+	// copies behind
+	keysXDR.Grow(3 * (4 + KeySize))
+	defer func() { goutil.Zero(keysXDR.Bytes()) }()
 	_, err := xdr.Marshal(&keysXDR, k)
 	if err != nil {
 		return nil, err
@@ -70,7 +226,7 @@ func (k *Keys) Encrypt(password []byte, N, r, p int) ([]byte, error) {
 
 	// generate a derived key
 	var salt [KeySize]byte
-	_, err = io.ReadFull(rand.Reader, salt[:])
+	_, err = io.ReadFull(random.Reader, salt[:])
 	if err != nil {
 		return nil, err
 	}
@@ -81,9 +237,7 @@ func (k *Keys) Encrypt(password []byte, N, r, p int) ([]byte, error) {
 	var key [KeySize]byte
 	copy(key[:], dk)
 	goutil.Zero(dk)
-	go func() {
-		goutil.Zero(key[:])
-	}()
+	defer goutil.Zero(key[:])
 
 	// encrypt KeySafe
 	nonce, err := NaClNonce()
@@ -123,6 +277,13 @@ func (k *Keys) Encrypt(password []byte, N, r, p int) ([]byte, error) {
 func KeysDecrypt(password []byte, N, r, p int,
 	blob []byte) (*Keys, error) {
 
+	if len(blob) < KeySize+NonceSize+secretbox.Overhead {
+		return nil, fmt.Errorf("keys blob too short: %v", len(blob))
+	}
+	if len(blob) > maxKeysBlob {
+		return nil, fmt.Errorf("keys blob too long: %v", len(blob))
+	}
+
 	var (
 		salt  [KeySize]byte
 		nonce [NonceSize]byte
@@ -139,24 +300,41 @@ func KeysDecrypt(password []byte, N, r, p int,
 	var key [KeySize]byte
 	copy(key[:], dk)
 	goutil.Zero(dk)
-	go func() {
-		goutil.Zero(key[:])
-	}()
+	defer goutil.Zero(key[:])
 
 	ksXDR, ok := secretbox.Open(nil, blob[KeySize+NonceSize:], &nonce, &key)
 	if !ok {
 		return nil, fmt.Errorf("could not decrypt")
 	}
+	defer goutil.Zero(ksXDR)
 
 	k := Keys{}
 	_, err = xdr.Unmarshal(bytes.NewReader(ksXDR), &k)
 	if err != nil {
+		k.Zero()
 		return nil, fmt.Errorf("could not unmarshal")
 	}
 
 	return &k, nil
 }
 
+// openTerminal returns the terminal to read a password from: stdin if it is
+// one and the controlling terminal otherwise, e.g. when stdin carries a tar
+// stream.
+func openTerminal() (fd int, closeTerminal func(), err error) {
+	if terminal.IsTerminal(0) {
+		return 0, func() {}, nil
+	}
+	f, err := os.Open("/dev/tty")
+	if err != nil {
+		return 0, nil, fmt.Errorf("no terminal to read the password "+
+			"from: %v", err)
+	}
+	return int(f.Fd()), func() { _ = f.Close() }, nil
+}
+
+// PromptPassword reads a password twice from the terminal and, if save is
+// set, writes it to the password file.
 func PromptPassword(save bool) ([]byte, error) {
 	var (
 		p1, p2 []byte
@@ -166,14 +344,20 @@ func PromptPassword(save bool) ([]byte, error) {
 		goutil.Zero(p2)
 	}()
 
+	fd, closeTerminal, err := openTerminal()
+	if err != nil {
+		return nil, err
+	}
+	defer closeTerminal()
+
 	for {
 		fmt.Printf("Password: ")
-		p1, err = terminal.ReadPassword(0)
+		p1, err = terminal.ReadPassword(fd)
 		if err != nil {
 			return nil, err
 		}
 		fmt.Printf("\nAgain   : ")
-		p2, err = terminal.ReadPassword(0)
+		p2, err = terminal.ReadPassword(fd)
 		if err != nil {
 			return nil, err
 		}
@@ -195,21 +379,101 @@ func PromptPassword(save bool) ([]byte, error) {
 	return p1, nil
 }
 
-func DefaultPasswordFilename() (string, error) {
+// home overrides the root directory when set.
+var home string
+
+// SetHome overrides the root directory returned by DefaultRootDirectory.  An
+// empty dir restores the default behavior.
+func SetHome(dir string) {
+	home = dir
+}
+
+// DefaultRootDirectory returns the directory that holds keys, password,
+// token and configuration.  This is the directory set with SetHome, if set,
+// otherwise the HomeEnv environment variable, if set, otherwise RootDirectory
+// in the home directory of the current user.
+func DefaultRootDirectory() (string, error) {
+	if home != "" {
+		return home, nil
+	}
+	if dir := os.Getenv(HomeEnv); dir != "" {
+		return dir, nil
+	}
+
 	usr, err := user.Current()
 	if err != nil {
 		return "", err
 	}
 
-	return path.Join(usr.HomeDir, RootDirectory, PasswordFilename), nil
+	return path.Join(usr.HomeDir, RootDirectory), nil
+}
+
+// EnvPassword returns the password supplied through the PasswordEnv
+// environment variable.  The variable is cleared so that it is not inherited
+// by child processes.  It returns nil if the variable is not set.
+func EnvPassword() []byte {
+	password, ok := os.LookupEnv(PasswordEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(PasswordEnv)
+
+	return []byte(password)
+}
+
+// ReadPasswordFd reads the password from file descriptor fd.  The password
+// ends at the first newline or at end of file.
+func ReadPasswordFd(fd int) ([]byte, error) {
+	f := os.NewFile(uintptr(fd), "password")
+	if f == nil {
+		return nil, fmt.Errorf("invalid password file descriptor: %v",
+			fd)
+	}
+	defer func() { _ = f.Close() }()
+
+	password, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(password, '\n'); i >= 0 {
+		goutil.Zero(password[i:])
+		password = password[:i]
+	}
+	if len(password) == 0 {
+		return nil, fmt.Errorf("empty password on file descriptor %v",
+			fd)
+	}
+
+	return password, nil
+}
+
+func DefaultPasswordFilename() (string, error) {
+	root, err := DefaultRootDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(root, PasswordFilename), nil
 }
 
+// ReadPassword returns the content of the password file.  Much like ssh
+// does for private keys, a password file that is accessible by group or
+// others is refused.
 func ReadPassword() ([]byte, error) {
 	filename, err := DefaultPasswordFilename()
 	if err != nil {
 		return nil, err
 	}
 
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("permissions %04o for %v are too open, "+
+			"run chmod 600 %v", fi.Mode().Perm(), filename, filename)
+	}
+
 	password, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -228,55 +492,56 @@ func WritePassword(password []byte) error {
 }
 
 func DefaultKeysFilename() (string, error) {
-	usr, err := user.Current()
+	root, err := DefaultRootDirectory()
 	if err != nil {
 		return "", err
 	}
 
-	return path.Join(usr.HomeDir, RootDirectory, KeysFilename), nil
+	return path.Join(root, KeysFilename), nil
 }
 
-func CreateNewKeys(filename string) error {
-	k := Keys{}
-
-	_, err := io.ReadFull(rand.Reader, k.MD[:])
+func DefaultConfigFilename() (string, error) {
+	root, err := DefaultRootDirectory()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	_, err = io.ReadFull(rand.Reader, k.Data[:])
-	if err != nil {
-		return err
-	}
+	return path.Join(root, ConfigFilename), nil
+}
 
-	_, err = io.ReadFull(rand.Reader, k.Dedup[:])
+func CreateNewKeys(filename string) error {
+	k, err := NewKeys()
 	if err != nil {
 		return err
 	}
+	defer k.Zero()
 
-	dir := path.Dir(filename)
+	return SaveKeys(filename, k)
+}
 
-	err = os.MkdirAll(dir, 0700)
+// SaveKeys writes k to keys file filename, which must not exist yet.
+func SaveKeys(filename string, k *Keys) error {
+	err := os.MkdirAll(path.Dir(filename), 0700)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
-	defer func() { _ = f.Close() }()
-
-	e := json.NewEncoder(f)
-	err = e.Encode(k)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+		0600)
 	if err != nil {
 		return err
 	}
+	err = WriteKeys(f, k)
+	if e := f.Close(); err == nil {
+		err = e
+	}
 
-	goutil.Zero(k.MD[:])
-	goutil.Zero(k.Data[:])
-	goutil.Zero(k.Dedup[:])
-
-	return nil
+	return err
 }
 
+// LoadKeys reads the keys file filename into keys.  New keys are created
+// when the file does not exist.  It returns ErrKeysEncrypted if the file is
+// encrypted, see LoadEncryptedKeys.
 func LoadKeys(filename string, keys *Keys) error {
 	_, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -292,109 +557,345 @@ func LoadKeys(filename string, keys *Keys) error {
 	}
 	defer func() { _ = f.Close() }()
 
-	d := json.NewDecoder(f)
-	err = d.Decode(keys)
+	return readKeys(f, keys)
+}
+
+// mimeExtensions maps the MIME types reported by http.DetectContentType to
+// file name extensions.
+var mimeExtensions = map[string]string{
+	"application/ogg":               ".ogg",
+	"application/pdf":               ".pdf",
+	"application/postscript":        ".ps",
+	"application/vnd.ms-fontobject": ".eot",
+	"application/wasm":              ".wasm",
+	"application/x-gzip":            ".gz",
+	"application/x-rar-compressed":  ".rar",
+	"application/zip":               ".zip",
+	"audio/aiff":                    ".aiff",
+	"audio/basic":                   ".au",
+	"audio/midi":                    ".mid",
+	"audio/mpeg":                    ".mp3",
+	"audio/wave":                    ".wav",
+	"font/otf":                      ".otf",
+	"font/ttf":                      ".ttf",
+	"font/woff":                     ".woff",
+	"font/woff2":                    ".woff2",
+	"image/bmp":                     ".bmp",
+	"image/gif":                     ".gif",
+	"image/jpeg":                    ".jpg",
+	"image/png":                     ".png",
+	"image/webp":                    ".webp",
+	"image/x-icon":                  ".ico",
+	"text/html":                     ".html",
+	"text/plain":                    ".txt",
+	"text/xml":                      ".xml",
+	"video/avi":                     ".avi",
+	"video/mp4":                     ".mp4",
+	"video/webm":                    ".webm",
+}
+
+// MimeExtension returns the file name extension, including the dot, for
+// MIME type mime.  It returns an empty string for unknown types.
+func MimeExtension(mime string) string {
+	if i := strings.Index(mime, ";"); i != -1 {
+		mime = mime[:i]
+	}
+	return mimeExtensions[strings.TrimSpace(mime)]
+}
+
+// Compressible returns the MIME type of sample and whether its byte entropy
+// is low enough to make compression worthwhile.
+func Compressible(sample []byte) (string, bool) {
+	mime := http.DetectContentType(sample)
+	if len(sample) == 0 {
+		return mime, false
+	}
+
+	var freq [256]int
+	for _, v := range sample {
+		freq[v]++
+	}
+
+	var entropy float64
+	total := float64(len(sample))
+	for _, v := range freq {
+		if v == 0 {
+			continue
+		}
+		p := float64(v) / total
+		entropy -= p * math.Log2(p)
+	}
+
+	return mime, entropy < CompressMaxEntropy
+}
+
+// compressRatio returns the ratio between the gzip compressed and the
+// uncompressed size of sample.
+func compressRatio(sample []byte) (float64, error) {
+	if len(sample) == 0 {
+		return 1, nil
+	}
+
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write(sample)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	err = w.Close()
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	return float64(b.Len()) / float64(len(sample)), nil
+}
+
+// compression decisions
+const (
+	CompressAuto   = iota // compress when the content looks compressible
+	CompressAlways        // compress regardless of the content
+	CompressNever         // never compress
+)
+
+// CompressOptions tunes payload compression.
+type CompressOptions struct {
+	Level     int // gzip level, gzip.NoCompression disables compression
+	Mode      int // CompressAuto, CompressAlways or CompressNever
+	BlockSize int // pgzip block size in bytes
+	Blocks    int // pgzip blocks compressed in parallel
+}
+
+// DefaultCompressOptions returns the options used to compress with level:
+// pgzip compresses one block per CPU.
+func DefaultCompressOptions(level int) *CompressOptions {
+	return &CompressOptions{
+		Level:     level,
+		BlockSize: CompressBlockSize,
+		Blocks:    runtime.NumCPU(),
+	}
 }
 
 func NaClNonce() (*[NonceSize]byte, error) {
 	n := [NonceSize]byte{}
-	_, err := io.ReadFull(rand.Reader, n[:])
+	_, err := io.ReadFull(random.Reader, n[:])
 	if err != nil {
 		return nil, err
 	}
 	return &n, nil
 }
 
-func FileNaClEncrypt(filename string, compress bool,
-	key *[KeySize]byte) ([]byte, error) {
+// FileNaClEncrypt compresses (when requested and deemed worthwhile) and
+// encrypts filename with key.  See NaClEncrypt for details.  The header Size
+// is the number of bytes actually read which differs from the size reported
+// by stat if the file changed while being read.
+func FileNaClEncrypt(filename string, co *CompressOptions, alg [4]byte,
+	key, dedup *[KeySize]byte) (*Header, []byte, *[sha256.Size]byte,
+	error) {
 
-	fd, err := goutil.FileSHA256(filename)
+	// set up reader
+	f, err := os.Open(filename)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return NaClEncrypt(f, fi.Size(), co, alg, key, dedup)
+}
+
+// FileDedupDigest reads filename once and returns the dedup digest,
+// keyed with dedup, that FileNaClEncrypt would return for it.  The returned
+// header carries the size, payload digest and MIME type; compression is not
+// decided since nothing is compressed.  This lets callers check whether a
+// payload already exists before paying for compression and encryption.
+func FileDedupDigest(filename string, alg [4]byte,
+	dedup *[KeySize]byte) (*Header, *[sha256.Size]byte, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	return DedupDigest(f, alg, dedup)
+}
+
+// DedupDigest is FileDedupDigest for the content of r.
+func DedupDigest(r io.Reader, alg [4]byte,
+	dedup *[KeySize]byte) (*Header, *[sha256.Size]byte, error) {
 
-	// test compressible
-	var comp bool
 	payloadHeader := Header{
 		Version:     Version,
-		Digest:      *fd,
 		Compression: CompNone,
+		Algorithm:   alg,
 	}
-	payloadHeader.MimeType, comp, err = goutil.FileCompressible(filename)
+	digest, err := NewDigest(alg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if compress {
-		if comp {
-			payloadHeader.Compression = CompGZIP
-		}
-	} else {
-		comp = false
+	mac, err := NewMAC(alg, dedup[:])
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// set up reader
-	f, err := os.Open(filename)
+	sample := make([]byte, CompressSampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, err
+	}
+	sample = sample[:n]
+	payloadHeader.MimeType, _ = Compressible(sample)
+
+	n64, err := io.Copy(io.MultiWriter(digest, mac),
+		io.MultiReader(bytes.NewReader(sample), r))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer func() { _ = f.Close() }()
+	payloadHeader.Size = uint64(n64)
+	copy(payloadHeader.Digest[:], digest.Sum(nil))
 
-	fi, err := f.Stat()
+	var macDigest [sha256.Size]byte
+	copy(macDigest[:], mac.Sum(nil))
+
+	return &payloadHeader, &macDigest, nil
+}
+
+// NaClEncrypt compresses (when requested and deemed worthwhile) and encrypts
+// the content of r with key.  Co selects the compression level and tunes
+// parallel compression.  Size is the expected content size and is only used
+// to pick a compressor.  The content is read exactly once; the payload
+// digest and the dedup digest (keyed with dedup), both using algorithm alg,
+// are calculated while the content streams through the compressor and the
+// MIME type and compressibility are estimated from the first
+// CompressSampleSize bytes of that same read.  The payload header is returned
+// alongside the encrypted payload and HMAC so that callers do not have to
+// read the content again.
+func NaClEncrypt(r io.Reader, size int64, co *CompressOptions, alg [4]byte,
+	key, dedup *[KeySize]byte) (*Header, []byte, *[sha256.Size]byte,
+	error) {
+
+	payloadHeader := Header{
+		Version:     Version,
+		Compression: CompNone,
+		Algorithm:   alg,
+	}
+	digest, err := NewDigest(alg)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	mac, err := NewMAC(alg, dedup[:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// test compressible using the head of the file
+	sample := make([]byte, CompressSampleSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, nil, err
+	}
+	sample = sample[:n]
+	var comp bool
+	payloadHeader.MimeType, comp = Compressible(sample)
+	switch {
+	case co.Level == gzip.NoCompression || co.Mode == CompressNever:
+		comp = false
+	case co.Mode == CompressAlways:
+		comp = true
+	case comp:
+		// MIME type and entropy are only a guess so verify by
+		// actually compressing the sample
+		ratio, err := compressRatio(sample)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		comp = ratio <= CompressMaxRatio
+	}
+	if comp {
+		payloadHeader.Compression = CompGZIP
 	}
-	payloadHeader.Size = uint64(fi.Size())
 
-	// encode payload [nonce][blob]
+	// encode payload [magic][nonce][blob]
 	var payload bytes.Buffer
 	pw := bufio.NewWriter(&payload)
 
+	// magic
+	_, err = pw.Write(Magic[:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	// nonce
 	nonce, err := NaClNonce()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	_, err = pw.Write(nonce[:])
 	if err != nil {
-		return nil, err
-	}
-
-	// create payload
-	var b bytes.Buffer
-
-	// can't encode directly into b because of appended 0x0a
-	_, err = xdr.Marshal(&b, payloadHeader)
-	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
+	// file content goes into its own buffer since the header, which
+	// carries the digest, can only be encoded once the file was read
+	var content bytes.Buffer
 	var w io.Writer
 	if comp {
-		// per https://github.com/klauspost/pgzip use pgzip on > 1MB
-		if fi.Size() > 1024*1024 {
-			w = pgzip.NewWriter(&b)
+		if size > CompressParallelSize {
+			var pw *pgzip.Writer
+			pw, err = pgzip.NewWriterLevel(&content, co.Level)
+			if err == nil {
+				err = pw.SetConcurrency(co.BlockSize, co.Blocks)
+			}
+			w = pw
 		} else {
-			w = gzip.NewWriter(&b)
+			w, err = gzip.NewWriterLevel(&content, co.Level)
+		}
+		if err != nil {
+			return nil, nil, nil, err
 		}
 	} else {
-		w = bufio.NewWriter(&b)
+		w = bufio.NewWriter(&content)
 	}
 
-	// file content
-	_, err = io.Copy(w, f)
+	// single pass over the file
+	n64, err := io.Copy(io.MultiWriter(digest, mac, w),
+		io.MultiReader(bytes.NewReader(sample), r))
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+
+	// record what was actually read; the file may have changed size
+	payloadHeader.Size = uint64(n64)
 	_, ok := w.(io.WriteCloser)
 	if ok {
-		w.(io.WriteCloser).Close()
+		err = w.(io.WriteCloser).Close()
 	} else {
-		w.(*bufio.Writer).Flush()
+		err = w.(*bufio.Writer).Flush()
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	copy(payloadHeader.Digest[:], digest.Sum(nil))
+	payloadHeader.compressed = content.Len()
+
+	var macDigest [sha256.Size]byte
+	copy(macDigest[:], mac.Sum(nil))
+
+	// create payload
+	var b bytes.Buffer
+
+	// can't encode directly into b because of appended 0x0a
+	_, err = xdr.Marshal(&b, payloadHeader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, err = content.WriteTo(&b)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
 	// encrypt
@@ -404,7 +905,7 @@ func FileNaClEncrypt(filename string, compress bool,
 	pw.Write(encryptedPayload)
 	pw.Flush()
 
-	return payload.Bytes(), nil
+	return &payloadHeader, payload.Bytes(), &macDigest, nil
 }
 
 func FileNaClDecrypt(filename string, key *[KeySize]byte) (*Header, []byte,
@@ -418,8 +919,23 @@ func FileNaClDecrypt(filename string, key *[KeySize]byte) (*Header, []byte,
 	return NaClDecrypt(body, key)
 }
 
+// NaClDecrypt decrypts a container created by FileNaClEncrypt.  Containers
+// that predate Magic are still accepted however if such a container does not
+// decrypt it is reported as ErrNotSFE.
 func NaClDecrypt(body []byte, key *[KeySize]byte) (*Header, []byte, error) {
 
+	legacy := !bytes.HasPrefix(body, Magic[:])
+	if !legacy {
+		body = body[len(Magic):]
+	}
+
+	if len(body) < NonceSize+secretbox.Overhead {
+		if legacy {
+			return nil, nil, ErrNotSFE
+		}
+		return nil, nil, fmt.Errorf("body too short: %v", len(body))
+	}
+
 	// obtain nonce
 	var nonce [NonceSize]byte
 	copy(nonce[:], body[:NonceSize])
@@ -427,16 +943,43 @@ func NaClDecrypt(body []byte, key *[KeySize]byte) (*Header, []byte, error) {
 	// decrypt payload
 	payload, ok := secretbox.Open(nil, body[NonceSize:], &nonce, key)
 	if !ok {
+		if legacy {
+			return nil, nil, ErrNotSFE
+		}
 		return nil, nil, fmt.Errorf("could not decrypt body")
 	}
 
 	// deal with actual payload
 	r := bytes.NewReader(payload)
 
-	// decode header
-	d := xdr.NewDecoder(r)
+	// decode header, field by field since its layout depends on the
+	// version; the MIME type is the only variable length field
+	d := xdr.NewDecoderLimited(r, maxMimeType)
 	var mh Header
-	_, err := d.Decode(&mh)
+	_, err := d.Decode(&mh.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range []interface{}{&mh.Compression, &mh.Size, &mh.Digest,
+		&mh.MimeType} {
+		_, err = d.Decode(v)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	switch mh.Version {
+	case versionNoAlgorithm:
+		mh.Algorithm = DigestSHA256
+	case Version:
+		_, err = d.Decode(&mh.Algorithm)
+		if err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("invalid payload version: %v",
+			mh.Version)
+	}
+	digest, err := NewDigest(mh.Algorithm)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -461,13 +1004,23 @@ func NaClDecrypt(body []byte, key *[KeySize]byte) (*Header, []byte, error) {
 	var cleartext bytes.Buffer
 	f := bufio.NewWriter(&cleartext)
 
-	// read left over from the xdr reader
-	_, err = io.Copy(f, rd)
+	// read left over from the xdr reader, never more than the header
+	// claims so that a corrupt payload can not decompress without bounds
+	n, err := io.Copy(io.MultiWriter(f, digest),
+		io.LimitReader(rd, int64(mh.Size)+1))
 	if err != nil {
 		return nil, nil, err
 	}
+	if uint64(n) != mh.Size {
+		return nil, nil, fmt.Errorf("payload size %v, expected %v", n,
+			mh.Size)
+	}
 
 	f.Flush()
 
+	if !hmac.Equal(digest.Sum(nil), mh.Digest[:]) {
+		return nil, nil, ErrDigest
+	}
+
 	return &mh, cleartext.Bytes(), nil
 }
@@ -0,0 +1,370 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/davecgh/go-xdr/xdr2"
+	"github.com/marcopeereboom/acdb/internal/random"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// fuzz scrypt parameters, the real ones make every iteration take seconds
+const (
+	fuzzN = 16
+	fuzzR = 1
+	fuzzP = 1
+)
+
+// testKeys returns fixed keys so that tests do not depend on randomness.
+func testKeys() *Keys {
+	var k Keys
+	for i := range k.MD {
+		k.MD[i] = byte(i)
+		k.Data[i] = byte(i + 1)
+		k.Dedup[i] = byte(i + 2)
+	}
+	return &k
+}
+
+// FuzzNaClDecrypt feeds containers to NaClDecrypt.  With seal set the input
+// is sealed with the key first so that the payload header and compression
+// decoding are reached despite the authenticator.
+func FuzzNaClDecrypt(f *testing.F) {
+	k := testKeys()
+	var nonce [NonceSize]byte
+	for _, content := range [][]byte{
+		nil,
+		[]byte("hello world"),
+		bytes.Repeat([]byte("compressible "), 1000),
+	} {
+		co := DefaultCompressOptions(0)
+		_, payload, _, err := NaClEncrypt(bytes.NewReader(content),
+			int64(len(content)), co, DigestSHA256, &k.Data, &k.Dedup)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(payload, false)
+
+		body := payload[len(Magic):]
+		copy(nonce[:], body)
+		cleartext, ok := secretbox.Open(nil, body[NonceSize:], &nonce,
+			&k.Data)
+		if !ok {
+			f.Fatal("could not open seed")
+		}
+		f.Add(cleartext, true)
+	}
+	f.Add([]byte{}, false)
+	f.Add(Magic[:], false)
+	f.Add(make([]byte, len(Magic)+NonceSize+secretbox.Overhead), false)
+
+	f.Fuzz(func(t *testing.T, body []byte, seal bool) {
+		if seal {
+			body = append(append(append([]byte(nil), Magic[:]...),
+				nonce[:]...),
+				secretbox.Seal(nil, body, &nonce, &k.Data)...)
+		}
+		h, content, err := NaClDecrypt(body, &k.Data)
+		if err == nil && (h == nil || uint64(len(content)) != h.Size) {
+			t.Fatalf("decrypted %v bytes, header %+v", len(content), h)
+		}
+	})
+}
+
+func FuzzKeysDecrypt(f *testing.F) {
+	password := []byte("password")
+	blob, err := testKeys().Encrypt(password, fuzzN, fuzzR, fuzzP)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(blob)
+	f.Add([]byte{})
+	f.Add(blob[:len(blob)-1])
+	f.Add(make([]byte, KeySize+NonceSize+secretbox.Overhead))
+
+	f.Fuzz(func(t *testing.T, blob []byte) {
+		k, err := KeysDecrypt(password, fuzzN, fuzzR, fuzzP, blob)
+		if err == nil && k == nil {
+			t.Fatal("no keys and no error")
+		}
+	})
+}
+
+// sealed returns content sealed with key as a container body, with or
+// without Magic.
+func sealed(content []byte, key *[KeySize]byte, magic bool) []byte {
+	var (
+		nonce [NonceSize]byte
+		b     []byte
+	)
+	if magic {
+		b = append(b, Magic[:]...)
+	}
+	b = append(b, nonce[:]...)
+	return secretbox.Seal(b, content, &nonce, key)
+}
+
+func TestNaClDecryptBounds(t *testing.T) {
+	k := testKeys()
+	content := []byte("hello world")
+	_, payload, _, err := NaClEncrypt(bytes.NewReader(content),
+		int64(len(content)), DefaultCompressOptions(0), DigestSHA256,
+		&k.Data, &k.Dedup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	min := NonceSize + secretbox.Overhead
+
+	tests := []struct {
+		name string
+		body []byte
+		want error // nil is any error
+	}{
+		{"empty", nil, ErrNotSFE},
+		{"1 byte", []byte{1}, ErrNotSFE},
+		{"legacy short", make([]byte, min-1), ErrNotSFE},
+		{"legacy minimum", make([]byte, min), ErrNotSFE},
+		{"magic", Magic[:], nil},
+		{"magic short", append(Magic[:len(Magic):len(Magic)],
+			make([]byte, min-1)...), nil},
+		{"magic minimum", append(Magic[:len(Magic):len(Magic)],
+			make([]byte, min)...), nil},
+		{"sealed empty", sealed(nil, &k.Data, true), nil},
+		{"sealed 1 byte", sealed([]byte{Version}, &k.Data, true), nil},
+		{"truncated", payload[:len(payload)-1], nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, err := NaClDecrypt(tt.body, &k.Data)
+			if err == nil {
+				t.Fatalf("decrypted %+v", h)
+			}
+			if tt.want != nil && err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	h, got, err := NaClDecrypt(payload, &k.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) || h.Size != uint64(len(content)) {
+		t.Fatalf("got %q, header %+v", got, h)
+	}
+}
+
+func TestKeysDecryptBounds(t *testing.T) {
+	password := []byte("password")
+	k := testKeys()
+	blob, err := k.Encrypt(password, fuzzN, fuzzR, fuzzP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	min := KeySize + NonceSize + secretbox.Overhead
+
+	for _, b := range [][]byte{
+		nil,
+		{1},
+		make([]byte, min-1),
+		make([]byte, min),
+		make([]byte, maxKeysBlob),
+		make([]byte, maxKeysBlob+1),
+		blob[:len(blob)-1],
+		append(blob[:len(blob):len(blob)], 0),
+	} {
+		_, err := KeysDecrypt(password, fuzzN, fuzzR, fuzzP, b)
+		if err == nil {
+			t.Fatalf("%v bytes: decrypted", len(b))
+		}
+	}
+
+	got, err := KeysDecrypt(password, fuzzN, fuzzR, fuzzP, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *k {
+		t.Fatal("wrong keys")
+	}
+}
+
+// logText returns size bytes of reproducible log-like text, which
+// compresses about as well as real logs.
+func logText(size int) []byte {
+	r := rand.New(rand.NewSource(1))
+	levels := []string{"DBG", "INF", "WRN", "ERR"}
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "2016-01-02 15:04:%02d.%06d [%v] request %v "+
+			"from 10.0.%v.%v took %vms\n", i%60, r.Intn(1e6),
+			levels[r.Intn(len(levels))], r.Int63(), r.Intn(256),
+			r.Intn(256), r.Intn(5000))
+	}
+	return b.Bytes()[:size]
+}
+
+// BenchmarkNaClEncrypt measures encryption of large inputs with compression
+// off, with a single pgzip block and with the default of a block per CPU.
+// Compare the block counts with e.g.:
+//
+//	go test -run X -bench NaClEncrypt -cpu 1,4 ./shared
+func BenchmarkNaClEncrypt(b *testing.B) {
+	k := testKeys()
+	for _, size := range []int{8 << 20, 64 << 20} {
+		content := logText(size)
+		for _, bc := range []struct {
+			name string
+			co   *CompressOptions
+		}{
+			{"none", DefaultCompressOptions(gzip.NoCompression)},
+			{"blocks=1", &CompressOptions{
+				Level:     gzip.DefaultCompression,
+				BlockSize: CompressBlockSize,
+				Blocks:    1,
+			}},
+			{"blocks=cpus", DefaultCompressOptions(
+				gzip.DefaultCompression)},
+		} {
+			name := fmt.Sprintf("%vMB/%v", size>>20, bc.name)
+			b.Run(name, func(b *testing.B) {
+				// the default follows -cpu
+				if bc.co.Blocks != 1 && bc.co.Level !=
+					gzip.NoCompression {
+					bc.co.Blocks = runtime.GOMAXPROCS(0)
+				}
+				b.SetBytes(int64(len(content)))
+				for i := 0; i < b.N; i++ {
+					_, _, _, err := NaClEncrypt(
+						bytes.NewReader(content),
+						int64(len(content)), bc.co,
+						DigestSHA256, &k.Data, &k.Dedup)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// fixedRandom makes random.Reader reproducible for the duration of t.
+func fixedRandom(t *testing.T) {
+	old := random.Reader
+	random.Reader = rand.New(rand.NewSource(1))
+	t.Cleanup(func() { random.Reader = old })
+}
+
+// checkGolden fails t unless the SHA256 of b is the hex encoded want.
+func checkGolden(t *testing.T, b []byte, want string) {
+	t.Helper()
+
+	sum := sha256.Sum256(b)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestNaClEncryptGolden(t *testing.T) {
+	fixedRandom(t)
+	k := testKeys()
+	content := logText(64 << 10)
+
+	// no compression, gzip output may change with the go version
+	_, payload, _, err := NaClEncrypt(bytes.NewReader(content),
+		int64(len(content)), DefaultCompressOptions(gzip.NoCompression),
+		DigestSHA256, &k.Data, &k.Dedup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, payload, "cffeb33ba2a7dfc1d158a1b2645b9f5e"+
+		"bfb67457c0006b49c42acfda7e872876")
+
+	_, got, err := NaClDecrypt(payload, &k.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("content differs")
+	}
+}
+
+func TestKeysEncryptGolden(t *testing.T) {
+	fixedRandom(t)
+	k := testKeys()
+	password := []byte("password")
+	b, err := k.Encrypt(password, fuzzN, fuzzR, fuzzP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, b, "8aa6ca2b4c5afd7b90deace2a406a66c"+
+		"897dfbbe7352de66e85f0fd93076a56f")
+
+	got, err := KeysDecrypt(password, fuzzN, fuzzR, fuzzP, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *k {
+		t.Fatal("keys differ")
+	}
+}
+
+func TestCompressedSize(t *testing.T) {
+	k := testKeys()
+	content := logText(2 * CompressParallelSize)
+	tests := []struct {
+		name string
+		size int
+		co   *CompressOptions
+	}{
+		{"none", len(content), DefaultCompressOptions(gzip.NoCompression)},
+		{"gzip", CompressParallelSize, &CompressOptions{
+			Level: gzip.DefaultCompression, Mode: CompressAlways}},
+		{"pgzip", len(content), &CompressOptions{
+			Level: gzip.DefaultCompression, Mode: CompressAlways,
+			BlockSize: CompressBlockSize, Blocks: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := content[:tt.size]
+			h, payload, _, err := NaClEncrypt(bytes.NewReader(c),
+				int64(len(c)), tt.co, DigestSHA256, &k.Data,
+				&k.Dedup)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// whatever is not overhead is content
+			var b bytes.Buffer
+			_, err = xdr.Marshal(&b, *h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := len(payload) - len(Magic) - NonceSize -
+				secretbox.Overhead - b.Len()
+			if h.CompressedSize() != want {
+				t.Fatalf("got %v, want %v", h.CompressedSize(),
+					want)
+			}
+			if tt.co.Level != gzip.NoCompression &&
+				want >= len(c) {
+				t.Fatalf("not compressed: %v", want)
+			}
+
+			// the size is not part of the encoded header
+			h, _, err = NaClDecrypt(payload, &k.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.CompressedSize() != 0 {
+				t.Fatalf("decoded %v", h.CompressedSize())
+			}
+		})
+	}
+}